@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/bundle"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/urfave/cli/v2"
+)
+
+var exportCommand = &cli.Command{
+	Name:      "export",
+	Usage:     "Write cached files to a bundle for another hub",
+	ArgsUsage: "[<type>|<type>/<key>]...",
+	Description: "The bundle is a zstd compressed tar archive with a manifest listing the size and\n" +
+		"sha256 of every file. Without arguments, all proxied repositories are exported.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Config path",
+			Value:   "config.yaml",
+			EnvVars: []string{"HUB_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Usage:    "Bundle path, - for stdout",
+			Required: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "package",
+			Usage: "Only export this package",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Only export files fetched since this time, as RFC 3339 or a duration such as 24h",
+		},
+	},
+	Action: exportBundle,
+}
+
+var importCommand = &cli.Command{
+	Name:      "import",
+	Usage:     "Load a bundle written by hub export into the cache",
+	ArgsUsage: "<bundle>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Config path",
+			Value:   "config.yaml",
+			EnvVars: []string{"HUB_CONFIG"},
+		},
+		&cli.BoolFlag{Name: "dry-run", Usage: "Only verify the bundle"},
+	},
+	Action: importBundle,
+}
+
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q, expected RFC 3339 or a duration", s)
+	}
+	return t, nil
+}
+
+func exportBundle(c *cli.Context) error {
+	since, err := parseSince(c.String("since"))
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+	entries, err := loadCacheEntries(c)
+	if err != nil {
+		return err
+	}
+	filters := c.Args().Slice()
+	packages := c.StringSlice("package")
+	selected := entries[:0]
+	for _, e := range entries {
+		if e.Repository == "" ||
+			len(filters) > 0 && !slices.ContainsFunc(filters, func(f string) bool { return matchesRepository(e, f) }) ||
+			len(packages) > 0 && !slices.ContainsFunc(packages, func(p string) bool { return storage.InPackage(e, p) }) ||
+			e.Changed.Before(since) {
+			continue
+		}
+		selected = append(selected, e)
+	}
+
+	var w io.Writer = os.Stdout
+	output := c.String("output")
+	if output != "-" {
+		f, errCreate := os.Create(output)
+		if errCreate != nil {
+			return errCreate
+		}
+		defer f.Close()
+		w = f
+	}
+	manifest, err := bundle.Export(w, cfg.Dir, selected, since)
+	if err != nil {
+		if output != "-" {
+			_ = os.Remove(output)
+		}
+		return fmt.Errorf("export: %v", err)
+	}
+
+	var size int64
+	repositories := map[string]int{}
+	for _, f := range manifest.Files {
+		size += f.Size
+		ecosystem, rest, _ := strings.Cut(f.Path, "/")
+		key, _, _ := strings.Cut(rest, "/")
+		repositories[ecosystem+"/"+key]++
+	}
+	// The summary goes to stderr, as the bundle may be written to stdout.
+	for _, name := range slices.Sorted(maps.Keys(repositories)) {
+		fmt.Fprintf(os.Stderr, "%s: %d files\n", name, repositories[name])
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d files (%s)\n", len(manifest.Files), types.ByteSize(size))
+	return nil
+}
+
+func importBundle(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("usage: hub import [options] <bundle>", 2)
+	}
+	cfg.Load(c.String("config"))
+	var r io.Reader = os.Stdin
+	if name := c.Args().First(); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	dryRun := c.Bool("dry-run")
+	result, err := bundle.Import(r, cfg.Dir, dryRun)
+	if err != nil {
+		return fmt.Errorf("import: %v", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(result.Failed)) {
+		fmt.Printf("FAILED %s: %s\n", name, result.Failed[name])
+	}
+	verb := "Imported"
+	if dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d files (%s), %d unchanged, %d failed\n", verb, len(result.Imported), types.ByteSize(result.Bytes), len(result.Unchanged), len(result.Failed))
+	if len(result.Failed) > 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/urfave/cli/v2"
+)
+
+var cacheCommand = &cli.Command{
+	Name:  "cache",
+	Usage: "Inspect and maintain the cache directory",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Config path",
+			Value:   "config.yaml",
+			EnvVars: []string{"HUB_CONFIG"},
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:      "ls",
+			Usage:     "List repositories, or packages and versions of a repository",
+			ArgsUsage: "[<type>/<key> [package]]",
+			Action:    cacheList,
+		},
+		{
+			Name:      "du",
+			Usage:     "Show disk usage per repository",
+			ArgsUsage: "[<type>|<type>/<key>]",
+			Action:    cacheUsage,
+		},
+		{
+			Name:      "rm",
+			Usage:     "Remove a repository, a package or a package version from the cache",
+			ArgsUsage: "<type>/<key> [package [version]]",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "dry-run", Usage: "Only print what would be removed"},
+			},
+			Action: cacheRemove,
+		},
+		{
+			Name:  "gc",
+			Usage: "Remove leftovers of interrupted downloads, orphaned metadata and empty directories",
+			Flags: []cli.Flag{
+				&cli.DurationFlag{Name: "older-than", Usage: "Only remove temporary files older than this", Value: time.Hour},
+				&cli.BoolFlag{Name: "dry-run", Usage: "Only print what would be removed"},
+			},
+			Action: cacheGC,
+		},
+		{
+			Name:      "verify",
+			Usage:     "Verify cached artifacts against the checksums in the cached metadata",
+			ArgsUsage: "[<type>|<type>/<key>]...",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "delete", Usage: "Remove artifacts that don't match their checksum"},
+			},
+			Action: cacheVerify,
+		},
+	},
+}
+
+func loadCacheEntries(c *cli.Context) ([]storage.Entry, error) {
+	cfg.Load(c.String("config"))
+	entries, err := storage.Scan(cfg.Dir, storage.LocalDirs(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("scan %s: %v", cfg.Dir, err)
+	}
+	return entries, nil
+}
+
+// matchesRepository reports whether e belongs to filter, which is either a
+// repository type or "<type>/<key>". An empty filter matches everything.
+func matchesRepository(e storage.Entry, filter string) bool {
+	return filter == "" || e.Repository == filter || e.Ecosystem == filter
+}
+
+func cacheList(c *cli.Context) error {
+	entries, err := loadCacheEntries(c)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	repo := c.Args().Get(0)
+	if repo == "" {
+		type summary struct {
+			packages map[string]bool
+			files    int
+			size     int64
+		}
+		repositories := map[string]*summary{}
+		for _, e := range entries {
+			if e.Repository == "" {
+				continue
+			}
+			s, ok := repositories[e.Repository]
+			if !ok {
+				s = &summary{packages: map[string]bool{}}
+				repositories[e.Repository] = s
+			}
+			s.files++
+			s.size += e.Size
+			if pkg, _, ok := storage.ParseArtifact(e); ok && !e.Metadata {
+				s.packages[pkg] = true
+			}
+		}
+		fmt.Fprintln(w, "REPOSITORY\tPACKAGES\tFILES\tSIZE")
+		for _, name := range slices.Sorted(maps.Keys(repositories)) {
+			s := repositories[name]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", name, len(s.packages), s.files, types.ByteSize(s.size))
+		}
+		return nil
+	}
+
+	filter := c.Args().Get(1)
+	fmt.Fprintln(w, "PACKAGE\tVERSION\tSIZE\tLAST ACCESS")
+	for _, e := range entries {
+		if e.Repository != repo || e.Metadata {
+			continue
+		}
+		pkg, version, ok := storage.ParseArtifact(e)
+		if !ok || filter != "" && pkg != filter {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", pkg, version, types.ByteSize(e.Size), e.Accessed.Format(time.DateTime))
+	}
+	return nil
+}
+
+func cacheUsage(c *cli.Context) error {
+	entries, err := loadCacheEntries(c)
+	if err != nil {
+		return err
+	}
+	type usage struct {
+		artifacts int64
+		metadata  int64
+	}
+	filter := c.Args().Get(0)
+	repositories := map[string]*usage{}
+	var total usage
+	for _, e := range entries {
+		if !matchesRepository(e, filter) {
+			continue
+		}
+		name := e.Repository
+		if name == "" {
+			name = "-"
+		}
+		u, ok := repositories[name]
+		if !ok {
+			u = &usage{}
+			repositories[name] = u
+		}
+		if e.Metadata {
+			u.metadata += e.Size
+			total.metadata += e.Size
+		} else {
+			u.artifacts += e.Size
+			total.artifacts += e.Size
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "REPOSITORY\tARTIFACTS\tMETADATA\tTOTAL")
+	for _, name := range slices.Sorted(maps.Keys(repositories)) {
+		u := repositories[name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, types.ByteSize(u.artifacts), types.ByteSize(u.metadata), types.ByteSize(u.artifacts+u.metadata))
+	}
+	fmt.Fprintf(w, "TOTAL\t%s\t%s\t%s\n", types.ByteSize(total.artifacts), types.ByteSize(total.metadata), types.ByteSize(total.artifacts+total.metadata))
+	return nil
+}
+
+func cacheRemove(c *cli.Context) error {
+	repo, pkg, version := c.Args().Get(0), c.Args().Get(1), c.Args().Get(2)
+	if repo == "" {
+		return cli.Exit("usage: hub cache rm <type>/<key> [package [version]]", 2)
+	}
+	entries, err := loadCacheEntries(c)
+	if err != nil {
+		return err
+	}
+	targets, err := storage.PurgeTargets(cfg.Dir, entries, repo, pkg, version)
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+	dryRun := c.Bool("dry-run")
+
+	removed := 0
+	for _, target := range targets {
+		if _, err = os.Stat(target); err != nil {
+			continue
+		}
+		fmt.Println(target)
+		removed++
+		if dryRun {
+			continue
+		}
+		if err = os.RemoveAll(target); err != nil {
+			return fmt.Errorf("remove %s: %v", target, err)
+		}
+	}
+	if removed == 0 {
+		return cli.Exit("nothing to remove", 1)
+	}
+	return nil
+}
+
+func cacheGC(c *cli.Context) error {
+	cfg.Load(c.String("config"))
+	dryRun := c.Bool("dry-run")
+	result, err := storage.GC(cfg.Dir, storage.LocalDirs(cfg), c.Duration("older-than"), dryRun)
+	for _, p := range slices.Concat(result.Temporary, result.Orphans, result.Dirs) {
+		fmt.Println(p)
+	}
+	if err != nil {
+		return err
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d temporary files, %d orphaned metadata files (%s) and %d empty directories\n",
+		verb, len(result.Temporary), len(result.Orphans), types.ByteSize(result.Bytes), len(result.Dirs))
+	return nil
+}
+
+func cacheVerify(c *cli.Context) error {
+	entries, err := loadCacheEntries(c)
+	if err != nil {
+		return err
+	}
+	verifier, err := storage.NewVerifier(cfg.Dir)
+	if err != nil {
+		return err
+	}
+	filters := c.Args().Slice()
+
+	var verified, unknown, corrupted int
+	for _, e := range entries {
+		if e.Metadata || len(filters) > 0 && !slices.ContainsFunc(filters, func(f string) bool { return matchesRepository(e, f) }) {
+			continue
+		}
+		err = verifier.Verify(e)
+		switch {
+		case err == nil:
+			verified++
+		case errors.Is(err, storage.ErrNoChecksum):
+			unknown++
+		default:
+			corrupted++
+			fmt.Printf("%s: %v\n", e.Path, err)
+			if c.Bool("delete") {
+				if errRemove := os.Remove(e.Path); errRemove != nil {
+					fmt.Printf("%s: %v\n", e.Path, errRemove)
+				}
+			}
+		}
+	}
+	fmt.Printf("%d verified, %d without checksum, %d corrupted\n", verified, unknown, corrupted)
+	if corrupted > 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
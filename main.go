@@ -4,15 +4,21 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/psvmcc/hub/pkg/admin"
+	"github.com/psvmcc/hub/pkg/auth"
 	"github.com/psvmcc/hub/pkg/handlers"
 	"github.com/psvmcc/hub/pkg/logging"
+	"github.com/psvmcc/hub/pkg/storage"
 	"github.com/psvmcc/hub/pkg/templates"
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
 	"github.com/psvmcc/hub/pkg/victoriametrics"
 
 	"github.com/VictoriaMetrics/metrics"
@@ -63,9 +69,18 @@ func main() {
 					Value:   "config.yaml",
 					EnvVars: []string{"HUB_CONFIG"},
 				},
+				&cli.BoolFlag{
+					Name:    "offline",
+					Usage:   "Serve only from the cache and never contact upstream",
+					EnvVars: []string{"HUB_OFFLINE"},
+				},
 			},
 			Action: startServer,
 		},
+		cacheCommand,
+		warmCommand,
+		exportCommand,
+		importCommand,
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -78,7 +93,60 @@ func startServer(c *cli.Context) error {
 	cfg.Load(c.String("config"))
 	logger := logging.Build(c.Bool("verbose"))
 	zap.ReplaceGlobals(logger)
+	if err := upstream.Setup(cfg); err != nil {
+		log.Fatalf("Upstream client setup error: %v", err)
+	}
+	if err := storage.Setup(cfg); err != nil {
+		log.Fatalf("Cache config error: %v", err)
+	}
+	if keys := slices.Sorted(maps.Keys(cfg.Server.Terraform)); len(keys) > 1 {
+		zap.S().Infof("Terraform service discovery at /.well-known/terraform.json serves %q; the other Terraform repositories need a host named after their key or a host block in the CLI configuration", keys[0])
+	}
+	if c.Bool("offline") {
+		upstream.SetOffline(true)
+		zap.S().Warn("Offline mode: serving from the cache only")
+	}
+
+	httpLogger := zap.S().Named("http")
+	middlewares := []echo.MiddlewareFunc{withContext(httpLogger), requestLogger}
+	if cfg.Auth.Enabled() {
+		authenticator, err := auth.New(cfg.Auth)
+		if err != nil {
+			log.Fatalf("Auth config error: %v", err)
+		}
+		middlewares = append(middlewares, authenticator.Middleware())
+	}
+	e := newServer(middlewares...)
+
+	if cfg.Admin.Enabled {
+		if !cfg.Auth.Enabled() {
+			log.Fatal("[ADMIN] The admin API requires the auth section to be configured.")
+		}
+		// Prefetching goes through the regular handlers, without the access
+		// checks and request logging of client requests.
+		warmer := newServer(withContext(httpLogger))
+		if cfg.Admin.Bind == "" {
+			admin.Register(e.Group("/-/admin"), cfg.Admin, warmer)
+		} else {
+			a := echo.New()
+			a.HideBanner = true
+			a.HidePort = true
+			a.Use(middlewares...)
+			admin.Register(a.Group("/-/admin"), cfg.Admin, warmer)
+			go func() {
+				log.Fatal(a.Start(cfg.Admin.Bind))
+			}()
+		}
+	}
 
+	go func() {
+		log.Fatal(e.Start(c.String("bind")))
+	}()
+	return victoriametrics.ListenMetricsServer(c.String("self-exporter-bind"))
+}
+
+// newServer builds the echo instance serving all configured repositories.
+func newServer(middlewares ...echo.MiddlewareFunc) *echo.Echo {
 	echo.NotFoundHandler = func(c echo.Context) error {
 		return c.String(http.StatusNotFound, "404 page not found")
 	}
@@ -91,58 +159,7 @@ func startServer(c *cli.Context) error {
 		echo.TrustPrivateNet(false),
 	)
 
-	httpLogger := zap.S().Named("http")
-
-	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			c.Set("cfg", cfg)
-			c.Set("logger", httpLogger)
-			c.Response().Header().Set("Server", fmt.Sprintf("hub/%s (%s)", version, commit))
-			return next(c)
-		}
-	})
-
-	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) (err error) {
-			req := c.Request()
-			res := c.Response()
-			if strings.HasPrefix(req.RequestURI, "/ping") {
-				return err
-			}
-			start := time.Now()
-			if err = next(c); err != nil {
-				c.Error(err)
-			}
-			stop := time.Now()
-			cacheStatus := res.Header().Get("X-Cache-Status")
-			if cacheStatus == "" {
-				cacheStatus = "UNKNOWN"
-			}
-			message := fmt.Sprintf(
-				"[%s] %s %s requested from %s with status %d in %s [%s] cache=%s",
-				c.Request().Host,
-				req.Method,
-				req.RequestURI,
-				c.RealIP(),
-				res.Status,
-				stop.Sub(start).String(),
-				c.Path(),
-				cacheStatus,
-			)
-
-			logger := c.Get("logger").(*zap.SugaredLogger)
-
-			if res.Status >= 100 && res.Status <= 399 {
-				logger.Named("req").Info(message)
-			} else if res.Status >= 400 && res.Status <= 499 {
-				logger.Named("req").Warn(message)
-			} else {
-				logger.Named("req").Error(message)
-			}
-
-			return err
-		}
-	})
+	e.Use(middlewares...)
 
 	e.Renderer = &templates.TemplateRegistry{
 		Templates: template.Must(template.New("pypi").Funcs(template.FuncMap{"kindIs": templates.KindIs}).Parse(templates.PypiHTML)),
@@ -196,6 +213,97 @@ func startServer(c *cli.Context) error {
 		n.GET("/*", handlers.NpmProxy(k)).Name = fmt.Sprintf("npm::%s", k)
 	}
 
+	for k := range cfg.Server.Maven {
+		m := e.Group(fmt.Sprintf("/maven/%s", k))
+		m.GET("/*", handlers.Maven(k)).Name = fmt.Sprintf("maven::%s", k)
+		m.HEAD("/*", handlers.Maven(k)).Name = fmt.Sprintf("maven::%s::head", k)
+	}
+
+	for k := range cfg.Server.APT {
+		a := e.Group(fmt.Sprintf("/apt/%s", k))
+		a.GET("/*", handlers.APT(k)).Name = fmt.Sprintf("apt::%s", k)
+		a.HEAD("/*", handlers.APT(k)).Name = fmt.Sprintf("apt::%s::head", k)
+	}
+
+	for k := range cfg.Server.APK {
+		a := e.Group(fmt.Sprintf("/apk/%s", k))
+		a.GET("/*", handlers.APK(k)).Name = fmt.Sprintf("apk::%s", k)
+		a.HEAD("/*", handlers.APK(k)).Name = fmt.Sprintf("apk::%s::head", k)
+	}
+
+	for k, source := range cfg.Server.RPM {
+		if source.URL == "" && source.Mirrorlist == "" && source.Metalink == "" {
+			log.Fatalf("[RPM] Wrong config definition for [%s], please set url, mirrorlist or metalink.", k)
+		}
+		r := e.Group(fmt.Sprintf("/rpm/%s", k))
+		r.GET("/*", handlers.RPM(k)).Name = fmt.Sprintf("rpm::%s", k)
+		r.HEAD("/*", handlers.RPM(k)).Name = fmt.Sprintf("rpm::%s::head", k)
+	}
+
+	for k := range cfg.Server.Helm {
+		h := e.Group(fmt.Sprintf("/helm/%s", k))
+		h.GET("/index.yaml", handlers.HelmIndex(k)).Name = fmt.Sprintf("helm::%s::index", k)
+		h.GET("/charts/:name/:version/:file", handlers.HelmChartDownload(k)).Name = fmt.Sprintf("helm::%s::chart", k)
+	}
+
+	for k := range cfg.Server.NuGet {
+		n := e.Group(fmt.Sprintf("/nuget/%s", k))
+		n.GET("/*", handlers.NuGet(k)).Name = fmt.Sprintf("nuget::%s", k)
+		n.HEAD("/*", handlers.NuGet(k)).Name = fmt.Sprintf("nuget::%s::head", k)
+	}
+
+	for k := range cfg.Server.Composer {
+		p := e.Group(fmt.Sprintf("/composer/%s", k))
+		p.GET("/*", handlers.Composer(k)).Name = fmt.Sprintf("composer::%s", k)
+		p.HEAD("/*", handlers.Composer(k)).Name = fmt.Sprintf("composer::%s::head", k)
+	}
+
+	for k := range cfg.Server.Terraform {
+		t := e.Group(fmt.Sprintf("/terraform/%s", k))
+		t.GET("/*", handlers.Terraform(k)).Name = fmt.Sprintf("terraform::%s", k)
+		t.HEAD("/*", handlers.Terraform(k)).Name = fmt.Sprintf("terraform::%s::head", k)
+	}
+	for k := range cfg.Server.Conda {
+		d := e.Group(fmt.Sprintf("/conda/%s", k))
+		d.GET("/*", handlers.Conda(k)).Name = fmt.Sprintf("conda::%s", k)
+		d.HEAD("/*", handlers.Conda(k)).Name = fmt.Sprintf("conda::%s::head", k)
+	}
+	for k := range cfg.Server.Hex {
+		x := e.Group(fmt.Sprintf("/hex/%s", k))
+		x.GET("/*", handlers.Hex(k)).Name = fmt.Sprintf("hex::%s", k)
+		x.HEAD("/*", handlers.Hex(k)).Name = fmt.Sprintf("hex::%s::head", k)
+	}
+	for k := range cfg.Server.Pub {
+		p := e.Group(fmt.Sprintf("/pub/%s", k))
+		p.GET("/*", handlers.Pub(k)).Name = fmt.Sprintf("pub::%s", k)
+		p.HEAD("/*", handlers.Pub(k)).Name = fmt.Sprintf("pub::%s::head", k)
+	}
+	for k := range cfg.Server.CRAN {
+		r := e.Group(fmt.Sprintf("/cran/%s", k))
+		r.GET("/*", handlers.CRAN(k)).Name = fmt.Sprintf("cran::%s", k)
+		r.HEAD("/*", handlers.CRAN(k)).Name = fmt.Sprintf("cran::%s::head", k)
+	}
+	for k := range cfg.Server.CPAN {
+		p := e.Group(fmt.Sprintf("/cpan/%s", k))
+		p.GET("/*", handlers.CPAN(k)).Name = fmt.Sprintf("cpan::%s", k)
+		p.HEAD("/*", handlers.CPAN(k)).Name = fmt.Sprintf("cpan::%s::head", k)
+	}
+	// Terraform only looks for service discovery at the root of a host, which
+	// lists the services of a single repository.
+	if keys := slices.Sorted(maps.Keys(cfg.Server.Terraform)); len(keys) > 0 {
+		e.GET("/.well-known/terraform.json", handlers.TerraformRootDiscovery(keys[0])).Name = "terraform::discovery"
+	}
+
+	if len(cfg.Server.OCI) > 0 {
+		e.GET("/v2/", handlers.OCIBase()).Name = "oci::base"
+		e.GET("/v2", handlers.OCIBase()).Name = "oci::base::noslash"
+	}
+	for k := range cfg.Server.OCI {
+		o := e.Group(fmt.Sprintf("/v2/%s", k))
+		o.GET("/*", handlers.OCI(k)).Name = fmt.Sprintf("oci::%s", k)
+		o.HEAD("/*", handlers.OCI(k)).Name = fmt.Sprintf("oci::%s::head", k)
+	}
+
 	for k, source := range cfg.Server.Cargo {
 		if source.Base == "" {
 			log.Fatal("[CARGO] Wrong config definition, please set base URL.")
@@ -236,8 +344,59 @@ func startServer(c *cli.Context) error {
 		}
 	}
 
-	go func() {
-		log.Fatal(e.Start(c.String("bind")))
-	}()
-	return victoriametrics.ListenMetricsServer(c.String("self-exporter-bind"))
+	return e
+}
+
+func withContext(logger *zap.SugaredLogger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("cfg", cfg)
+			c.Set("logger", logger)
+			c.Response().Header().Set("Server", fmt.Sprintf("hub/%s (%s)", version, commit))
+			return next(c)
+		}
+	}
+}
+
+func requestLogger(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		req := c.Request()
+		res := c.Response()
+		if strings.HasPrefix(req.RequestURI, "/ping") {
+			return err
+		}
+		start := time.Now()
+		if err = next(c); err != nil {
+			c.Error(err)
+		}
+		stop := time.Now()
+		cacheStatus := res.Header().Get("X-Cache-Status")
+		if cacheStatus == "" {
+			cacheStatus = "UNKNOWN"
+		}
+		storage.RecordRequest(types.RepositoryFromPath(req.URL.Path), cacheStatus)
+		message := fmt.Sprintf(
+			"[%s] %s %s requested from %s with status %d in %s [%s] cache=%s",
+			c.Request().Host,
+			req.Method,
+			req.RequestURI,
+			c.RealIP(),
+			res.Status,
+			stop.Sub(start).String(),
+			c.Path(),
+			cacheStatus,
+		)
+
+		logger := c.Get("logger").(*zap.SugaredLogger)
+
+		if res.Status >= 100 && res.Status <= 399 {
+			logger.Named("req").Info(message)
+		} else if res.Status >= 400 && res.Status <= 499 {
+			logger.Named("req").Warn(message)
+		} else {
+			logger.Named("req").Error(message)
+		}
+
+		return err
+	}
 }
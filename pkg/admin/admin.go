@@ -0,0 +1,400 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/auth"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+	"github.com/psvmcc/hub/pkg/warm"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLimit    = 1000
+	maxLockfileSize = 32 << 20
+)
+
+var defaultAccess = []string{"@admin"}
+
+type Entry struct {
+	Repository string    `json:"repository"`
+	Path       string    `json:"path"`
+	Package    string    `json:"package,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Size       int64     `json:"size"`
+	Metadata   bool      `json:"metadata"`
+	Modified   time.Time `json:"modified"`
+	Accessed   time.Time `json:"accessed"`
+}
+
+type Usage struct {
+	Repository    string            `json:"repository"`
+	Files         int               `json:"files"`
+	ArtifactBytes int64             `json:"artifact_bytes"`
+	MetadataBytes int64             `json:"metadata_bytes"`
+	TotalBytes    int64             `json:"total_bytes"`
+	Requests      map[string]uint64 `json:"requests"`
+	HitRatio      float64           `json:"hit_ratio"`
+}
+
+type OfflineState struct {
+	Offline bool `json:"offline"`
+}
+
+type Result struct {
+	Paths []string `json:"paths"`
+	Count int      `json:"count"`
+	// Skipped lists the files a purge kept because they were in use.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Register adds the admin API to g. Requests must be authenticated by the
+// auth middleware and match one of the configured access principals. Cache
+// warming requests are served by warmer.
+func Register(g *echo.Group, cfg types.AdminConfig, warmer http.Handler) {
+	access := cfg.Access
+	if len(access) == 0 {
+		access = defaultAccess
+	}
+	g.Use(authorize(access))
+	g.GET("/repositories", Repositories()).Name = "admin::repositories"
+	g.GET("/usage", DiskUsage()).Name = "admin::usage"
+	g.GET("/entries", Entries()).Name = "admin::entries"
+	g.DELETE("/entries", Purge()).Name = "admin::purge"
+	g.POST("/revalidate", Revalidate()).Name = "admin::revalidate"
+	g.POST("/warm", Warm(warmer)).Name = "admin::warm"
+	g.GET("/offline", Offline()).Name = "admin::offline"
+	g.PUT("/offline", SetOffline()).Name = "admin::offline::set"
+}
+
+func authorize(access []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id, _ := c.Get("identity").(*auth.Identity)
+			if auth.Matches(access, id) {
+				return next(c)
+			}
+			if id == nil {
+				c.Response().Header().Set("WWW-Authenticate", `Basic realm="hub"`)
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			}
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "forbidden"})
+		}
+	}
+}
+
+func Repositories() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		return c.JSON(http.StatusOK, types.ConfiguredRepositories(cfg))
+	}
+}
+
+func DiskUsage() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+
+		entries, err := storage.Scan(cfg.Dir, storage.LocalDirs(cfg))
+		if err != nil {
+			logger.Named("admin").Errorf("Scan error: %s", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+		usage := map[string]*Usage{}
+		for _, r := range types.ConfiguredRepositories(cfg) {
+			usage[r.Name] = &Usage{Repository: r.Name}
+		}
+		for _, e := range entries {
+			if e.Repository == "" {
+				continue
+			}
+			u, ok := usage[e.Repository]
+			if !ok {
+				u = &Usage{Repository: e.Repository}
+				usage[e.Repository] = u
+			}
+			u.Files++
+			u.TotalBytes += e.Size
+			if e.Metadata {
+				u.MetadataBytes += e.Size
+			} else {
+				u.ArtifactBytes += e.Size
+			}
+		}
+
+		result := make([]*Usage, 0, len(usage))
+		for _, u := range usage {
+			u.Requests = storage.Requests(u.Repository)
+			var total uint64
+			for _, n := range u.Requests {
+				total += n
+			}
+			if total > 0 {
+				u.HitRatio = float64(u.Requests["HIT"]) / float64(total)
+			}
+			result = append(result, u)
+		}
+		slices.SortFunc(result, func(a, b *Usage) int { return strings.Compare(a.Repository, b.Repository) })
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// selection is the set of cached files a request refers to, chosen with
+// the repository, package, version, prefix and q query parameters.
+type selection struct {
+	repository string
+	pkg        string
+	version    string
+	prefix     string
+	query      string
+}
+
+func newSelection(c echo.Context) selection {
+	return selection{
+		repository: c.QueryParam("repository"),
+		pkg:        c.QueryParam("package"),
+		version:    c.QueryParam("version"),
+		prefix:     strings.TrimPrefix(c.QueryParam("prefix"), "/"),
+		query:      c.QueryParam("q"),
+	}
+}
+
+func (s selection) scan(cfg types.ConfigFile) ([]storage.Entry, error) {
+	if s.repository == "" {
+		return storage.Scan(cfg.Dir, storage.LocalDirs(cfg))
+	}
+	return storage.ScanRepository(cfg.Dir, s.repository)
+}
+
+func (s selection) matches(e storage.Entry) bool {
+	if s.prefix != "" && !strings.HasPrefix(e.Name, s.prefix) {
+		return false
+	}
+	if s.query != "" && !strings.Contains(e.Name, s.query) {
+		return false
+	}
+	if s.pkg == "" {
+		return true
+	}
+	if s.version == "" {
+		return storage.InPackage(e, s.pkg)
+	}
+	pkg, version, ok := storage.ParseArtifact(e)
+	return ok && pkg == s.pkg && version == s.version
+}
+
+func Entries() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		sel := newSelection(c)
+		limit := defaultLimit
+		if v, err := strconv.Atoi(c.QueryParam("limit")); err == nil && v > 0 {
+			limit = v
+		}
+
+		entries, err := sel.scan(cfg)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		result := []Entry{}
+		for _, e := range entries {
+			if !sel.matches(e) {
+				continue
+			}
+			if len(result) >= limit {
+				c.Response().Header().Set("X-Truncated", "true")
+				break
+			}
+			pkg, version, _ := storage.ParseArtifact(e)
+			result = append(result, Entry{
+				Repository: e.Repository,
+				Path:       e.Name,
+				Package:    pkg,
+				Version:    version,
+				Size:       e.Size,
+				Metadata:   e.Metadata,
+				Modified:   e.Modified,
+				Accessed:   e.Accessed,
+			})
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+func Purge() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		sel := newSelection(c)
+		if sel.repository == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "repository is required"})
+		}
+		entries, err := sel.scan(cfg)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		var targets []string
+		if sel.prefix == "" && sel.query == "" {
+			targets, err = storage.PurgeTargets(cfg.Dir, entries, sel.repository, sel.pkg, sel.version)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+			}
+		} else {
+			for _, e := range entries {
+				if sel.matches(e) {
+					targets = append(targets, e.Path)
+				}
+			}
+		}
+
+		result := Result{Paths: []string{}}
+		for _, target := range targets {
+			if _, err = os.Stat(target); err != nil {
+				continue
+			}
+			skipped, errRemove := storage.RemoveAll(target)
+			if errRemove != nil {
+				logger.Named("admin").Errorf("Purge %s error: %s", target, errRemove)
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": errRemove.Error()})
+			}
+			result.Paths = append(result.Paths, relative(cfg.Dir, target))
+			for _, file := range skipped {
+				result.Skipped = append(result.Skipped, relative(cfg.Dir, file))
+			}
+		}
+		result.Count = len(result.Paths)
+		logger.Named("admin").Infof("Purged %d paths from %s by %v", result.Count, sel.repository, c.Get("user"))
+		if len(result.Skipped) > 0 {
+			logger.Named("admin").Infof("Kept %d files in use while purging %s", len(result.Skipped), sel.repository)
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// Revalidate marks the selected files as outdated, so the next request for
+// them is checked against upstream.
+func Revalidate() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		sel := newSelection(c)
+		if sel.repository == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "repository is required"})
+		}
+		entries, err := sel.scan(cfg)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		result := Result{Paths: []string{}}
+		for _, e := range entries {
+			if storage.IsSidecar(e.Path) || !sel.matches(e) {
+				continue
+			}
+			if err = storage.Invalidate(e.Path); err != nil {
+				logger.Named("admin").Errorf("Revalidate %s error: %s", e.Path, err)
+				continue
+			}
+			result.Paths = append(result.Paths, relative(cfg.Dir, e.Path))
+		}
+		result.Count = len(result.Paths)
+		logger.Named("admin").Infof("Marked %d paths of %s for revalidation by %v", result.Count, sel.repository, c.Get("user"))
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// Warm prefetches the packages of the lockfile in the request body. The
+// lockfile kind is taken from the type or the file query parameter.
+func Warm(warmer http.Handler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		kind := c.QueryParam("type")
+		if kind == "" {
+			var ok bool
+			if kind, ok = warm.Detect(c.QueryParam("file")); !ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "unknown lockfile, set the type or file parameter"})
+			}
+		}
+		opts := warm.Options{Repositories: map[string]string{}}
+		for _, r := range c.QueryParams()["repository"] {
+			ecosystem, key, ok := strings.Cut(r, "=")
+			if !ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid repository %q, expected <type>=<key>", r)})
+			}
+			opts.Repositories[ecosystem] = key
+		}
+		if v := c.QueryParam("concurrency"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid concurrency"})
+			}
+			opts.Concurrency = n
+		}
+
+		data, err := io.ReadAll(io.LimitReader(c.Request().Body, maxLockfileSize))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		packages, err := warm.Parse(kind, data)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		report, err := warm.Run(c.Request().Context(), warmer, cfg, packages, opts)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		logger.Named("admin").Infof("Warmed %d packages (%d files, %d failures) from %s by %v", report.Packages, report.Files, len(report.Failures), kind, c.Get("user"))
+		return c.JSON(http.StatusOK, report)
+	}
+}
+
+func Offline() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, OfflineState{Offline: upstream.Offline()})
+	}
+}
+
+// SetOffline switches offline mode with a {"offline": bool} body.
+func SetOffline() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		var state OfflineState
+		if err := json.NewDecoder(c.Request().Body).Decode(&state); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid body: %v", err)})
+		}
+		if upstream.Offline() != state.Offline {
+			upstream.SetOffline(state.Offline)
+			logger.Named("admin").Warnf("Offline mode set to %t by %v", state.Offline, c.Get("user"))
+		}
+		return c.JSON(http.StatusOK, state)
+	}
+}
+
+func relative(dir, path string) string {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if rel, err := filepath.Rel(root, path); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/logging"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicCacheTTL bounds how long a verified basic password is remembered, so
+// package managers issuing hundreds of requests don't pay for bcrypt on
+// every one of them.
+const basicCacheTTL = 5 * time.Minute
+
+var errBadCredentials = errors.New("invalid credentials")
+
+// Identity is an authenticated client.
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+type Authenticator struct {
+	cfg     types.AuthConfig
+	tokens  map[[32]byte]Identity
+	proxies []*net.IPNet
+
+	mu       sync.Mutex
+	verified map[[32]byte]time.Time
+}
+
+// New prepares the authenticator, resolving token secrets and trusted
+// proxy networks.
+func New(cfg types.AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		cfg:      cfg,
+		tokens:   map[[32]byte]Identity{},
+		verified: map[[32]byte]time.Time{},
+	}
+	for name, user := range cfg.Users {
+		if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+			return nil, fmt.Errorf("user %s: password must be a bcrypt hash: %v", name, err)
+		}
+	}
+	for i, t := range cfg.Tokens {
+		token, err := t.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("token %d: %v", i, err)
+		}
+		if token == "" || t.User == "" {
+			return nil, fmt.Errorf("token %d: user and token are required", i)
+		}
+		logging.AddSecrets(token)
+		a.tokens[sha256.Sum256([]byte(token))] = Identity{User: t.User, Groups: t.Groups}
+	}
+	for _, cidr := range cfg.TrustedHeader.Proxies {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %v", cidr, err)
+		}
+		a.proxies = append(a.proxies, network)
+	}
+	if cfg.TrustedHeader.User != "" && len(a.proxies) == 0 {
+		return nil, errors.New("trusted_header requires at least one proxy address")
+	}
+	return a, nil
+}
+
+// Middleware authenticates every request and enforces the repository ACLs.
+// Anonymous clients that are denied get a 401 challenge, authenticated ones
+// a 403.
+func (a *Authenticator) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			id, err := a.Authenticate(c.Request())
+			if err != nil {
+				return unauthorized(c)
+			}
+			if id != nil {
+				c.Set("user", id.User)
+				c.Set("identity", id)
+			}
+
+			repo := types.RepositoryFromPath(c.Request().URL.Path)
+			if repo == "" {
+				return next(c)
+			}
+			method := c.Request().Method
+			write := method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+			if Allowed(a.cfg, repo, id, write) {
+				return next(c)
+			}
+			if id == nil {
+				return unauthorized(c)
+			}
+			return c.String(http.StatusForbidden, "403 forbidden")
+		}
+	}
+}
+
+// Authenticate returns the identity of the request, nil for anonymous
+// requests, or an error when credentials were given but are wrong.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if a.cfg.TrustedHeader.User != "" && a.fromTrustedProxy(r) {
+		if user := r.Header.Get(a.cfg.TrustedHeader.User); user != "" {
+			id := &Identity{User: user}
+			if a.cfg.TrustedHeader.Groups != "" {
+				for g := range strings.SplitSeq(r.Header.Get(a.cfg.TrustedHeader.Groups), ",") {
+					if g = strings.TrimSpace(g); g != "" {
+						id.Groups = append(id.Groups, g)
+					}
+				}
+			}
+			return id, nil
+		}
+	}
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return a.basic(username, password)
+	}
+
+	token := header
+	if scheme, value, found := strings.Cut(header, " "); found {
+		switch strings.ToLower(scheme) {
+		case "bearer", "token":
+			token = value
+		}
+	}
+	if id, ok := a.tokens[sha256.Sum256([]byte(strings.TrimSpace(token)))]; ok {
+		return &id, nil
+	}
+	return nil, errBadCredentials
+}
+
+func (a *Authenticator) basic(username, password string) (*Identity, error) {
+	user, ok := a.cfg.Users[username]
+	if !ok {
+		// Tokens can also be sent as the basic password, which is how pip,
+		// bundler and go pass credentials embedded in an URL.
+		if id, found := a.tokens[sha256.Sum256([]byte(password))]; found {
+			return &id, nil
+		}
+		return nil, errBadCredentials
+	}
+
+	key := sha256.Sum256([]byte(username + "\x00" + password + "\x00" + user.Password))
+	a.mu.Lock()
+	expires, cached := a.verified[key]
+	a.mu.Unlock()
+	if !cached || time.Now().After(expires) {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+			return nil, errBadCredentials
+		}
+		a.mu.Lock()
+		if len(a.verified) >= 1024 {
+			now := time.Now()
+			for k, v := range a.verified {
+				if now.After(v) {
+					delete(a.verified, k)
+				}
+			}
+		}
+		a.verified[key] = time.Now().Add(basicCacheTTL)
+		a.mu.Unlock()
+	}
+	return &Identity{User: username, Groups: user.Groups}, nil
+}
+
+func (a *Authenticator) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether id (nil for anonymous) may read or write repo.
+// Everything is allowed when authentication is not configured.
+func Allowed(cfg types.AuthConfig, repo string, id *Identity, write bool) bool {
+	if !cfg.Enabled() {
+		return true
+	}
+	rule, ok := cfg.ACL[repo]
+	if !ok {
+		if cfg.Default != nil {
+			rule = *cfg.Default
+		} else {
+			rule = types.AccessRule{Read: []string{"@authenticated"}}
+		}
+	}
+	principals := rule.Read
+	if write {
+		principals = rule.Write
+	}
+	return Matches(principals, id)
+}
+
+// AnonymousAllowed reports whether repo can be read without credentials.
+func AnonymousAllowed(cfg types.AuthConfig, repo string) bool {
+	return Allowed(cfg, repo, nil, false)
+}
+
+// Matches reports whether id is covered by one of the principals.
+func Matches(principals []string, id *Identity) bool {
+	for _, p := range principals {
+		switch {
+		case p == "*":
+			return true
+		case id == nil:
+			continue
+		case p == "@authenticated":
+			return true
+		case strings.HasPrefix(p, "@"):
+			if slices.Contains(id.Groups, strings.TrimPrefix(p, "@")) {
+				return true
+			}
+		case p == id.User:
+			return true
+		}
+	}
+	return false
+}
+
+func unauthorized(c echo.Context) error {
+	c.Response().Header().Set("WWW-Authenticate", `Basic realm="hub"`)
+	return c.String(http.StatusUnauthorized, "401 unauthorized")
+}
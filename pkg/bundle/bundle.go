@@ -0,0 +1,291 @@
+package bundle
+
+import (
+	"archive/tar"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// FormatVersion is the bundle layout version written to manifests.
+	FormatVersion = 1
+	manifestName  = "manifest.json"
+	filesPrefix   = "files/"
+)
+
+// Manifest lists the files of a bundle. It is the last entry of the
+// archive, so files are hashed while they are written.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Since   time.Time `json:"since,omitzero"`
+	Files   []File    `json:"files"`
+}
+
+// File is a cached file in a bundle. Path is relative to the cache
+// directory.
+type File struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Modified time.Time `json:"modified"`
+}
+
+// Export writes the given cache entries to w as a zstd compressed tar
+// archive. Entries that disappear while the bundle is written are left out.
+func Export(w io.Writer, dir string, entries []storage.Entry, since time.Time) (Manifest, error) {
+	manifest := Manifest{Version: FormatVersion, Created: time.Now().UTC(), Since: since, Files: []File{}}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return manifest, err
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return manifest, err
+	}
+	tw := tar.NewWriter(zw)
+
+	for _, e := range entries {
+		rel, errRel := filepath.Rel(root, e.Path)
+		if errRel != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		f, errAdd := addFile(tw, e.Path, filepath.ToSlash(rel))
+		if errors.Is(errAdd, os.ErrNotExist) {
+			continue
+		}
+		if errAdd != nil {
+			return manifest, fmt.Errorf("%s: %v", e.Path, errAdd)
+		}
+		manifest.Files = append(manifest.Files, f)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err = tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0o644, Size: int64(len(data)), ModTime: manifest.Created}); err != nil {
+		return manifest, err
+	}
+	if _, err = tw.Write(data); err != nil {
+		return manifest, err
+	}
+	if err = tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, zw.Close()
+}
+
+func addFile(tw *tar.Writer, name, rel string) (File, error) {
+	file, err := os.Open(filepath.Clean(name))
+	if err != nil {
+		return File{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return File{}, err
+	}
+
+	header := &tar.Header{
+		Name:    filesPrefix + rel,
+		Mode:    0o644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+	if err = tw.WriteHeader(header); err != nil {
+		return File{}, err
+	}
+	hash := sha256.New()
+	// The size was announced in the header, so a file that grows meanwhile
+	// is cut and one that shrinks makes the export fail.
+	if _, err = io.CopyN(io.MultiWriter(tw, hash), file, info.Size()); err != nil {
+		return File{}, err
+	}
+	return File{
+		Path:     rel,
+		Size:     info.Size(),
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+		Modified: info.ModTime().UTC(),
+	}, nil
+}
+
+// Result is the outcome of an import.
+type Result struct {
+	Imported  []string
+	Unchanged []string
+	// Failed maps the files that did not match the manifest to the reason.
+	Failed map[string]string
+	Bytes  int64
+}
+
+type staged struct {
+	temp   string
+	sha256 string
+	size   int64
+}
+
+// Import loads a bundle into the cache directory dir. Files are staged next
+// to their destination and only moved into place once the whole archive
+// was read and they matched the manifest. With dryRun set, the bundle is
+// only verified.
+func Import(r io.Reader, dir string, dryRun bool) (Result, error) {
+	result := Result{Failed: map[string]string{}}
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return result, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	files := map[string]*staged{}
+	defer func() {
+		for _, s := range files {
+			if s.temp != "" {
+				_ = os.Remove(s.temp)
+			}
+		}
+	}()
+
+	var manifest *Manifest
+	for {
+		header, errNext := tr.Next()
+		if errors.Is(errNext, io.EOF) {
+			break
+		}
+		if errNext != nil {
+			return result, fmt.Errorf("read bundle: %v", errNext)
+		}
+		if manifest != nil {
+			return result, fmt.Errorf("unexpected entry %q after the manifest", header.Name)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		if header.Name == manifestName {
+			manifest = &Manifest{}
+			if err = json.NewDecoder(tr).Decode(manifest); err != nil {
+				return result, fmt.Errorf("read manifest: %v", err)
+			}
+			continue
+		}
+
+		rel, ok := strings.CutPrefix(header.Name, filesPrefix)
+		if !ok || header.Typeflag != tar.TypeReg || !validPath(rel) {
+			return result, fmt.Errorf("invalid bundle entry %q", header.Name)
+		}
+		if _, dup := files[rel]; dup {
+			return result, fmt.Errorf("duplicate bundle entry %q", header.Name)
+		}
+		s := &staged{}
+		files[rel] = s
+		if err = stage(tr, filepath.Join(dir, filepath.FromSlash(rel)), s, dryRun); err != nil {
+			return result, fmt.Errorf("%s: %v", rel, err)
+		}
+	}
+	if manifest == nil {
+		return result, errors.New("bundle has no manifest")
+	}
+	if manifest.Version != FormatVersion {
+		return result, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	for _, f := range manifest.Files {
+		s, ok := files[f.Path]
+		switch {
+		case !ok:
+			result.Failed[f.Path] = "missing from the bundle"
+			continue
+		case s.size != f.Size:
+			result.Failed[f.Path] = fmt.Sprintf("size %d, expected %d", s.size, f.Size)
+			continue
+		case s.sha256 != f.SHA256:
+			result.Failed[f.Path] = fmt.Sprintf("sha256 %s, expected %s", s.sha256, f.SHA256)
+			continue
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if local, errSum := misc.CalculateSHA256(dest); errSum == nil && local == f.SHA256 {
+			result.Unchanged = append(result.Unchanged, f.Path)
+			continue
+		}
+		if !dryRun {
+			if err = os.Chtimes(s.temp, time.Now(), f.Modified); err != nil {
+				return result, err
+			}
+			if err = os.Rename(s.temp, dest); err != nil {
+				return result, err
+			}
+			s.temp = ""
+		}
+		result.Imported = append(result.Imported, f.Path)
+		result.Bytes += f.Size
+	}
+	for rel := range files {
+		if !manifestHas(manifest, rel) {
+			result.Failed[rel] = "not listed in the manifest"
+		}
+	}
+	return result, nil
+}
+
+func manifestHas(m *Manifest, rel string) bool {
+	for _, f := range m.Files {
+		if f.Path == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// validPath reports whether rel is a file of a repository directory
+// ("<type>/<key>/...").
+func validPath(rel string) bool {
+	return filepath.IsLocal(filepath.FromSlash(rel)) && path.Clean(rel) == rel && strings.Count(rel, "/") >= 2
+}
+
+func stage(r io.Reader, dest string, s *staged, dryRun bool) error {
+	hash := sha256.New()
+	if dryRun {
+		n, err := io.Copy(hash, r)
+		s.size, s.sha256 = n, hex.EncodeToString(hash.Sum(nil))
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000))
+	if err != nil {
+		return err
+	}
+	// Temporary names are skipped by scans and eviction and cleaned up by
+	// "hub cache gc" if the import is interrupted.
+	s.temp = filepath.Join(filepath.Dir(dest), fmt.Sprintf(".tmp.%s.%d.%d", filepath.Base(dest), time.Now().UnixNano(), n.Int64()))
+	file, err := os.Create(filepath.Clean(s.temp))
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	s.size, s.sha256 = size, hex.EncodeToString(hash.Sum(nil))
+	return err
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// apkIndexTTL is how long APKINDEX.tar.gz is served from the cache before
+// being revalidated upstream.
+const apkIndexTTL = time.Minute
+
+func APK(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("apk", key)
+		loggerNS := "apk"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		url := strings.TrimSuffix(cfg.Server.APK[key].URL, "/") + "/" + name
+		repoDir := filepath.Join(cfg.Dir, "apk", key)
+		dest := filepath.Join(repoDir, filepath.FromSlash(name))
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+
+		if !strings.HasSuffix(name, ".apk") {
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, url, dest, headers, apkIndexTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return serveFile(c, dest)
+		}
+
+		checksum := func() *misc.Checksum {
+			sum := storage.APKChecksum(repoDir, name)
+			if sum == nil {
+				logger.Named(loggerNS).Debugf("No checksum for %s in the cached APKINDEX", name)
+			}
+			return sum
+		}
+		return serveImmutable(c, logger.Named(loggerNS), client, url, dest, headers, checksum, "")
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// aptIndexTTL is how long Release files and indexes requested by name are
+// served from the cache before being revalidated upstream. Indexes
+// requested by hash never change.
+const aptIndexTTL = time.Minute
+
+func APT(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("apt", key)
+		loggerNS := "apt"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		base := strings.TrimSuffix(cfg.Server.APT[key].URL, "/")
+		repoDir := filepath.Join(cfg.Dir, "apt", key)
+		dest := filepath.Join(repoDir, filepath.FromSlash(name))
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+
+		switch {
+		case storage.AptByHashChecksum(name) != nil:
+			checksum := func() *misc.Checksum { return storage.AptByHashChecksum(name) }
+			return serveImmutable(c, logger.Named(loggerNS), client, base+"/"+name, dest, headers, checksum, "")
+		case strings.HasPrefix(name, "pool/"):
+			var checksum func() *misc.Checksum
+			if strings.HasSuffix(name, ".deb") || strings.HasSuffix(name, ".udeb") {
+				checksum = func() *misc.Checksum {
+					return aptChecksum(logger.Named(loggerNS), client, base, repoDir, name, headers)
+				}
+			}
+			return serveImmutable(c, logger.Named(loggerNS), client, base+"/"+name, dest, headers, checksum, "")
+		default:
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, base+"/"+name, dest, headers, aptIndexTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return serveFile(c, dest)
+		}
+	}
+}
+
+// aptChecksum looks up a package in the cached Packages indexes. apt
+// prefers xz compressed indexes, which can't be read here, so the gzip
+// variant of those is fetched first.
+func aptChecksum(logger *zap.SugaredLogger, client *upstream.Client, base, repoDir, name string, headers types.RequestHeaders) *misc.Checksum {
+	if checksum := storage.AptChecksum(repoDir, name); checksum != nil {
+		return checksum
+	}
+	missing := storage.AptMissingIndexes(repoDir)
+	for _, index := range missing {
+		dest := filepath.Join(repoDir, filepath.FromSlash(index.ByHash()))
+		checksum := &misc.Checksum{Algorithm: "sha256", Value: index.SHA256}
+		if _, err := misc.StartDownload(client, base+"/"+index.Name, dest, headers, checksum).Wait(); err != nil {
+			logger.Errorf("[Downloading] %s: %s", index.Name, err)
+		}
+	}
+	if len(missing) > 0 {
+		if checksum := storage.AptChecksum(repoDir, name); checksum != nil {
+			return checksum
+		}
+	}
+	logger.Debugf("No checksum for %s in the cached Packages indexes", name)
+	return nil
+}
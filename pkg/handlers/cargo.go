@@ -11,8 +11,10 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/psvmcc/hub/pkg/auth"
 	"github.com/psvmcc/hub/pkg/misc"
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -44,6 +46,7 @@ func CargoIndex(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("cargo", key)
 		loggerNS := "cargo_index"
 
 		source, ok := cfg.Server.Cargo[key]
@@ -65,22 +68,22 @@ func CargoIndex(key string) echo.HandlerFunc {
 
 		if cleaned == "config.json" {
 			dest := filepath.Join(cfg.Dir, "cargo", key, "index", "config.json")
-			if _, err = os.Stat(dest); err == nil {
-				c.Response().Header().Add("X-Cache-Status", "HIT")
-				c.Response().Header().Set("Content-Type", "application/json")
-				return c.File(dest)
-			}
-
 			baseURL := fmt.Sprintf("%s://%s", c.Scheme(), c.Request().Host)
 			payload := cargoIndexConfig{
 				DL:  fmt.Sprintf("%s/cargo/%s/crates/{crate}/{version}/download", baseURL, key),
 				API: fmt.Sprintf("%s/cargo/%s/api", baseURL, key),
+				// Cargo only sends its token for registries that ask for it.
+				AuthRequired: !auth.AnonymousAllowed(cfg.Auth, "cargo/"+key),
 			}
 			data, errMarshal := json.Marshal(payload)
 			if errMarshal != nil {
 				logger.Named(loggerNS).Errorf("Config marshal error: %s", errMarshal)
 				return c.String(http.StatusInternalServerError, "")
 			}
+			if cached, errRead := os.ReadFile(filepath.Clean(dest)); errRead == nil && string(cached) == string(data) {
+				c.Response().Header().Add("X-Cache-Status", "HIT")
+				return c.Blob(http.StatusOK, "application/json", data)
+			}
 			if err = os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
 				logger.Named(loggerNS).Errorf("Config directory error: %s", err)
 				return c.String(http.StatusInternalServerError, "")
@@ -108,13 +111,18 @@ func CargoIndex(key string) echo.HandlerFunc {
 			"Accept":     "application/json",
 		}
 
+		if upstream.Offline() {
+			c.Response().Header().Set("Content-Type", "application/json")
+			return serveCached(c, dest, "STALE", offlineMissingIndex)
+		}
+
 		cacheExists := cargoFileExists(dest)
 		meta := cargoCacheMeta{}
 		if cacheExists {
 			meta, _ = readCargoCacheMeta(metaFile)
 		}
 
-		status, newETag, newLastModified, notModified, err := misc.DownloadFileConditional(upstreamURL, dest, headers, meta.ETag, meta.LastModified)
+		status, newETag, newLastModified, notModified, err := misc.DownloadFileConditional(client, upstreamURL, dest, headers, meta.ETag, meta.LastModified)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 			if !cacheExists {
@@ -142,7 +150,7 @@ func CargoIndex(key string) echo.HandlerFunc {
 		}
 
 		c.Response().Header().Set("Content-Type", "application/json")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 }
 
@@ -150,6 +158,7 @@ func CargoCrateDownload(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("cargo", key)
 		loggerNS := "cargo_crates"
 
 		source, ok := cfg.Server.Cargo[key]
@@ -176,30 +185,31 @@ func CargoCrateDownload(key string) echo.HandlerFunc {
 			"User-Agent": "cargo",
 		}
 
+		if upstream.Offline() {
+			c.Response().Header().Set("Content-Type", "application/octet-stream")
+			return serveCached(c, dest, "HIT", offlineMissingArtifact)
+		}
 		if _, err = os.Stat(dest); err == nil {
 			c.Response().Header().Add("X-Cache-Status", "HIT")
 			c.Response().Header().Set("Content-Type", "application/octet-stream")
-			return c.File(dest)
+			return serveFile(c, dest)
 		}
 
-		status, err := misc.DownloadFile(upstreamURL, dest, headers)
-		if err != nil {
-			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
-			if _, statErr := os.Stat(dest); errors.Is(statErr, os.ErrNotExist) {
-				logger.Named(loggerNS).Errorf("[FS]: %s", statErr)
-				c.Response().Header().Add("X-Cache-Status", "ERROR")
-				return c.String(status, "Please check logs...")
-			}
-			c.Response().Header().Add("X-Cache-Status", "STALE")
-			logger.Named(loggerNS).Debugf("Remote %s served from local file %s", upstreamURL, dest)
-			c.Response().Header().Set("Content-Type", "application/octet-stream")
-			return c.File(dest)
+		started, status, err := streamDownload(c, client, upstreamURL, dest, headers, nil, "MISS", "application/octet-stream")
+		if started {
+			logger.Named(loggerNS).Debugf("Remote %s streamed and saved as %s", upstreamURL, dest)
+			return err
 		}
-
-		c.Response().Header().Add("X-Cache-Status", "MISS")
-		logger.Named(loggerNS).Debugf("Remote %s saved as %s", upstreamURL, dest)
+		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+		if _, statErr := os.Stat(dest); errors.Is(statErr, os.ErrNotExist) {
+			logger.Named(loggerNS).Errorf("[FS]: %s", statErr)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(status, "Please check logs...")
+		}
+		c.Response().Header().Add("X-Cache-Status", "STALE")
+		logger.Named(loggerNS).Debugf("Remote %s served from local file %s", upstreamURL, dest)
 		c.Response().Header().Set("Content-Type", "application/octet-stream")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 }
 
@@ -207,6 +217,7 @@ func CargoAPIProxy(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("cargo", key)
 		loggerNS := "cargo_api"
 
 		source, ok := cfg.Server.Cargo[key]
@@ -223,6 +234,9 @@ func CargoAPIProxy(key string) echo.HandlerFunc {
 		if method != http.MethodGet && method != http.MethodHead {
 			return c.NoContent(http.StatusMethodNotAllowed)
 		}
+		if upstream.Offline() {
+			return offlineMiss(c, http.StatusGatewayTimeout)
+		}
 
 		rawPath := strings.TrimPrefix(c.Param("*"), "/")
 		cleaned := path.Clean("/" + rawPath)
@@ -247,7 +261,6 @@ func CargoAPIProxy(key string) echo.HandlerFunc {
 			req.Header.Set("Accept", accept)
 		}
 
-		client := &http.Client{}
 		resp, err := client.Do(req)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("[Proxy] %s", err)
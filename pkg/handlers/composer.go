@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+func Composer(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("composer", key)
+		loggerNS := "composer"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		repoDir := filepath.Join(cfg.Dir, "composer", key)
+		headers := types.RequestHeaders{
+			"User-Agent": "Composer",
+		}
+		baseURL := fmt.Sprintf("%s://%s/composer/%s", c.Scheme(), c.Request().Host, key)
+
+		parts := strings.Split(name, "/")
+		switch {
+		case name == "packages.json":
+			dest := filepath.Join(repoDir, "packages.json")
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, composerRepositoryURL(cfg, key), dest, headers, 0)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return sendComposerJSON(c, logger.Named(loggerNS), dest, func(metadata map[string]any) {
+				rewriteComposerRepository(metadata, composerRepositoryURL(cfg, key), baseURL)
+			})
+		case len(parts) == 3 && parts[0] == "p2" && strings.HasSuffix(parts[2], ".json"):
+			pkg := parts[1] + "/" + strings.TrimSuffix(parts[2], ".json")
+			metadataURL, status, err := composerMetadataURL(logger.Named(loggerNS), client, cfg, key, pkg)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			dest := filepath.Join(repoDir, filepath.FromSlash(name))
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, metadataURL, dest, headers, 0)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return sendComposerJSON(c, logger.Named(loggerNS), dest, func(metadata map[string]any) {
+				rewriteComposerDists(metadata, baseURL)
+			})
+		case len(parts) == 4 && parts[0] == "dists":
+			return handleComposerDist(c, cfg, logger.Named(loggerNS), client, key, parts[1]+"/"+parts[2], parts[3], headers)
+		default:
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+	}
+}
+
+func handleComposerDist(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLogger, client *upstream.Client, key, pkg, file string, headers types.RequestHeaders) error {
+	repoDir := filepath.Join(cfg.Dir, "composer", key)
+	dest := filepath.Join(repoDir, "dists", filepath.FromSlash(pkg), file)
+	if upstream.Offline() || fileExists(dest) {
+		return serveImmutable(c, logger, client, "", dest, headers, nil, "")
+	}
+
+	reference := strings.TrimSuffix(file, path.Ext(file))
+	dist, ok, status, err := findListed(logger, client, headers, func() (storage.ComposerDist, bool) {
+		return storage.ComposerPackageDist(repoDir, pkg, reference)
+	}, func() ([]listing, int, error) {
+		var listings []listing
+		for _, metadata := range []string{pkg, pkg + "~dev"} {
+			metadataURL, status, err := composerMetadataURL(logger, client, cfg, key, metadata)
+			if err != nil {
+				return nil, status, err
+			}
+			listings = append(listings, listing{url: metadataURL, dest: filepath.Join(repoDir, "p2", filepath.FromSlash(metadata)+".json")})
+		}
+		return listings, http.StatusOK, nil
+	})
+	if err != nil {
+		return revalidationFailed(c, status, err)
+	}
+	if !ok {
+		c.Response().Header().Add("X-Cache-Status", "ERROR")
+		return c.String(http.StatusNotFound, "Dist not found in metadata")
+	}
+
+	var checksum func() *misc.Checksum
+	if dist.Shasum != "" {
+		checksum = func() *misc.Checksum {
+			return &misc.Checksum{Algorithm: "sha1", Value: dist.Shasum}
+		}
+	}
+	return serveImmutable(c, logger, client, composerDistURL(dist.URL), dest, headers, checksum, "")
+}
+
+// composerDistURL downloads GitHub API zipballs from codeload.github.com,
+// where the API redirects to, so that they don't count against the API
+// rate limit.
+func composerDistURL(distURL string) string {
+	rest, ok := strings.CutPrefix(distURL, "https://api.github.com/repos/")
+	if !ok {
+		return distURL
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 4 || parts[2] != "zipball" {
+		return distURL
+	}
+	return fmt.Sprintf("https://codeload.github.com/%s/%s/legacy.zip/%s", parts[0], parts[1], parts[3])
+}
+
+func composerRepositoryURL(cfg types.ConfigFile, key string) string {
+	return strings.TrimSuffix(cfg.Server.Composer[key].URL, "/") + "/packages.json"
+}
+
+// composerMetadataURL returns the upstream URL of the p2 metadata of pkg,
+// following the metadata-url template of the cached packages.json.
+func composerMetadataURL(logger *zap.SugaredLogger, client *upstream.Client, cfg types.ConfigFile, key, pkg string) (string, int, error) {
+	repositoryURL := composerRepositoryURL(cfg, key)
+	dest := filepath.Join(cfg.Dir, "composer", key, "packages.json")
+	if !fileExists(dest) {
+		if _, status, err := fetchRevalidated(logger, client, repositoryURL, dest, types.RequestHeaders{"User-Agent": "Composer"}, 0); err != nil {
+			return "", status, err
+		}
+	}
+	data, err := os.ReadFile(filepath.Clean(dest))
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	var repository struct {
+		MetadataURL string `json:"metadata-url"`
+	}
+	if err = json.Unmarshal(data, &repository); err != nil {
+		return "", http.StatusBadGateway, fmt.Errorf("packages.json: %v", err)
+	}
+	if repository.MetadataURL == "" {
+		return "", http.StatusNotFound, errors.New("packages.json has no metadata-url")
+	}
+	template, err := composerResolve(repositoryURL, repository.MetadataURL)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	return strings.ReplaceAll(template, "%package%", pkg), http.StatusOK, nil
+}
+
+// composerResolve resolves a URL of packages.json, which may be relative to
+// the repository.
+func composerResolve(repositoryURL, ref string) (string, error) {
+	base, err := url.Parse(repositoryURL)
+	if err != nil {
+		return "", err
+	}
+	// Templates hold "%package%", which is not a valid escape.
+	const placeholder = "__package__"
+	resolved, err := url.Parse(strings.ReplaceAll(ref, "%package%", placeholder))
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(base.ResolveReference(resolved).String(), placeholder, "%package%"), nil
+}
+
+// sendComposerJSON answers with a cached metadata file, rewritten by
+// rewrite.
+func sendComposerJSON(c echo.Context, logger *zap.SugaredLogger, file string, rewrite func(metadata map[string]any)) error {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return c.String(http.StatusNotFound, "404 page not found")
+	}
+	var metadata map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&metadata); err != nil {
+		logger.Errorf("Metadata unmarshal error: %s", err)
+		return c.String(http.StatusBadGateway, "Metadata error")
+	}
+	rewrite(metadata)
+	updated, err := json.Marshal(metadata)
+	if err != nil {
+		logger.Errorf("Metadata marshal error: %s", err)
+		return c.String(http.StatusInternalServerError, "Metadata error")
+	}
+	return c.Blob(http.StatusOK, "application/json", updated)
+}
+
+// rewriteComposerRepository points metadata-url to hub. Composer 1 provider
+// files and dist mirrors are not proxied and are removed, and the other
+// relative URLs are resolved against upstream.
+func rewriteComposerRepository(repository map[string]any, repositoryURL, baseURL string) {
+	for _, field := range []string{"providers-url", "provider-includes", "providers-lazy-url", "mirrors"} {
+		delete(repository, field)
+	}
+	for field, value := range repository {
+		ref, ok := value.(string)
+		if !ok || !strings.HasPrefix(ref, "/") {
+			continue
+		}
+		if resolved, err := composerResolve(repositoryURL, ref); err == nil {
+			repository[field] = resolved
+		}
+	}
+	if _, ok := repository["metadata-url"]; ok {
+		repository["metadata-url"] = baseURL + "/p2/%package%.json"
+	}
+}
+
+// rewriteComposerDists points the dist URLs of p2 metadata to hub, like
+// rewriteNpmTarballs does for npm. Dists are served by reference, which
+// must be usable as a file name.
+func rewriteComposerDists(metadata map[string]any, baseURL string) {
+	packages, ok := metadata["packages"].(map[string]any)
+	if !ok {
+		return
+	}
+	for pkg, versions := range packages {
+		list, ok := versions.([]any)
+		if !ok {
+			continue
+		}
+		for _, v := range list {
+			version, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			dist, ok := version["dist"].(map[string]any)
+			if !ok {
+				continue
+			}
+			reference, _ := dist["reference"].(string)
+			distType, _ := dist["type"].(string)
+			if reference == "" || reference == "." || reference == ".." || url.PathEscape(reference) != reference {
+				continue
+			}
+			dist["url"] = fmt.Sprintf("%s/dists/%s/%s.%s", baseURL, pkg, reference, cmp.Or(distType, "zip"))
+		}
+	}
+}
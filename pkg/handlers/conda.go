@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// condaIndexTTL is how long channeldata.json, repodata and JLAP files are
+// served from the cache before being revalidated upstream.
+const condaIndexTTL = time.Minute
+
+func Conda(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("conda", key)
+		loggerNS := "conda"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		base := strings.TrimSuffix(cfg.Server.Conda[key].URL, "/")
+		repoDir := filepath.Join(cfg.Dir, "conda", key)
+		dest := filepath.Join(repoDir, filepath.FromSlash(name))
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+
+		// JLAP files are fetched whole; the ranges conda asks for are served
+		// from the cached copy.
+		if !storage.IsCondaPackage(name) {
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, base+"/"+name, dest, headers, condaIndexTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return serveFile(c, dest)
+		}
+
+		checksum := func() *misc.Checksum {
+			sum, _, _, _ := findListed(logger.Named(loggerNS), client, headers, func() (*misc.Checksum, bool) {
+				sum := storage.CondaChecksum(repoDir, name)
+				return sum, sum != nil
+			}, func() ([]listing, int, error) {
+				// Conda may only have fetched JLAP patches of this subdir.
+				candidates := []string{"repodata.json.zst", "repodata.json"}
+				if repodata := storage.CondaRepodata(repoDir, name); repodata != "" {
+					candidates = []string{filepath.Base(repodata)}
+				}
+				var listings []listing
+				for i, file := range candidates {
+					rel := path.Join(path.Dir(name), file)
+					listings = append(listings, listing{url: base + "/" + rel, dest: filepath.Join(repoDir, filepath.FromSlash(rel)), fallback: i > 0})
+				}
+				return listings, http.StatusOK, nil
+			})
+			if sum == nil {
+				logger.Named(loggerNS).Debugf("No checksum for %s in the cached repodata", name)
+			}
+			return sum
+		}
+		return serveImmutable(c, logger.Named(loggerNS), client, base+"/"+name, dest, headers, checksum, "")
+	}
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CPAN serves a CPAN mirror. The module indexes and CHECKSUMS files are
+// revalidated, distributions are cached forever.
+func CPAN(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		return handleMirror(c, "cpan", key, cfg.Server.CPAN[key].URL, "hub", storage.IsCPANDistribution)
+	}
+}
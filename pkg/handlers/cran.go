@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CRAN serves a CRAN mirror. PACKAGES indexes are revalidated, source and
+// binary packages are cached forever.
+func CRAN(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		return handleMirror(c, "cran", key, cfg.Server.CRAN[key].URL, "hub", storage.IsCRANPackage)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/psvmcc/hub/pkg/misc"
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -18,6 +19,7 @@ func GalaxyProxyCollection(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("galaxy", key)
 		loggerNS := "galaxy_proxy_connection"
 		namespace := c.Param("namespace")
 		name := c.Param("name")
@@ -27,8 +29,12 @@ func GalaxyProxyCollection(key string) echo.HandlerFunc {
 		headers := types.RequestHeaders{
 			"User-Agent": "ansible-galaxy",
 		}
-		status, err := misc.DownloadFile(url, dest, headers)
-		if err != nil {
+		if upstream.Offline() {
+			if !fileExists(dest) {
+				return offlineMiss(c, offlineMissingIndex)
+			}
+			c.Response().Header().Add("X-Cache-Status", "STALE")
+		} else if status, err := misc.DownloadFile(client, url, dest, headers); err != nil {
 			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 			if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
 				logger.Named(loggerNS).Errorf("[FS]: %s", err)
@@ -42,7 +48,7 @@ func GalaxyProxyCollection(key string) echo.HandlerFunc {
 			logger.Named(loggerNS).Debugf("Remote %s saved as %s", url, dest)
 		}
 		var collection types.GalaxyCollection
-		err = collection.ReadFromJSONFile(dest)
+		err := collection.ReadFromJSONFile(dest)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("Unable to parse local json file %s, got error: %s", dest, err)
 		}
@@ -57,6 +63,7 @@ func GalaxyProxyCollectionVersions(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("galaxy", key)
 		loggerNS := "galaxy_proxy_connection_versions"
 		namespace := c.Param("namespace")
 		name := c.Param("name")
@@ -66,8 +73,12 @@ func GalaxyProxyCollectionVersions(key string) echo.HandlerFunc {
 		headers := types.RequestHeaders{
 			"User-Agent": "ansible-galaxy",
 		}
-		status, err := misc.DownloadFile(url, dest, headers)
-		if err != nil {
+		if upstream.Offline() {
+			if !fileExists(dest) {
+				return offlineMiss(c, offlineMissingIndex)
+			}
+			c.Response().Header().Add("X-Cache-Status", "STALE")
+		} else if status, err := misc.DownloadFile(client, url, dest, headers); err != nil {
 			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 			if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
 				logger.Named(loggerNS).Errorf("[FS]: %s", err)
@@ -81,7 +92,7 @@ func GalaxyProxyCollectionVersions(key string) echo.HandlerFunc {
 			logger.Named(loggerNS).Debugf("Remote %s saved as %s", url, dest)
 		}
 		var collectionVersions types.GalaxyCollectionVersions
-		err = collectionVersions.ReadFromJSONFile(dest, key, namespace, name)
+		err := collectionVersions.ReadFromJSONFile(dest, key, namespace, name)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("Unable to parse local json file %s, got error: %s", dest, err)
 		}
@@ -93,6 +104,7 @@ func GalaxyProxyCollectionVersionInfo(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("galaxy", key)
 		loggerNS := "galaxy_proxy_connection_version_info"
 		namespace := c.Param("namespace")
 		name := c.Param("name")
@@ -106,8 +118,12 @@ func GalaxyProxyCollectionVersionInfo(key string) echo.HandlerFunc {
 		headers := types.RequestHeaders{
 			"User-Agent": "ansible-galaxy",
 		}
-		_, err := misc.DownloadFile(url, dest, headers)
-		if err != nil {
+		if upstream.Offline() {
+			if !fileExists(dest) {
+				return offlineMiss(c, offlineMissingIndex)
+			}
+			c.Response().Header().Add("X-Cache-Status", "STALE")
+		} else if _, err := misc.DownloadFile(client, url, dest, headers); err != nil {
 			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 			if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
 				logger.Named(loggerNS).Errorf("[FS]: %s", err)
@@ -121,7 +137,7 @@ func GalaxyProxyCollectionVersionInfo(key string) echo.HandlerFunc {
 			logger.Named(loggerNS).Debugf("Remote %s saved as %s", url, dest)
 		}
 		var CollectionVersionInfo types.GalaxyCollectionVersionInfo
-		err = CollectionVersionInfo.ReadFromJSONFile(dest)
+		err := CollectionVersionInfo.ReadFromJSONFile(dest)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("Unable to parse local json file %s, got error: %s", dest, err)
 		}
@@ -136,11 +152,21 @@ func GalaxyProxyCollectionGet(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("galaxy", key)
 		loggerNS := "galaxy_proxy_connection_get"
 		namespace := c.Param("namespace")
 		name := c.Param("name")
 		version := strings.TrimRight(c.Param("version"), "/")
 		versionFile := fmt.Sprintf("%s/galaxy/%s/index/%s/%s/versions/%s/index.json", cfg.Dir, key, namespace, name, version)
+		if upstream.Offline() {
+			dest := fmt.Sprintf("%s/galaxy/%s/binary/%s/%s/%s-%s-%s.tar.gz", cfg.Dir, key, namespace, name, namespace, name, version)
+			if !fileExists(dest) {
+				return offlineMiss(c, offlineMissingArtifact)
+			}
+			c.Response().Header().Add("X-Cache-Status", "HIT")
+			c.Response().Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s-%s.tar.gz\"", namespace, name, version))
+			return serveFile(c, dest)
+		}
 		var CollectionVersionInfo types.GalaxyCollectionVersionInfo
 		err := CollectionVersionInfo.ReadFromJSONFile(versionFile)
 		if err != nil {
@@ -151,7 +177,7 @@ func GalaxyProxyCollectionGet(key string) echo.HandlerFunc {
 			headers := types.RequestHeaders{
 				"User-Agent": "ansible-galaxy",
 			}
-			_, err := misc.DownloadFile(url, versionFile, headers)
+			_, err := misc.DownloadFile(client, url, versionFile, headers)
 			if err != nil {
 				logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 				c.Response().Header().Add("X-Cache-Status", "ERROR")
@@ -170,37 +196,42 @@ func GalaxyProxyCollectionGet(key string) echo.HandlerFunc {
 		headers := types.RequestHeaders{
 			"User-Agent": "ansible-galaxy",
 		}
+		cacheStatus := "HIT"
 		if _, err := os.Stat(dest); errors.Is(err, os.ErrNotExist) {
-			status, err := misc.DownloadFile(url, dest, headers)
-			if err != nil {
-				logger.Named(loggerNS).Errorf("[Downloading] %s", err)
-				c.Response().Header().Add("X-Cache-Status", "ERROR")
-				return c.String(status, fmt.Sprintf("%v", err))
-			}
-			c.Response().Header().Add("X-Cache-Status", "MISS")
+			cacheStatus = "MISS"
 		} else {
 			logger.Named(loggerNS).Debugf("Remote %s served from local file %s", url, dest)
 			localSha, err := misc.CalculateSHA256(dest)
 			if err != nil {
 				logger.Named(loggerNS).Errorf("SHA calculating for %s error: %s", dest, err)
 			}
-			if CollectionVersionInfo.Artifact.Sha256 == localSha {
-				c.Response().Header().Add("X-Cache-Status", "HIT")
-			} else {
+			if CollectionVersionInfo.Artifact.Sha256 != localSha {
 				logger.Named(loggerNS).Errorf("SHA mismatch for %s local %s and remote %s", dest, localSha, CollectionVersionInfo.Artifact.Sha256)
-				status, err := misc.DownloadFile(url, dest, headers)
-				if err != nil {
-					logger.Named(loggerNS).Errorf("[Downloading] %s", err)
-					c.Response().Header().Add("X-Cache-Status", "ERROR")
-					return c.String(status, fmt.Sprintf("%v", err))
-				}
+				cacheStatus = "EXPIRED"
+			}
+		}
+
+		disposition := fmt.Sprintf("attachment; filename=\"%s-%s-%s.tar.gz\"", namespace, name, version)
+		if cacheStatus != "HIT" {
+			var checksum *misc.Checksum
+			if CollectionVersionInfo.Artifact.Sha256 != "" {
+				checksum = &misc.Checksum{Algorithm: "sha256", Value: CollectionVersionInfo.Artifact.Sha256}
+			}
+			c.Response().Header().Add("Content-Disposition", disposition)
+			started, status, err := streamDownload(c, client, url, dest, headers, checksum, cacheStatus, "application/gzip")
+			if started {
 				logger.Named(loggerNS).Debugf("Downloaded %s", url)
-				c.Response().Header().Add("X-Cache-Status", "EXPIRED")
+				return err
 			}
+			c.Response().Header().Del("Content-Disposition")
+			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(status, fmt.Sprintf("%v", err))
 		}
 
+		c.Response().Header().Add("X-Cache-Status", cacheStatus)
 		c.Response().Header().Add("Content-Type", "application/gzip")
-		c.Response().Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s-%s.tar.gz\"", namespace, name, version))
-		return c.File(dest)
+		c.Response().Header().Add("Content-Disposition", disposition)
+		return serveFile(c, dest)
 	}
 }
@@ -5,25 +5,31 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/psvmcc/hub/pkg/misc"
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
 // downloadAndCacheFile downloads a file from upstream and caches it locally
 func downloadAndCacheFile(c echo.Context, key, loggerNS, url, dest string) error {
 	logger := c.Get("logger").(*zap.SugaredLogger)
+	client := upstream.Get("goproxy", key)
 
 	headers := types.RequestHeaders{
 		"User-Agent": "go/goproxy",
 	}
 
-	status, err := misc.DownloadFile(url, dest, headers)
+	status, err := misc.DownloadFile(client, url, dest, headers)
 	if err != nil {
 		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 		if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
@@ -46,19 +52,33 @@ func GoProxyList(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("goproxy", key)
 		loggerNS := "goproxy_list"
 
 		module := c.Param("*")
 		module = strings.TrimSuffix(module, "/@v/list")
 
-		url := fmt.Sprintf("%s/%s/@v/list", cfg.Server.GOPROXY[key], module)
+		url := fmt.Sprintf("%s/%s/@v/list", cfg.Server.GOPROXY[key].URL, module)
 		dest := fmt.Sprintf("%s/goproxy/%s/%s/@v/list", cfg.Dir, key, module)
 
 		headers := types.RequestHeaders{
 			"User-Agent": "go/goproxy",
 		}
 
-		status, err := misc.DownloadFile(url, dest, headers)
+		if upstream.Offline() {
+			c.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if fileExists(dest) {
+				return serveCached(c, dest, "STALE", offlineMissingIndex)
+			}
+			list := cachedGoList(filepath.Dir(dest))
+			if list == "" {
+				return offlineMiss(c, offlineMissingIndex)
+			}
+			c.Response().Header().Add("X-Cache-Status", "STALE")
+			return c.String(http.StatusOK, list)
+		}
+
+		status, err := misc.DownloadFile(client, url, dest, headers)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 			if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
@@ -74,7 +94,7 @@ func GoProxyList(key string) echo.HandlerFunc {
 		}
 
 		c.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 }
 
@@ -91,15 +111,20 @@ func GoProxyInfo(key string) echo.HandlerFunc {
 		modulePath := parts[0]
 		version := strings.TrimSuffix(parts[1], ".info")
 
-		url := fmt.Sprintf("%s/%s/@v/%s.info", cfg.Server.GOPROXY[key], modulePath, version)
+		url := fmt.Sprintf("%s/%s/@v/%s.info", cfg.Server.GOPROXY[key].URL, modulePath, version)
 		dest := fmt.Sprintf("%s/goproxy/%s/%s/@v/%s.info", cfg.Dir, key, modulePath, version)
 
+		if upstream.Offline() {
+			c.Response().Header().Set("Content-Type", "application/json")
+			return serveCached(c, dest, "HIT", offlineMissingArtifact)
+		}
+
 		if err := downloadAndCacheFile(c, key, "goproxy_info", url, dest); err != nil {
 			return err
 		}
 
 		c.Response().Header().Set("Content-Type", "application/json")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 }
 
@@ -116,15 +141,20 @@ func GoProxyMod(key string) echo.HandlerFunc {
 		modulePath := parts[0]
 		version := strings.TrimSuffix(parts[1], ".mod")
 
-		url := fmt.Sprintf("%s/%s/@v/%s.mod", cfg.Server.GOPROXY[key], modulePath, version)
+		url := fmt.Sprintf("%s/%s/@v/%s.mod", cfg.Server.GOPROXY[key].URL, modulePath, version)
 		dest := fmt.Sprintf("%s/goproxy/%s/%s/@v/%s.mod", cfg.Dir, key, modulePath, version)
 
+		if upstream.Offline() {
+			c.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
+			return serveCached(c, dest, "HIT", offlineMissingArtifact)
+		}
+
 		if err := downloadAndCacheFile(c, key, "goproxy_mod", url, dest); err != nil {
 			return err
 		}
 
 		c.Response().Header().Set("Content-Type", "text/plain; charset=utf-8")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 }
 
@@ -133,6 +163,7 @@ func GoProxyZip(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("goproxy", key)
 		loggerNS := "goproxy_zip"
 
 		module := c.Param("*")
@@ -143,38 +174,42 @@ func GoProxyZip(key string) echo.HandlerFunc {
 		modulePath := parts[0]
 		version := strings.TrimSuffix(parts[1], ".zip")
 
-		url := fmt.Sprintf("%s/%s/@v/%s.zip", cfg.Server.GOPROXY[key], modulePath, version)
+		url := fmt.Sprintf("%s/%s/@v/%s.zip", cfg.Server.GOPROXY[key].URL, modulePath, version)
 		dest := fmt.Sprintf("%s/goproxy/%s/%s/@v/%s.zip", cfg.Dir, key, modulePath, version)
 
 		headers := types.RequestHeaders{
 			"User-Agent": "go/goproxy",
 		}
 
+		if upstream.Offline() {
+			c.Response().Header().Set("Content-Type", "application/zip")
+			return serveCached(c, dest, "HIT", offlineMissingArtifact)
+		}
+
 		// Check if file exists and has valid content
 		if _, err := os.Stat(dest); err == nil {
 			c.Response().Header().Add("X-Cache-Status", "HIT")
 			logger.Named(loggerNS).Debugf("Serving cached file %s", dest)
 			c.Response().Header().Set("Content-Type", "application/zip")
-			return c.File(dest)
+			return serveFile(c, dest)
 		}
 
-		status, err := misc.DownloadFile(url, dest, headers)
-		if err != nil {
-			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
-			if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
-				logger.Named(loggerNS).Errorf("[FS]: %s", err)
-				c.Response().Header().Add("X-Cache-Status", "ERROR")
-				return c.String(status, "410 Gone\n")
-			}
-			c.Response().Header().Add("X-Cache-Status", "STALE")
-			logger.Named(loggerNS).Debugf("Remote %s served from local file %s", url, dest)
-		} else {
-			c.Response().Header().Add("X-Cache-Status", "MISS")
-			logger.Named(loggerNS).Debugf("Remote %s saved as %s", url, dest)
+		started, status, err := streamDownload(c, client, url, dest, headers, nil, "MISS", "application/zip")
+		if started {
+			logger.Named(loggerNS).Debugf("Remote %s streamed and saved as %s", url, dest)
+			return err
 		}
+		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+		if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
+			logger.Named(loggerNS).Errorf("[FS]: %s", err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(status, "410 Gone\n")
+		}
+		c.Response().Header().Add("X-Cache-Status", "STALE")
+		logger.Named(loggerNS).Debugf("Remote %s served from local file %s", url, dest)
 
 		c.Response().Header().Set("Content-Type", "application/zip")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 }
 
@@ -183,18 +218,27 @@ func GoProxyLatest(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("goproxy", key)
 		loggerNS := "goproxy_latest"
 
 		module := c.Param("*")
 		module = strings.TrimSuffix(module, "/@latest")
 
-		url := fmt.Sprintf("%s/%s/@latest", cfg.Server.GOPROXY[key], module)
+		url := fmt.Sprintf("%s/%s/@latest", cfg.Server.GOPROXY[key].URL, module)
 		dest := fmt.Sprintf("%s/goproxy/%s/%s/@latest", cfg.Dir, key, module)
 
 		headers := types.RequestHeaders{
 			"User-Agent": "go/goproxy",
 		}
 
+		if upstream.Offline() {
+			c.Response().Header().Set("Content-Type", "application/json")
+			if fileExists(dest) {
+				return serveCached(c, dest, "STALE", offlineMissingIndex)
+			}
+			return goProxyOfflineLatest(c, filepath.Join(filepath.Dir(dest), "@v"))
+		}
+
 		// @latest should be fetched more frequently, so check if file is older than 1 hour
 		fileInfo, err := os.Stat(dest)
 		cacheValid := false
@@ -204,7 +248,7 @@ func GoProxyLatest(key string) echo.HandlerFunc {
 		}
 
 		if !cacheValid {
-			status, err := misc.DownloadFile(url, dest, headers)
+			status, err := misc.DownloadFile(client, url, dest, headers)
 			if err != nil {
 				logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 				if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
@@ -224,6 +268,32 @@ func GoProxyLatest(key string) echo.HandlerFunc {
 		}
 
 		c.Response().Header().Set("Content-Type", "application/json")
-		return c.File(dest)
+		return serveFile(c, dest)
+	}
+}
+
+// goProxyOfflineLatest answers @latest with the highest cached release, or
+// the highest cached version when no release is cached.
+func goProxyOfflineLatest(c echo.Context, dir string) error {
+	versions := cachedGoVersions(dir)
+	if len(versions) == 0 {
+		return offlineMiss(c, offlineMissingIndex)
+	}
+	latest := versions[len(versions)-1]
+	for _, v := range slices.Backward(versions) {
+		if semver.Prerelease(v) == "" && !module.IsPseudoVersion(v) {
+			latest = v
+			break
+		}
+	}
+	escaped, err := module.EscapeVersion(latest)
+	if err != nil {
+		return offlineMiss(c, offlineMissingIndex)
+	}
+	info := filepath.Join(dir, escaped+".info")
+	if fileExists(info) {
+		return serveCached(c, info, "STALE", offlineMissingIndex)
 	}
+	c.Response().Header().Add("X-Cache-Status", "STALE")
+	return c.JSON(http.StatusOK, map[string]string{"Version": latest})
 }
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/inflight"
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// helmIndexTTL is how long index.yaml is served from the cache before being
+// revalidated upstream.
+const helmIndexTTL = 5 * time.Minute
+
+type helmRewrittenIndex struct {
+	modified time.Time
+	size     int64
+	baseURL  string
+	data     []byte
+}
+
+// helmRewritten keeps the last rewritten index.yaml of each repository, as
+// large indexes take seconds to parse and encode. Rewrites run without
+// holding helmRewrittenMu; concurrent ones of the same index are coalesced
+// by helmRewrites.
+var (
+	helmRewrittenMu sync.Mutex
+	helmRewritten   = map[string]helmRewrittenIndex{}
+	helmRewrites    = inflight.New(nil)
+)
+
+func HelmIndex(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("helm", key)
+		loggerNS := "helm"
+
+		dest := filepath.Join(cfg.Dir, "helm", key, "index.yaml")
+		headers := types.RequestHeaders{
+			"User-Agent": "Helm",
+		}
+
+		cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, helmIndexURL(cfg, key), dest, headers, helmIndexTTL)
+		if err != nil {
+			return revalidationFailed(c, status, err)
+		}
+
+		baseURL := fmt.Sprintf("%s://%s", c.Scheme(), c.Request().Host)
+		data, err := rewrittenHelmIndex(key, dest, baseURL)
+		if err != nil {
+			logger.Named(loggerNS).Errorf("Index rewrite error: %s", err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(http.StatusBadGateway, "Index error")
+		}
+		c.Response().Header().Add("X-Cache-Status", cacheStatus)
+		return c.Blob(http.StatusOK, "application/x-yaml", data)
+	}
+}
+
+func HelmChartDownload(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("helm", key)
+		loggerNS := "helm"
+
+		var params [3]string
+		for i, param := range []string{"name", "version", "file"} {
+			value, err := url.PathUnescape(c.Param(param))
+			if err != nil || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+				return c.String(http.StatusNotFound, "404 page not found")
+			}
+			params[i] = value
+		}
+		name, version, file := params[0], params[1], params[2]
+		chartFile := name + "-" + version + ".tgz"
+		provenance := file == chartFile+".prov"
+		if name == "" || version == "" || file != chartFile && !provenance {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		repoDir := filepath.Join(cfg.Dir, "helm", key)
+		dest := filepath.Join(repoDir, "charts", name, version, file)
+		headers := types.RequestHeaders{
+			"User-Agent": "Helm",
+		}
+		if upstream.Offline() || fileExists(dest) {
+			return serveImmutable(c, logger.Named(loggerNS), client, "", dest, headers, nil, "")
+		}
+
+		indexFile := filepath.Join(repoDir, "index.yaml")
+		chart, ok, status, err := findListed(logger.Named(loggerNS), client, headers, func() (storage.HelmChart, bool) {
+			return storage.HelmChartVersion(indexFile, name, version)
+		}, func() ([]listing, int, error) {
+			return []listing{{url: helmIndexURL(cfg, key), dest: indexFile}}, http.StatusOK, nil
+		})
+		if err != nil {
+			return revalidationFailed(c, status, err)
+		}
+		if !ok || len(chart.URLs) == 0 {
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(http.StatusNotFound, "Chart not found in index")
+		}
+
+		chartURL, err := helmChartURL(cfg, key, chart.URLs[0])
+		if err != nil {
+			logger.Named(loggerNS).Errorf("Chart URL error: %s", err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(http.StatusBadGateway, "Index error")
+		}
+		var checksum func() *misc.Checksum
+		if provenance {
+			chartURL += ".prov"
+		} else if chart.Digest != "" {
+			checksum = func() *misc.Checksum {
+				return &misc.Checksum{Algorithm: "sha256", Value: chart.Digest}
+			}
+		}
+		return serveImmutable(c, logger.Named(loggerNS), client, chartURL, dest, headers, checksum, "")
+	}
+}
+
+func helmIndexURL(cfg types.ConfigFile, key string) string {
+	return strings.TrimSuffix(cfg.Server.Helm[key].URL, "/") + "/index.yaml"
+}
+
+// helmChartURL resolves a chart URL of the index, which may be relative to
+// the index.
+func helmChartURL(cfg types.ConfigFile, key, chartURL string) (string, error) {
+	base, err := url.Parse(helmIndexURL(cfg, key))
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(chartURL)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// rewrittenHelmIndex returns the cached index.yaml with chart URLs pointing
+// to hub, reusing the last rewrite when neither the index nor baseURL
+// changed.
+func rewrittenHelmIndex(key, indexFile, baseURL string) ([]byte, error) {
+	info, err := os.Stat(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	helmRewrittenMu.Lock()
+	r, ok := helmRewritten[key]
+	helmRewrittenMu.Unlock()
+	if ok && r.baseURL == baseURL && r.modified.Equal(info.ModTime()) && r.size == info.Size() {
+		return r.data, nil
+	}
+
+	flight := fmt.Sprintf("%s\x00%s\x00%d\x00%d", key, baseURL, info.ModTime().UnixNano(), info.Size())
+	value, _ := helmRewrites.Do(flight, func() any {
+		release := storage.Acquire(indexFile)
+		data, err := os.ReadFile(filepath.Clean(indexFile))
+		release()
+		if err != nil {
+			return err
+		}
+		if data, err = rewriteHelmIndex(data, baseURL, key); err != nil {
+			return err
+		}
+		helmRewrittenMu.Lock()
+		helmRewritten[key] = helmRewrittenIndex{modified: info.ModTime(), size: info.Size(), baseURL: baseURL, data: data}
+		helmRewrittenMu.Unlock()
+		return data
+	})
+	switch result := value.(type) {
+	case []byte:
+		return result, nil
+	case error:
+		return nil, result
+	default:
+		return nil, fmt.Errorf("rewrite of %s did not complete", indexFile)
+	}
+}
+
+// rewriteHelmIndex points the urls of every chart version to hub, like
+// rewriteNpmTarballs does for npm. The document is edited as YAML nodes so
+// that every other field is kept as is. Charts hosted in OCI registries are
+// left alone.
+func rewriteHelmIndex(data []byte, baseURL, key string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
+	}
+	entries := yamlMappingValue(doc.Content[0], "entries")
+	if entries == nil || entries.Kind != yaml.MappingNode {
+		return data, nil
+	}
+	for i := 0; i+1 < len(entries.Content); i += 2 {
+		name := entries.Content[i].Value
+		for _, chart := range entries.Content[i+1].Content {
+			version := yamlMappingValue(chart, "version")
+			urls := yamlMappingValue(chart, "urls")
+			if version == nil || urls == nil || urls.Kind != yaml.SequenceNode || len(urls.Content) == 0 {
+				continue
+			}
+			if strings.HasPrefix(urls.Content[0].Value, "oci://") {
+				continue
+			}
+			first := urls.Content[0]
+			first.Value = fmt.Sprintf("%s/helm/%s/charts/%s/%s/%s", baseURL, key, url.PathEscape(name), url.PathEscape(version.Value), url.PathEscape(name+"-"+version.Value+".tgz"))
+			first.Style = 0
+			urls.Content = urls.Content[:1]
+		}
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
+
+// yamlMappingValue returns the value of key in a mapping node, or nil.
+func yamlMappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// hexIndexTTL is how long the registry resources are served from the cache
+// before being revalidated upstream.
+const hexIndexTTL = time.Minute
+
+// Hex serves a Hex repository. The registry resources are signed by the
+// repository, so they are passed through unmodified.
+func Hex(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("hex", key)
+		loggerNS := "hex"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		base := strings.TrimSuffix(cfg.Server.Hex[key].URL, "/")
+		repoDir := filepath.Join(cfg.Dir, "hex", key)
+		dest := filepath.Join(repoDir, filepath.FromSlash(name))
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+
+		parts := strings.Split(name, "/")
+		switch {
+		case name == "names" || name == "versions" || len(parts) == 2 && parts[0] == "packages" || parts[0] == "installs":
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, base+"/"+name, dest, headers, hexIndexTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return serveFile(c, dest)
+		case len(parts) == 2 && parts[0] == "tarballs":
+			pkg, _, ok := storage.HexTarball(name)
+			if !ok {
+				return c.String(http.StatusNotFound, "404 page not found")
+			}
+			checksum := func() *misc.Checksum {
+				sum, _, _, err := findListed(logger.Named(loggerNS), client, headers, func() (*misc.Checksum, bool) {
+					sum := storage.HexChecksum(repoDir, name)
+					return sum, sum != nil
+				}, func() ([]listing, int, error) {
+					packageName := "packages/" + pkg
+					return []listing{{url: base + "/" + packageName, dest: filepath.Join(repoDir, filepath.FromSlash(packageName))}}, http.StatusOK, nil
+				})
+				if err != nil {
+					logger.Named(loggerNS).Debugf("No package resource for %s: %s", pkg, err)
+				}
+				return sum
+			}
+			return serveImmutable(c, logger.Named(loggerNS), client, base+"/"+name, dest, headers, checksum, "application/octet-stream")
+		default:
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// mavenMetadataTTL is how long maven-metadata.xml and SNAPSHOT files are
+// served from the cache before being revalidated upstream.
+const mavenMetadataTTL = 5 * time.Minute
+
+// mavenChecksums lists the checksum files looked up to verify an artifact,
+// strongest first.
+var mavenChecksums = []string{"sha256", "sha1"}
+
+func Maven(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("maven", key)
+		loggerNS := "maven"
+
+		// Directory listings share their path with the directory holding
+		// the artifacts, so they can't be cached.
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		url := strings.TrimSuffix(cfg.Server.Maven[key].URL, "/") + "/" + name
+		dest := filepath.Join(cfg.Dir, "maven", key, filepath.FromSlash(name))
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+
+		if storage.MavenMutable(name) {
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, url, dest, headers, mavenMetadataTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return serveFile(c, dest)
+		}
+
+		var checksum func() *misc.Checksum
+		if !storage.IsMavenChecksum(name) {
+			checksum = func() *misc.Checksum {
+				return mavenChecksum(logger.Named(loggerNS), client, url, dest, headers)
+			}
+		}
+		return serveImmutable(c, logger.Named(loggerNS), client, url, dest, headers, checksum, "")
+	}
+}
+
+// mavenChecksum fetches the checksum file published next to an artifact and
+// caches it, as clients ask for it right after the artifact. It returns nil
+// when upstream has none.
+func mavenChecksum(logger *zap.SugaredLogger, client *upstream.Client, url, dest string, headers types.RequestHeaders) *misc.Checksum {
+	for _, algorithm := range mavenChecksums {
+		file := dest + "." + algorithm
+		if !fileExists(file) {
+			if _, err := misc.DownloadFile(client, url+"."+algorithm, file, headers); err != nil {
+				logger.Debugf("No %s checksum for %s: %s", algorithm, url, err)
+				continue
+			}
+		}
+		data, err := os.ReadFile(filepath.Clean(file))
+		if err != nil {
+			continue
+		}
+		if checksum := storage.ParseMavenChecksum(algorithm, data); checksum != nil {
+			return checksum
+		}
+		logger.Errorf("Invalid %s checksum file for %s", algorithm, url)
+		_ = os.Remove(file)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// handleMirror proxies any path of a plain HTTP repository. Files for which
+// immutable returns true are cached forever, the others are compared with
+// upstream on every request and downloaded again when they changed.
+func handleMirror(c echo.Context, ecosystem, key, base, userAgent string, immutable func(p string) bool) error {
+	cfg := c.Get("cfg").(types.ConfigFile)
+	logger := c.Get("logger").(*zap.SugaredLogger)
+	client := upstream.Get(ecosystem, key)
+	loggerNS := ecosystem
+
+	requestedPath := strings.TrimPrefix(c.Param("*"), "/")
+	upstreamPath := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+	cacheKey := upstreamPath
+	if upstreamPath == "" || upstreamPath == "." {
+		upstreamPath = ""
+		cacheKey = "__root"
+	}
+
+	query := c.QueryString()
+	cachePath := cacheKey
+	if query != "" {
+		sum := sha256.Sum256([]byte(query))
+		cachePath = path.Join("_query", hex.EncodeToString(sum[:]), cacheKey)
+	}
+
+	url := strings.TrimSuffix(base, "/") + "/"
+	if upstreamPath != "" {
+		url += upstreamPath
+	}
+	if query != "" {
+		url = url + "?" + query
+	}
+
+	dest := fmt.Sprintf("%s/%s/%s/%s", cfg.Dir, ecosystem, key, cachePath)
+
+	headers := types.RequestHeaders{
+		"User-Agent": userAgent,
+	}
+
+	isImmutable := upstreamPath != "" && immutable(upstreamPath)
+	if upstream.Offline() {
+		if isImmutable {
+			return serveCached(c, dest, "HIT", offlineMissingArtifact)
+		}
+		return serveCached(c, dest, "STALE", offlineMissingIndex)
+	}
+
+	cacheExists := true
+	if _, err := os.Stat(dest); errors.Is(err, os.ErrNotExist) {
+		cacheExists = false
+	} else {
+		if isImmutable {
+			c.Response().Header().Add("X-Cache-Status", "HIT")
+			return serveFile(c, dest)
+		}
+
+		equal, err := misc.FilesEqual(client, url, dest)
+		if err != nil {
+			logger.Named(loggerNS).Errorf("[FilesEqual]: %s", err)
+		}
+
+		if equal {
+			c.Response().Header().Add("X-Cache-Status", "HIT")
+			return serveFile(c, dest)
+		}
+	}
+
+	cacheStatus := "MISS"
+	if cacheExists {
+		cacheStatus = "EXPIRED"
+	}
+	started, status, err := streamDownload(c, client, url, dest, headers, nil, cacheStatus, "")
+	if started {
+		logger.Named(loggerNS).Debugf("Remote %s streamed and saved as %s", url, dest)
+		return err
+	}
+	logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+	if _, statErr := os.Stat(dest); errors.Is(statErr, os.ErrNotExist) {
+		logger.Named(loggerNS).Errorf("[FS]: %s", statErr)
+		c.Response().Header().Add("X-Cache-Status", "ERROR")
+		return c.String(status, "Please check logs...")
+	}
+	c.Response().Header().Add("X-Cache-Status", "STALE")
+	logger.Named(loggerNS).Debugf("Remote %s served from local file %s", url, dest)
+	return serveFile(c, dest)
+}
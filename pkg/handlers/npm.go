@@ -16,6 +16,7 @@ import (
 
 	"github.com/psvmcc/hub/pkg/misc"
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -57,6 +58,7 @@ func NpmProxy(key string) echo.HandlerFunc {
 }
 
 func handleNpmMetadata(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLogger, loggerNS, key, rawPath string) error {
+	client := upstream.Get("npm", key)
 	decodedPath, err := url.PathUnescape(rawPath)
 	if err != nil {
 		decodedPath = rawPath
@@ -84,7 +86,7 @@ func handleNpmMetadata(c echo.Context, cfg types.ConfigFile, logger *zap.Sugared
 	dataFile := filepath.Join(cacheDir, filenameBase+".json")
 	metaFile := filepath.Join(cacheDir, filenameBase+".meta.json")
 
-	upstreamBase := strings.TrimSuffix(cfg.Server.NPM[key], "/")
+	upstreamBase := strings.TrimSuffix(cfg.Server.NPM[key].URL, "/")
 	upstreamName := npmEncodePackageName(packageName)
 	upstreamURL := fmt.Sprintf("%s/%s", upstreamBase, upstreamName)
 	if query != "" {
@@ -96,13 +98,24 @@ func handleNpmMetadata(c echo.Context, cfg types.ConfigFile, logger *zap.Sugared
 		"Accept":     upstreamAccept,
 	}
 
+	if upstream.Offline() {
+		tarballDir := filepath.Join(cfg.Dir, "npm", key, "tarballs", packagePath, "-")
+		payload, err := offlineNpmPackument(cacheDir, dataFile, tarballDir, packageName)
+		if err != nil {
+			logger.Named(loggerNS).Debugf("Offline packument of %s: %s", packageName, err)
+			return offlineMiss(c, offlineMissingIndex)
+		}
+		c.Response().Header().Add("X-Cache-Status", "STALE")
+		return sendNpmPackument(c, logger, loggerNS, key, packageName, upstreamAccept, payload)
+	}
+
 	cacheExists := fileExists(dataFile)
 	meta := npmCacheMeta{}
 	if cacheExists {
 		meta, _ = readNpmCacheMeta(metaFile)
 	}
 
-	status, newETag, newLastModified, notModified, err := misc.DownloadFileConditional(upstreamURL, dataFile, headers, meta.ETag, meta.LastModified)
+	status, newETag, newLastModified, notModified, err := misc.DownloadFileConditional(client, upstreamURL, dataFile, headers, meta.ETag, meta.LastModified)
 	if err != nil {
 		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 		if !cacheExists {
@@ -135,8 +148,13 @@ func handleNpmMetadata(c echo.Context, cfg types.ConfigFile, logger *zap.Sugared
 		return c.String(http.StatusBadRequest, "Metadata error")
 	}
 
+	return sendNpmPackument(c, logger, loggerNS, key, packageName, upstreamAccept, payload)
+}
+
+// sendNpmPackument answers with a packument whose tarball URLs point to hub.
+func sendNpmPackument(c echo.Context, logger *zap.SugaredLogger, loggerNS, key, packageName, contentType string, payload []byte) error {
 	var packument map[string]any
-	if err = json.Unmarshal(payload, &packument); err != nil {
+	if err := json.Unmarshal(payload, &packument); err != nil {
 		logger.Named(loggerNS).Errorf("Metadata unmarshal error: %s", err)
 		return c.String(http.StatusBadRequest, "Metadata error")
 	}
@@ -153,11 +171,12 @@ func handleNpmMetadata(c echo.Context, cfg types.ConfigFile, logger *zap.Sugared
 		return c.String(http.StatusInternalServerError, "Metadata error")
 	}
 
-	return c.Blob(http.StatusOK, upstreamAccept, updated)
+	return c.Blob(http.StatusOK, contentType, updated)
 }
 
 func handleNpmTarball(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLogger, loggerNS, key, rawPath string) error {
-	upstreamBase := strings.TrimSuffix(cfg.Server.NPM[key], "/")
+	client := upstream.Get("npm", key)
+	upstreamBase := strings.TrimSuffix(cfg.Server.NPM[key].URL, "/")
 	upstreamURL := fmt.Sprintf("%s/%s", upstreamBase, rawPath)
 	dest := filepath.Join(cfg.Dir, "npm", key, "tarballs", filepath.FromSlash(rawPath))
 
@@ -165,30 +184,32 @@ func handleNpmTarball(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredL
 		"User-Agent": "npm",
 	}
 
+	if upstream.Offline() {
+		return serveCached(c, dest, "HIT", offlineMissingArtifact)
+	}
 	if _, err := os.Stat(dest); err == nil {
 		c.Response().Header().Add("X-Cache-Status", "HIT")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 
-	status, err := misc.DownloadFile(upstreamURL, dest, headers)
-	if err != nil {
-		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
-		if _, statErr := os.Stat(dest); errors.Is(statErr, os.ErrNotExist) {
-			logger.Named(loggerNS).Errorf("[FS]: %s", statErr)
-			c.Response().Header().Add("X-Cache-Status", "ERROR")
-			return c.String(status, "Please check logs...")
-		}
-		c.Response().Header().Add("X-Cache-Status", "STALE")
-		logger.Named(loggerNS).Debugf("Remote %s served from local file %s", upstreamURL, dest)
-		return c.File(dest)
+	started, status, err := streamDownload(c, client, upstreamURL, dest, headers, nil, "MISS", "")
+	if started {
+		logger.Named(loggerNS).Debugf("Remote %s streamed and saved as %s", upstreamURL, dest)
+		return err
 	}
-
-	c.Response().Header().Add("X-Cache-Status", "MISS")
-	logger.Named(loggerNS).Debugf("Remote %s saved as %s", upstreamURL, dest)
-	return c.File(dest)
+	logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+	if _, statErr := os.Stat(dest); errors.Is(statErr, os.ErrNotExist) {
+		logger.Named(loggerNS).Errorf("[FS]: %s", statErr)
+		c.Response().Header().Add("X-Cache-Status", "ERROR")
+		return c.String(status, "Please check logs...")
+	}
+	c.Response().Header().Add("X-Cache-Status", "STALE")
+	logger.Named(loggerNS).Debugf("Remote %s served from local file %s", upstreamURL, dest)
+	return serveFile(c, dest)
 }
 
 func handleNpmSearch(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLogger, loggerNS, key string) error {
+	client := upstream.Get("npm", key)
 	query := c.QueryString()
 	hash := "empty"
 	if query != "" {
@@ -198,13 +219,17 @@ func handleNpmSearch(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLo
 
 	dest := filepath.Join(cfg.Dir, "npm", key, "search", hash+".json")
 	info, err := os.Stat(dest)
+	if upstream.Offline() {
+		c.Response().Header().Set("Content-Type", "application/json")
+		return serveCached(c, dest, "STALE", offlineMissingIndex)
+	}
 	if err == nil && time.Since(info.ModTime()) < npmSearchTTL {
 		c.Response().Header().Add("X-Cache-Status", "HIT")
 		c.Response().Header().Set("Content-Type", "application/json")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 
-	upstreamBase := strings.TrimSuffix(cfg.Server.NPM[key], "/")
+	upstreamBase := strings.TrimSuffix(cfg.Server.NPM[key].URL, "/")
 	upstreamURL := fmt.Sprintf("%s/-/v1/search", upstreamBase)
 	if query != "" {
 		upstreamURL = upstreamURL + "?" + query
@@ -215,7 +240,7 @@ func handleNpmSearch(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLo
 		"Accept":     "application/json",
 	}
 
-	status, err := misc.DownloadFile(upstreamURL, dest, headers)
+	status, err := misc.DownloadFile(client, upstreamURL, dest, headers)
 	if err != nil {
 		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 		if _, statErr := os.Stat(dest); errors.Is(statErr, os.ErrNotExist) {
@@ -225,7 +250,7 @@ func handleNpmSearch(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLo
 		}
 		c.Response().Header().Add("X-Cache-Status", "STALE")
 		c.Response().Header().Set("Content-Type", "application/json")
-		return c.File(dest)
+		return serveFile(c, dest)
 	}
 
 	if err := os.Chtimes(dest, time.Now(), time.Now()); err != nil {
@@ -233,7 +258,7 @@ func handleNpmSearch(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLo
 	}
 	c.Response().Header().Add("X-Cache-Status", "MISS")
 	c.Response().Header().Set("Content-Type", "application/json")
-	return c.File(dest)
+	return serveFile(c, dest)
 }
 
 func isNpmTarballPath(p string) bool {
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// nugetIndexTTL is how long the service index is served from the cache
+	// before being revalidated upstream.
+	nugetIndexTTL = time.Hour
+	// nugetMetadataTTL applies to registrations and flat container version
+	// lists.
+	nugetMetadataTTL = 5 * time.Minute
+	nugetSearchTTL   = 10 * time.Minute
+)
+
+// nugetResource is a resource of the service index served by hub, below
+// local. Search resources are served at local itself.
+type nugetResource struct {
+	upstream string
+	local    string
+}
+
+func NuGet(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("nuget", key)
+		loggerNS := "nuget"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		repoDir := filepath.Join(cfg.Dir, "nuget", key)
+		indexFile := filepath.Join(repoDir, "index.json")
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+
+		// Every other resource is found through the service index, so it is
+		// fetched first when it is not cached yet.
+		cacheStatus := ""
+		if name == "index.json" || !fileExists(indexFile) {
+			var status int
+			var err error
+			cacheStatus, status, err = fetchRevalidated(logger.Named(loggerNS), client, cfg.Server.NuGet[key].URL, indexFile, headers, nugetIndexTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+		}
+		resources, err := nugetResources(indexFile)
+		if err != nil {
+			logger.Named(loggerNS).Errorf("Service index error: %s", err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(http.StatusBadGateway, "Service index error")
+		}
+		if name == "index.json" {
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return sendNugetJSON(c, key, indexFile, resources)
+		}
+
+		var resource nugetResource
+		for _, r := range resources {
+			if name == r.local || strings.HasPrefix(name, r.local) && strings.HasSuffix(r.local, "/") {
+				resource = r
+				break
+			}
+		}
+		rest := strings.TrimPrefix(name, resource.local)
+		switch {
+		case resource.local == "":
+			return c.String(http.StatusNotFound, "404 page not found")
+		case resource.local == "query" || resource.local == "autocomplete":
+			// Search results are cached by query for nugetSearchTTL.
+			searchURL, hash := resource.upstream, "empty"
+			if query := c.QueryString(); query != "" {
+				sum := sha256.Sum256([]byte(query))
+				searchURL, hash = searchURL+"?"+query, hex.EncodeToString(sum[:])
+			}
+			dest := filepath.Join(repoDir, "search", resource.local, hash+".json")
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, searchURL, dest, headers, nugetSearchTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return sendNugetJSON(c, key, dest, resources)
+		case rest == "":
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		dest := filepath.Join(repoDir, filepath.FromSlash(name))
+		resourceURL := resource.upstream + rest
+		if resource.local != "v3-flatcontainer/" || path.Base(rest) == "index.json" {
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, resourceURL, dest, headers, nugetMetadataTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return sendNugetJSON(c, key, dest, resources)
+		}
+
+		// Packages, nuspecs and the other files of a package version never
+		// change. The flat container publishes no checksum for them.
+		return serveImmutable(c, logger.Named(loggerNS), client, resourceURL, dest, headers, nil, "")
+	}
+}
+
+// nugetResources lists the resources of the cached service index proxied by
+// hub: the flat container, registrations, search and autocomplete. Other
+// resources of the same kind, like the secondary search service of
+// nuget.org, are listed after the first one and served by it. Each
+// registration URL is served on its own, as their versions differ in the
+// packages they list and in compression.
+func nugetResources(indexFile string) ([]nugetResource, error) {
+	data, err := os.ReadFile(filepath.Clean(indexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index struct {
+		Resources []struct {
+			ID   string `json:"@id"`
+			Type string `json:"@type"`
+		} `json:"resources"`
+	}
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+
+	var resources []nugetResource
+	used := map[string]bool{}
+	for _, r := range index.Resources {
+		kind, _, _ := strings.Cut(r.Type, "/")
+		base := strings.TrimSuffix(r.ID, "/") + "/"
+		if kind == "SearchQueryService" || kind == "SearchAutocompleteService" {
+			base = r.ID
+		}
+		if slices.ContainsFunc(resources, func(known nugetResource) bool { return known.upstream == base }) {
+			continue
+		}
+		local := ""
+		switch kind {
+		case "PackageBaseAddress":
+			local = "v3-flatcontainer/"
+		case "RegistrationsBaseUrl":
+			u, err := url.Parse(base)
+			if err != nil {
+				continue
+			}
+			slug := cmp.Or(path.Base(strings.TrimSuffix(u.Path, "/")), "registration")
+			local = "registration/" + slug + "/"
+			for i := 2; used[local]; i++ {
+				local = fmt.Sprintf("registration/%s-%d/", slug, i)
+			}
+		case "SearchQueryService":
+			local = "query"
+		case "SearchAutocompleteService":
+			local = "autocomplete"
+		default:
+			continue
+		}
+		used[local] = true
+		resources = append(resources, nugetResource{upstream: base, local: local})
+	}
+	return resources, nil
+}
+
+// sendNugetJSON serves a cached document with the URLs of the proxied
+// resources pointing to hub, like rewriteNpmTarballs does for npm. URLs are
+// replaced as JSON strings so that the document is otherwise kept as is.
+func sendNugetJSON(c echo.Context, key, file string, resources []nugetResource) error {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return c.String(http.StatusNotFound, "404 page not found")
+	}
+	baseURL := fmt.Sprintf("%s://%s/nuget/%s/", c.Scheme(), c.Request().Host, key)
+	// Longer URLs are replaced first, so that a resource below another one
+	// gets its own location.
+	sorted := slices.Clone(resources)
+	slices.SortFunc(sorted, func(a, b nugetResource) int {
+		return len(b.upstream) - len(a.upstream)
+	})
+	var replacements []string
+	for _, r := range sorted {
+		if !strings.HasSuffix(r.local, "/") {
+			replacements = append(replacements, `"`+r.upstream+`"`, `"`+baseURL+r.local+`"`)
+			continue
+		}
+		// The service index may list base URLs without trailing slash.
+		replacements = append(replacements, `"`+r.upstream, `"`+baseURL+r.local,
+			`"`+strings.TrimSuffix(r.upstream, "/")+`"`, `"`+baseURL+r.local+`"`)
+	}
+	data = []byte(strings.NewReplacer(replacements...).Replace(string(data)))
+	return c.Blob(http.StatusOK, "application/json", data)
+}
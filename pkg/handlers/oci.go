@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/auth"
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// ociManifestTTL is how long manifests fetched by tag are served without
+// asking upstream, unless the repository sets manifest_ttl.
+const ociManifestTTL = 5 * time.Minute
+
+// ociManifestTypes are the manifest media types requested from upstream.
+var ociManifestTypes = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+var (
+	ociNamePattern   = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	ociTagPattern    = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	ociDigestPattern = regexp.MustCompile(`^(sha256:[a-f0-9]{64}|sha512:[a-f0-9]{128})$`)
+)
+
+// OCIBase answers the API version check registry clients start with. When
+// a repository needs credentials, anonymous clients are challenged here, as
+// that is where clients learn how to authenticate.
+func OCIBase() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		c.Response().Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if cfg.Auth.Enabled() && c.Get("identity") == nil {
+			for k := range cfg.Server.OCI {
+				if !auth.AnonymousAllowed(cfg.Auth, "oci/"+k) {
+					c.Response().Header().Set("WWW-Authenticate", `Basic realm="hub"`)
+					return ociError(c, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+				}
+			}
+		}
+		return c.JSON(http.StatusOK, struct{}{})
+	}
+}
+
+// OCI serves manifests and blobs of the registry key, as
+// /v2/<key>/<name>/manifests/<reference> and /v2/<key>/<name>/blobs/<digest>.
+func OCI(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		c.Response().Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+		rest := strings.TrimPrefix(c.Param("*"), "/")
+		if name, reference, ok := cutLast(rest, "/manifests/"); ok {
+			if !ociNamePattern.MatchString(name) || !ociTagPattern.MatchString(reference) && !ociDigestPattern.MatchString(reference) {
+				return ociError(c, http.StatusNotFound, "MANIFEST_UNKNOWN", "invalid name or reference")
+			}
+			return handleOCIManifest(c, cfg, logger, key, ociUpstreamName(cfg.Server.OCI[key].URL, name), reference)
+		}
+		if name, digest, ok := cutLast(rest, "/blobs/"); ok {
+			if !ociNamePattern.MatchString(name) || !ociDigestPattern.MatchString(digest) {
+				return ociError(c, http.StatusNotFound, "BLOB_UNKNOWN", "invalid name or digest")
+			}
+			return handleOCIBlob(c, cfg, logger, key, ociUpstreamName(cfg.Server.OCI[key].URL, name), digest)
+		}
+		return ociError(c, http.StatusNotFound, "UNSUPPORTED", "only pulling manifests and blobs is supported")
+	}
+}
+
+func handleOCIManifest(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLogger, key, name, reference string) error {
+	client := upstream.Get("oci", key)
+	loggerNS := "oci_manifest"
+	source := cfg.Server.OCI[key]
+	upstreamURL := fmt.Sprintf("%s/v2/%s/manifests/%s", strings.TrimSuffix(source.URL, "/"), name, reference)
+	repoDir := filepath.Join(cfg.Dir, "oci", key)
+
+	byDigest := ociDigestPattern.MatchString(reference)
+	dest := ociManifestPath(repoDir, name, reference)
+
+	if upstream.Offline() {
+		if !fileExists(dest) {
+			return offlineMiss(c, offlineMissingIndex)
+		}
+		if byDigest {
+			return sendOCIManifest(c, dest, "HIT", reference)
+		}
+		return sendOCIManifest(c, dest, "STALE", "")
+	}
+
+	// Manifests fetched by digest never change.
+	info, err := os.Stat(dest)
+	cacheExists := err == nil
+	if cacheExists && byDigest {
+		return sendOCIManifest(c, dest, "HIT", reference)
+	}
+	ttl := source.ManifestTTL
+	if ttl <= 0 {
+		ttl = ociManifestTTL
+	}
+	if cacheExists && time.Since(info.ModTime()) < ttl {
+		return sendOCIManifest(c, dest, "HIT", "")
+	}
+
+	// Registries don't count HEAD requests against pull rate limits, so a
+	// tag is revalidated by comparing the digest upstream reports.
+	if cacheExists {
+		digest, errHead := ociHeadDigest(client, source.URL, upstreamURL, name)
+		if errHead != nil {
+			logger.Named(loggerNS).Errorf("[Revalidating] %s", errHead)
+			return sendOCIManifest(c, dest, "STALE", "")
+		}
+		if cached, errRead := os.ReadFile(filepath.Clean(dest)); errRead == nil && digest == ociDigest(cached) {
+			if errTouch := os.Chtimes(dest, time.Now(), time.Now()); errTouch != nil {
+				logger.Named(loggerNS).Errorf("Cache timestamp update error: %s", errTouch)
+			}
+			return sendOCIManifest(c, dest, "HIT", "")
+		}
+	}
+
+	var checksum *misc.Checksum
+	if byDigest {
+		algorithm, value, _ := strings.Cut(reference, ":")
+		checksum = &misc.Checksum{Algorithm: algorithm, Value: value}
+	}
+	status, err := ociFetch(client, source.URL, name, func(headers types.RequestHeaders) (int, error) {
+		headers["Accept"] = ociManifestTypes
+		return misc.StartDownload(client, upstreamURL, dest, headers, checksum).Wait()
+	})
+	if err != nil {
+		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+		if !cacheExists {
+			return ociError(c, ociUpstreamStatus(status), "MANIFEST_UNKNOWN", fmt.Sprintf("%v", err))
+		}
+		logger.Named(loggerNS).Debugf("Remote %s served from local file %s", upstreamURL, dest)
+		return sendOCIManifest(c, dest, "STALE", "")
+	}
+	logger.Named(loggerNS).Debugf("Remote %s saved as %s", upstreamURL, dest)
+	if err = os.Chtimes(dest, time.Now(), time.Now()); err != nil {
+		logger.Named(loggerNS).Errorf("Cache timestamp update error: %s", err)
+	}
+
+	cacheStatus := "MISS"
+	if cacheExists {
+		cacheStatus = "EXPIRED"
+	}
+	if byDigest {
+		return sendOCIManifest(c, dest, cacheStatus, reference)
+	}
+	// Keep the manifest by digest as well, as clients pull the platform
+	// manifests of an index by digest.
+	if payload, errRead := os.ReadFile(filepath.Clean(dest)); errRead == nil {
+		if errCopy := ociStoreManifest(ociManifestPath(repoDir, name, ociDigest(payload)), payload); errCopy != nil {
+			logger.Named(loggerNS).Errorf("Manifest copy error: %s", errCopy)
+		}
+	}
+	return sendOCIManifest(c, dest, cacheStatus, "")
+}
+
+func handleOCIBlob(c echo.Context, cfg types.ConfigFile, logger *zap.SugaredLogger, key, name, digest string) error {
+	client := upstream.Get("oci", key)
+	loggerNS := "oci_blob"
+	source := cfg.Server.OCI[key]
+	upstreamURL := fmt.Sprintf("%s/v2/%s/blobs/%s", strings.TrimSuffix(source.URL, "/"), name, digest)
+	algorithm, value, _ := strings.Cut(digest, ":")
+	// Blobs are content addressed, so they are shared by all images of the
+	// repository.
+	dest := filepath.Join(cfg.Dir, "oci", key, "blobs", algorithm, value)
+
+	c.Response().Header().Set("Docker-Content-Digest", digest)
+	if upstream.Offline() {
+		c.Response().Header().Set("Content-Type", echo.MIMEOctetStream)
+		return serveCached(c, dest, "HIT", offlineMissingArtifact)
+	}
+	if fileExists(dest) {
+		c.Response().Header().Add("X-Cache-Status", "HIT")
+		c.Response().Header().Set("Content-Type", echo.MIMEOctetStream)
+		return serveFile(c, dest)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		var size int64
+		status, err := ociFetch(client, source.URL, name, func(headers types.RequestHeaders) (int, error) {
+			resp, errHead := ociHead(client, upstreamURL, headers)
+			if errHead != nil {
+				return http.StatusBadGateway, errHead
+			}
+			size = resp.ContentLength
+			return resp.StatusCode, ociStatusError(resp)
+		})
+		if err != nil {
+			logger.Named(loggerNS).Errorf("[HEAD] %s", err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.NoContent(ociUpstreamStatus(status))
+		}
+		c.Response().Header().Add("X-Cache-Status", "MISS")
+		c.Response().Header().Set("Content-Type", echo.MIMEOctetStream)
+		if size >= 0 {
+			c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+		}
+		return c.NoContent(http.StatusOK)
+	}
+
+	var started bool
+	status, err := ociFetch(client, source.URL, name, func(headers types.RequestHeaders) (int, error) {
+		var code int
+		var errStream error
+		started, code, errStream = streamDownload(c, client, upstreamURL, dest, headers, &misc.Checksum{Algorithm: algorithm, Value: value}, "MISS", echo.MIMEOctetStream)
+		return code, errStream
+	})
+	if started {
+		logger.Named(loggerNS).Debugf("Remote %s streamed and saved as %s", upstreamURL, dest)
+		return err
+	}
+	logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+	return ociError(c, ociUpstreamStatus(status), "BLOB_UNKNOWN", fmt.Sprintf("%v", err))
+}
+
+// ociFetch runs fetch with the headers needed to pull name from the
+// registry at base, and runs it once more with a new token when upstream
+// rejected the cached one.
+func ociFetch(client *upstream.Client, base, name string, fetch func(types.RequestHeaders) (int, error)) (int, error) {
+	for attempt := 0; ; attempt++ {
+		headers := types.RequestHeaders{"User-Agent": "hub"}
+		authorization, err := client.RegistryAuthorization(base, name)
+		if err != nil {
+			return http.StatusBadGateway, fmt.Errorf("registry authorization: %v", err)
+		}
+		if authorization != "" {
+			headers["Authorization"] = authorization
+		}
+		status, err := fetch(headers)
+		if status != http.StatusUnauthorized || attempt > 0 {
+			return status, err
+		}
+		client.ForgetRegistryToken(name)
+	}
+}
+
+func ociHead(client *upstream.Client, upstreamURL string, headers types.RequestHeaders) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, upstreamURL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	return resp, nil
+}
+
+// ociHeadDigest returns the digest upstream currently serves for a
+// manifest.
+func ociHeadDigest(client *upstream.Client, base, upstreamURL, name string) (string, error) {
+	var digest string
+	_, err := ociFetch(client, base, name, func(headers types.RequestHeaders) (int, error) {
+		headers["Accept"] = ociManifestTypes
+		resp, err := ociHead(client, upstreamURL, headers)
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		digest = resp.Header.Get("Docker-Content-Digest")
+		return resp.StatusCode, ociStatusError(resp)
+	})
+	return digest, err
+}
+
+func ociStatusError(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendOCIManifest answers with a cached manifest. The digest is the one
+// the client asked for, or empty to use the sha256 of the manifest.
+func sendOCIManifest(c echo.Context, dest, cacheStatus, digest string) error {
+	payload, err := os.ReadFile(filepath.Clean(dest))
+	if err != nil {
+		return ociError(c, http.StatusInternalServerError, "UNKNOWN", "manifest read error")
+	}
+	if digest == "" {
+		digest = ociDigest(payload)
+	}
+	c.Response().Header().Add("X-Cache-Status", cacheStatus)
+	c.Response().Header().Set("Docker-Content-Digest", digest)
+	return c.Blob(http.StatusOK, ociMediaType(payload), payload)
+}
+
+// ociStoreManifest writes a manifest to its digest path unless it is there
+// already.
+func ociStoreManifest(dest string, payload []byte) error {
+	if fileExists(dest) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return err
+	}
+	temp := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".tmp.%s.%d", filepath.Base(dest), time.Now().UnixNano()))
+	if err := os.WriteFile(temp, payload, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, dest); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+func ociManifestPath(repoDir, name, reference string) string {
+	if algorithm, value, ok := strings.Cut(reference, ":"); ok {
+		return filepath.Join(repoDir, "manifests", filepath.FromSlash(name), "digests", algorithm, value)
+	}
+	return filepath.Join(repoDir, "manifests", filepath.FromSlash(name), "tags", reference)
+}
+
+func ociDigest(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ociMediaType returns the media type of a manifest. It is optional in OCI
+// manifests, which are then told apart by their fields.
+func ociMediaType(payload []byte) string {
+	var manifest struct {
+		MediaType     string          `json:"mediaType"`
+		SchemaVersion int             `json:"schemaVersion"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}
+	_ = json.Unmarshal(payload, &manifest)
+	switch {
+	case manifest.MediaType != "":
+		return manifest.MediaType
+	case manifest.SchemaVersion == 1:
+		return "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	case manifest.Manifests != nil:
+		return "application/vnd.oci.image.index.v1+json"
+	default:
+		return "application/vnd.oci.image.manifest.v1+json"
+	}
+}
+
+// ociUpstreamName returns the repository name to request from upstream.
+// Docker Hub keeps official images below "library/".
+func ociUpstreamName(base, name string) string {
+	u, err := url.Parse(base)
+	if err == nil && !strings.Contains(name, "/") {
+		switch u.Hostname() {
+		case "registry-1.docker.io", "index.docker.io", "docker.io":
+			return "library/" + name
+		}
+	}
+	return name
+}
+
+// ociUpstreamStatus returns the status to answer with when upstream failed
+// with status. Authentication failures are hub's, not the client's.
+func ociUpstreamStatus(status int) int {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden || status < http.StatusBadRequest {
+		return http.StatusBadGateway
+	}
+	return status
+}
+
+func ociError(c echo.Context, status int, code, message string) error {
+	c.Response().Header().Set("X-Cache-Status", "ERROR")
+	type ociErrorDetail struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	return c.JSON(status, struct {
+		Errors []ociErrorDetail `json:"errors"`
+	}{Errors: []ociErrorDetail{{Code: code, Message: message}}})
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
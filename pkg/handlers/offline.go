@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1" // #nosec G505 -- sha1 is only used for the npm shasum field
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// Offline mode answers misses of listings and metadata with 404 and misses
+// of artifacts with 504, the status caches use for "only-if-cached".
+const (
+	offlineMissingIndex    = http.StatusNotFound
+	offlineMissingArtifact = http.StatusGatewayTimeout
+)
+
+var errNotCached = errors.New("not cached")
+
+// offlineMiss answers a request for something that isn't cached while hub is
+// offline.
+func offlineMiss(c echo.Context, status int) error {
+	c.Response().Header().Set("X-Cache-Status", "ERROR")
+	return c.String(status, "Not cached, hub is offline\n")
+}
+
+// serveCached sends dest without contacting upstream, as done in offline
+// mode.
+func serveCached(c echo.Context, dest, cacheStatus string, missStatus int) error {
+	if !fileExists(dest) {
+		return offlineMiss(c, missStatus)
+	}
+	c.Response().Header().Add("X-Cache-Status", cacheStatus)
+	return serveFile(c, dest)
+}
+
+// cachedFiles lists the regular files of dir that hold cached content.
+func cachedFiles(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !storage.IsSidecar(e.Name()) && !storage.IsTemporary(e.Name()) {
+			files = append(files, e.Name())
+		}
+	}
+	return files
+}
+
+// cachedPypiMetadata builds the simple index of a project from its cached
+// distribution files, with the digests recorded in their sidecars.
+func cachedPypiMetadata(dir, name string) (types.PypiMetadata, error) {
+	metadata := types.PypiMetadata{Name: name}
+	metadata.Meta.APIVersion = "1.0"
+	for _, file := range cachedFiles(dir) {
+		if file == "index.json" || storage.PypiVersion(file) == "" {
+			continue
+		}
+		f := types.PypiFile{Filename: file, Yanked: false}
+		sha, err := pypiSHA256(filepath.Join(dir, file))
+		if err != nil {
+			return metadata, err
+		}
+		f.Hashes.Sha256 = sha
+		metadata.Files = append(metadata.Files, f)
+	}
+	if len(metadata.Files) == 0 {
+		return metadata, errNotCached
+	}
+	return metadata, nil
+}
+
+// cachedGoVersions returns the versions of a module that have files in its
+// cached @v directory, in semver order.
+func cachedGoVersions(dir string) []string {
+	var versions []string
+	for _, file := range cachedFiles(dir) {
+		ext := path.Ext(file)
+		if ext != ".info" && ext != ".mod" && ext != ".zip" {
+			continue
+		}
+		version, err := module.UnescapeVersion(strings.TrimSuffix(file, ext))
+		if err != nil || !semver.IsValid(version) || slices.Contains(versions, version) {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	semver.Sort(versions)
+	return versions
+}
+
+// cachedGoList builds the @v/list response of a module from its cached
+// versions. Like upstream lists, it leaves out pseudo-versions.
+func cachedGoList(dir string) string {
+	var list strings.Builder
+	for _, v := range cachedGoVersions(dir) {
+		if !module.IsPseudoVersion(v) {
+			list.WriteString(v + "\n")
+		}
+	}
+	return list.String()
+}
+
+// cachedNpmPackument builds a packument from the cached tarballs of a
+// package, using the package.json each of them carries.
+func cachedNpmPackument(tarballDir, name string) (map[string]any, error) {
+	versions := map[string]any{}
+	latest := ""
+	for _, file := range cachedFiles(tarballDir) {
+		if !strings.HasSuffix(file, ".tgz") {
+			continue
+		}
+		manifest, dist, err := readNpmTarball(filepath.Join(tarballDir, file))
+		if err != nil {
+			continue
+		}
+		version, _ := manifest["version"].(string)
+		if version == "" {
+			continue
+		}
+		dist["tarball"] = fmt.Sprintf("/%s/-/%s", name, file)
+		manifest["dist"] = dist
+		versions[version] = manifest
+		if v := "v" + version; semver.IsValid(v) && semver.Prerelease(v) == "" && semver.Compare(v, "v"+latest) > 0 {
+			latest = version
+		}
+	}
+	if len(versions) == 0 {
+		return nil, errNotCached
+	}
+	packument := map[string]any{"name": name, "versions": versions}
+	if latest != "" {
+		packument["dist-tags"] = map[string]any{"latest": latest}
+	}
+	return packument, nil
+}
+
+// offlineNpmPackument returns the cached packument of a package. Without one
+// for the requested Accept header, another cached variant is used, and
+// failing that, one built from the cached tarballs.
+func offlineNpmPackument(cacheDir, dataFile, tarballDir, name string) ([]byte, error) {
+	candidates := []string{dataFile}
+	for _, file := range cachedFiles(cacheDir) {
+		if strings.HasPrefix(file, "packument.") && strings.HasSuffix(file, ".json") {
+			candidates = append(candidates, filepath.Join(cacheDir, file))
+		}
+	}
+	for _, file := range candidates {
+		if payload, err := os.ReadFile(filepath.Clean(file)); err == nil {
+			return payload, nil
+		}
+	}
+	packument, err := cachedNpmPackument(tarballDir, name)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(packument)
+}
+
+func readNpmTarball(file string) (manifest, dist map[string]any, err error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	sha512sum := sha512.New()
+	sha1sum := sha1.New() // #nosec G401
+	r := io.TeeReader(f, io.MultiWriter(sha512sum, sha1sum))
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, errNext := tr.Next()
+		if errNext != nil {
+			return nil, nil, fmt.Errorf("%s: package.json not found", file)
+		}
+		// Tarballs normally use "package/" as their top directory, but not
+		// all of them do.
+		if dir, base := path.Split(header.Name); base == "package.json" && strings.Count(dir, "/") == 1 {
+			if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+	// The digests cover the whole file.
+	if _, err = io.Copy(io.Discard, r); err != nil {
+		return nil, nil, err
+	}
+	delete(manifest, "readme")
+	dist = map[string]any{
+		"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sha512sum.Sum(nil)),
+		"shasum":    hex.EncodeToString(sha1sum.Sum(nil)),
+	}
+	return manifest, dist, nil
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const pubContentType = "application/vnd.pub.v2+json"
+
+func Pub(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("pub", key)
+		loggerNS := "pub"
+
+		// Versions may hold "+", which clients can send escaped.
+		requestedPath, err := url.PathUnescape(c.Param("*"))
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if err != nil || name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		base := strings.TrimSuffix(cfg.Server.Pub[key].URL, "/")
+		repoDir := filepath.Join(cfg.Dir, "pub", key)
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+			"Accept":     pubContentType,
+		}
+		baseURL := fmt.Sprintf("%s://%s/pub/%s", c.Scheme(), c.Request().Host, key)
+
+		parts := strings.Split(name, "/")
+		switch {
+		case len(parts) == 3 && parts[0] == "api" && parts[1] == "packages":
+			dest := filepath.Join(repoDir, "api", "packages", parts[2])
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, base+"/"+name, dest, headers, 0)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return sendPubJSON(c, logger.Named(loggerNS), dest, baseURL)
+		case len(parts) == 4 && parts[0] == "api" && parts[1] == "packages" && parts[3] == "advisories":
+			dest := filepath.Join(repoDir, "advisories", parts[2])
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, base+"/"+name, dest, headers, 0)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			c.Response().Header().Set("Content-Type", pubContentType)
+			return serveFile(c, dest)
+		case len(parts) == 4 && parts[0] == "packages" && parts[2] == "versions" && strings.HasSuffix(parts[3], ".tar.gz"):
+			return handlePubArchive(c, logger.Named(loggerNS), client, base, repoDir, parts[1], strings.TrimSuffix(parts[3], ".tar.gz"), headers)
+		default:
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+	}
+}
+
+func handlePubArchive(c echo.Context, logger *zap.SugaredLogger, client *upstream.Client, base, repoDir, pkg, version string, headers types.RequestHeaders) error {
+	dest := filepath.Join(repoDir, "packages", pkg, "versions", version+".tar.gz")
+	if upstream.Offline() || fileExists(dest) {
+		return serveImmutable(c, logger, client, "", dest, headers, nil, "application/octet-stream")
+	}
+
+	archive, ok, _, err := findListed(logger, client, headers, func() (storage.PubArchive, bool) {
+		return storage.PubPackageArchive(repoDir, pkg, version)
+	}, func() ([]listing, int, error) {
+		return []listing{{url: base + "/api/packages/" + pkg, dest: filepath.Join(repoDir, "api", "packages", pkg)}}, http.StatusOK, nil
+	})
+	if err != nil {
+		logger.Debugf("No metadata for %s: %s", pkg, err)
+	}
+	if !ok {
+		c.Response().Header().Add("X-Cache-Status", "ERROR")
+		return c.String(http.StatusNotFound, "Version not found in metadata")
+	}
+
+	var checksum func() *misc.Checksum
+	if archive.SHA256 != "" {
+		checksum = func() *misc.Checksum {
+			return &misc.Checksum{Algorithm: "sha256", Value: archive.SHA256}
+		}
+	}
+	archiveURL, err := pubResolve(base, archive.URL)
+	if err != nil {
+		logger.Errorf("Invalid archive_url %q: %s", archive.URL, err)
+		c.Response().Header().Add("X-Cache-Status", "ERROR")
+		return c.String(http.StatusBadGateway, "Metadata error")
+	}
+	return serveImmutable(c, logger, client, archiveURL, dest, headers, checksum, "application/octet-stream")
+}
+
+// pubResolve resolves an archive_url, which may be relative to the
+// repository.
+func pubResolve(base, ref string) (string, error) {
+	baseURL, err := url.Parse(base + "/")
+	if err != nil {
+		return "", err
+	}
+	resolved, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(resolved).String(), nil
+}
+
+// sendPubJSON answers with cached package metadata, the archive_url of
+// every version pointing to hub.
+func sendPubJSON(c echo.Context, logger *zap.SugaredLogger, file, baseURL string) error {
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return c.String(http.StatusNotFound, "404 page not found")
+	}
+	var metadata map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&metadata); err != nil {
+		logger.Errorf("Metadata unmarshal error: %s", err)
+		return c.String(http.StatusBadGateway, "Metadata error")
+	}
+	rewritePubArchives(metadata, baseURL)
+	updated, err := json.Marshal(metadata)
+	if err != nil {
+		logger.Errorf("Metadata marshal error: %s", err)
+		return c.String(http.StatusInternalServerError, "Metadata error")
+	}
+	return c.Blob(http.StatusOK, pubContentType, updated)
+}
+
+// rewritePubArchives points archive_url of the latest and of every listed
+// version to "/pub/<key>/packages/<name>/versions/<version>.tar.gz", like
+// pub repositories used to serve them.
+func rewritePubArchives(metadata map[string]any, baseURL string) {
+	pkg, _ := metadata["name"].(string)
+	if pkg == "" || pkg == "." || pkg == ".." || url.PathEscape(pkg) != pkg {
+		return
+	}
+	versions, _ := metadata["versions"].([]any)
+	if latest, ok := metadata["latest"]; ok {
+		versions = append(versions, latest)
+	}
+	for _, v := range versions {
+		version, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		number, _ := version["version"].(string)
+		if number == "" || url.PathEscape(number) != number {
+			continue
+		}
+		if _, ok := version["archive_url"]; ok {
+			version["archive_url"] = fmt.Sprintf("%s/packages/%s/versions/%s.tar.gz", baseURL, pkg, number)
+		}
+	}
+}
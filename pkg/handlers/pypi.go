@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -18,19 +22,30 @@ func PypiSimple(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("pypi", key)
 		loggerNS := "pypi_simple"
 		name := c.Param("name")
-		url := fmt.Sprintf("%s/%s/", cfg.Server.PYPI[key], name)
+		url := fmt.Sprintf("%s/%s/", cfg.Server.PYPI[key].URL, name)
 		dest := fmt.Sprintf("%s/pypi/%s/%s/index.json", cfg.Dir, key, name)
 
-		scheme := c.Scheme()
-		host := c.Request().Host
 		headers := types.RequestHeaders{
 			"User-Agent": "pypi",
 			"Accept":     "application/vnd.pypi.simple.v1+json",
 		}
 
-		status, err := misc.DownloadFile(url, dest, headers)
+		if upstream.Offline() {
+			var pypiMetadata types.PypiMetadata
+			if err := pypiMetadata.ReadFromJSONFile(dest); err != nil {
+				if pypiMetadata, err = cachedPypiMetadata(filepath.Dir(dest), name); err != nil {
+					logger.Named(loggerNS).Debugf("Offline index of %s: %s", name, err)
+					return offlineMiss(c, offlineMissingIndex)
+				}
+			}
+			c.Response().Header().Add("X-Cache-Status", "STALE")
+			return renderPypiSimple(c, key, name, pypiMetadata)
+		}
+
+		status, err := misc.DownloadFile(client, url, dest, headers)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 			if _, err = os.Stat(dest); errors.Is(err, os.ErrNotExist) {
@@ -45,24 +60,32 @@ func PypiSimple(key string) echo.HandlerFunc {
 			logger.Named(loggerNS).Debugf("Remote %s saved as %s", url, dest)
 		}
 
-		c.Response().Header().Add("Content-Type", "text/html")
 		var pypiMetadata types.PypiMetadata
 		err = pypiMetadata.ReadFromJSONFile(dest)
 		if err != nil {
 			logger.Named(loggerNS).Errorf("Unable to parse local json file %s, got error: %s", dest, err)
 		}
+		return renderPypiSimple(c, key, name, pypiMetadata)
+	}
+}
 
-		for i := range pypiMetadata.Files {
-			pypiMetadata.Files[i].URL = fmt.Sprintf("%s://%s/pypi/%s/packages/%s/%s", scheme, host, key, name, pypiMetadata.Files[i].Filename)
-		}
-		return c.Render(http.StatusOK, "pypi", pypiMetadata)
+// renderPypiSimple answers with the simple index page of a project, linking
+// its files through hub.
+func renderPypiSimple(c echo.Context, key, name string, pypiMetadata types.PypiMetadata) error {
+	scheme := c.Scheme()
+	host := c.Request().Host
+	c.Response().Header().Add("Content-Type", "text/html")
+	for i := range pypiMetadata.Files {
+		pypiMetadata.Files[i].URL = fmt.Sprintf("%s://%s/pypi/%s/packages/%s/%s", scheme, host, key, name, pypiMetadata.Files[i].Filename)
 	}
+	return c.Render(http.StatusOK, "pypi", pypiMetadata)
 }
 
 func PypiPackages(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("pypi", key)
 		loggerNS := "pypi_packages"
 		name := c.Param("name")
 		filename := c.Param("filename")
@@ -75,6 +98,16 @@ func PypiPackages(key string) echo.HandlerFunc {
 			"User-Agent": "pypi",
 		}
 
+		if upstream.Offline() {
+			if !fileExists(dest) {
+				return offlineMiss(c, offlineMissingArtifact)
+			}
+			c.Response().Header().Add("X-Cache-Status", "HIT")
+			c.Response().Header().Add("Content-Type", "application/gzip")
+			c.Response().Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+			return serveFile(c, dest)
+		}
+
 		indexFileInfo, err := os.Stat(indexDest)
 		if err == nil {
 			modTime := indexFileInfo.ModTime()
@@ -83,13 +116,13 @@ func PypiPackages(key string) echo.HandlerFunc {
 			if modTime.Before(oneHourAgo) {
 				logger.Named(loggerNS).Debugf("Index file older than 1 hour: %s", indexDest)
 
-				url = fmt.Sprintf("%s/%s/", cfg.Server.PYPI[key], name)
+				url = fmt.Sprintf("%s/%s/", cfg.Server.PYPI[key].URL, name)
 
 				headers = types.RequestHeaders{
 					"User-Agent": "pypi",
 					"Accept":     "application/vnd.pypi.simple.v1+json",
 				}
-				_, err = misc.DownloadFile(url, indexDest, headers)
+				_, err = misc.DownloadFile(client, url, indexDest, headers)
 				if err != nil {
 					logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 				}
@@ -102,13 +135,13 @@ func PypiPackages(key string) echo.HandlerFunc {
 		if err != nil {
 			logger.Named(loggerNS).Debugf("Parse local json file %s, got error: %s", indexDest, err)
 
-			url = fmt.Sprintf("%s/%s/", cfg.Server.PYPI[key], name)
+			url = fmt.Sprintf("%s/%s/", cfg.Server.PYPI[key].URL, name)
 
 			headers = types.RequestHeaders{
 				"User-Agent": "pypi",
 				"Accept":     "application/vnd.pypi.simple.v1+json",
 			}
-			_, err := misc.DownloadFile(url, indexDest, headers)
+			_, err := misc.DownloadFile(client, url, indexDest, headers)
 			if err != nil {
 				logger.Named(loggerNS).Errorf("[Downloading] %s", err)
 				c.Response().Header().Add("X-Cache-Status", "ERROR")
@@ -136,37 +169,92 @@ func PypiPackages(key string) echo.HandlerFunc {
 			return c.String(http.StatusNotFound, fmt.Sprintf("URL is empty for %s/%s", name, filename))
 		}
 
+		cacheStatus := "HIT"
 		if _, err := os.Stat(dest); errors.Is(err, os.ErrNotExist) {
-			status, err := misc.DownloadFile(url, dest, headers)
-			if err != nil {
-				logger.Named(loggerNS).Errorf("Downloading %s error: %s", url, err)
-				c.Response().Header().Add("X-Cache-Status", "ERROR")
-				return c.String(status, fmt.Sprintf("%v", err))
-			}
 			logger.Named(loggerNS).Debugf("Local file %s not found", dest)
-			c.Response().Header().Add("X-Cache-Status", "MISS")
+			cacheStatus = "MISS"
 		} else {
-			localSha, err := misc.CalculateSHA256(dest)
+			localSha, err := pypiSHA256(dest)
 			if err != nil {
 				logger.Named(loggerNS).Errorf("SHA calculating for %s error: %s", dest, err)
 			}
-			if sha == localSha {
-				c.Response().Header().Add("X-Cache-Status", "HIT")
-			} else {
+			if sha != localSha {
 				logger.Named(loggerNS).Errorf("SHA mismatch for %s local %s and remote %s", dest, localSha, sha)
-				status, err := misc.DownloadFile(url, dest, headers)
-				if err != nil {
-					logger.Named(loggerNS).Errorf("[Downloading] %s", err)
-					c.Response().Header().Add("X-Cache-Status", "ERROR")
-					return c.String(status, fmt.Sprintf("%v", err))
+				cacheStatus = "EXPIRED"
+			}
+		}
+
+		if cacheStatus != "HIT" {
+			var checksum *misc.Checksum
+			if sha != "" {
+				checksum = &misc.Checksum{Algorithm: "sha256", Value: sha}
+			}
+			c.Response().Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+			started, status, err := streamDownload(c, client, url, dest, headers, checksum, cacheStatus, "application/gzip")
+			if started {
+				logger.Named(loggerNS).Debugf("Remote %s streamed and saved as %s", url, dest)
+				// The transfer verified the file against the index digest.
+				if err == nil && sha != "" {
+					if errDigest := writePypiDigest(dest, sha); errDigest != nil {
+						logger.Named(loggerNS).Errorf("Digest write for %s error: %s", dest, errDigest)
+					}
 				}
-				logger.Named(loggerNS).Debugf("Remote %s saved as %s", url, dest)
-				c.Response().Header().Add("X-Cache-Status", "EXPIRED")
+				return err
 			}
+			c.Response().Header().Del("Content-Disposition")
+			logger.Named(loggerNS).Errorf("Downloading %s error: %s", url, err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(status, fmt.Sprintf("%v", err))
 		}
 
+		c.Response().Header().Add("X-Cache-Status", cacheStatus)
 		c.Response().Header().Add("Content-Type", "application/gzip")
 		c.Response().Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-		return c.File(dest)
+		return serveFile(c, dest)
+	}
+}
+
+// pypiDigest is the sidecar of a cached distribution. It holds the SHA-256
+// digest of the file, which is valid while the size and modification time
+// still match.
+type pypiDigest struct {
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// writePypiDigest records sha as the digest of the distribution cached at
+// file.
+func writePypiDigest(file, sha string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(pypiDigest{SHA256: sha, Size: info.Size(), Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Clean(storage.Sidecars(file)[0]), data, 0o600)
+}
+
+// pypiSHA256 returns the SHA-256 digest of the distribution cached at file.
+// It is read from the sidecar when that still describes the file, else it
+// is calculated and recorded there.
+func pypiSHA256(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	var digest pypiDigest
+	if data, errRead := os.ReadFile(filepath.Clean(storage.Sidecars(file)[0])); errRead == nil && json.Unmarshal(data, &digest) == nil {
+		if digest.SHA256 != "" && digest.Size == info.Size() && digest.Modified.Equal(info.ModTime()) {
+			return digest.SHA256, nil
+		}
+	}
+	sha, err := misc.CalculateSHA256(file)
+	if err != nil {
+		return "", err
 	}
+	_ = writePypiDigest(file, sha)
+	return sha, nil
 }
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/inflight"
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// rpmRepomdTTL is how long repomd.xml is served from the cache before
+	// being revalidated upstream.
+	rpmRepomdTTL = time.Minute
+	// rpmMirrorTTL is how long a base URL picked from a mirrorlist or a
+	// metalink is used before the list is fetched again.
+	rpmMirrorTTL = time.Hour
+)
+
+type rpmMirror struct {
+	base    string
+	expires time.Time
+}
+
+// rpmMirrors keeps the mirror in use by each repository. Mirror lists are
+// fetched without holding rpmMirrorsMu; concurrent fetches for the same
+// repository are coalesced by rpmMirrorFetches.
+var (
+	rpmMirrorsMu     sync.Mutex
+	rpmMirrors       = map[string]rpmMirror{}
+	rpmMirrorFetches = inflight.New(nil)
+)
+
+type rpmMirrorResult struct {
+	base string
+	err  error
+}
+
+func RPM(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("rpm", key)
+		loggerNS := "rpm"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		repoDir := filepath.Join(cfg.Dir, "rpm", key)
+		dest := filepath.Join(repoDir, filepath.FromSlash(name))
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+
+		// Cached files are served without a base URL in offline mode.
+		base := ""
+		if !upstream.Offline() {
+			var err error
+			base, err = rpmBase(client, key, cfg.Server.RPM[key])
+			if err != nil {
+				logger.Named(loggerNS).Errorf("[Mirror] %s", err)
+				if !fileExists(dest) {
+					c.Response().Header().Add("X-Cache-Status", "ERROR")
+					return c.String(http.StatusBadGateway, "Please check logs...")
+				}
+			}
+		}
+		url := base + "/" + name
+
+		if storage.RPMMutable(name) {
+			cacheStatus, status, err := fetchRevalidated(logger.Named(loggerNS), client, url, dest, headers, rpmRepomdTTL)
+			if err != nil {
+				return revalidationFailed(c, status, err)
+			}
+			c.Response().Header().Add("X-Cache-Status", cacheStatus)
+			return serveFile(c, dest)
+		}
+
+		checksum := func() *misc.Checksum {
+			var sum *misc.Checksum
+			if storage.IsRPMPackage(name) {
+				sum = storage.RPMChecksum(repoDir, name)
+			} else {
+				sum = storage.RPMMetadataChecksum(repoDir, name)
+			}
+			if sum == nil {
+				logger.Named(loggerNS).Debugf("No checksum for %s in the cached repository metadata", name)
+			}
+			return sum
+		}
+		return serveImmutable(c, logger.Named(loggerNS), client, url, dest, headers, checksum, "")
+	}
+}
+
+// rpmBase returns the base URL of an RPM repository. For repositories
+// configured with a mirrorlist or a metalink, the first mirror listed is
+// used until rpmMirrorTTL expires. If the list can't be fetched then, the
+// previous mirror is kept.
+func rpmBase(client *upstream.Client, key string, source types.RPMSource) (string, error) {
+	if source.URL != "" {
+		return strings.TrimSuffix(source.URL, "/"), nil
+	}
+
+	rpmMirrorsMu.Lock()
+	mirror, ok := rpmMirrors[key]
+	rpmMirrorsMu.Unlock()
+	if ok && time.Now().Before(mirror.expires) {
+		return mirror.base, nil
+	}
+
+	value, _ := rpmMirrorFetches.Do(key, func() any {
+		bases, err := rpmMirrorList(client, source)
+		if err == nil && len(bases) == 0 {
+			err = errors.New("no usable mirror listed")
+		}
+		rpmMirrorsMu.Lock()
+		defer rpmMirrorsMu.Unlock()
+		if err != nil {
+			if ok {
+				mirror.expires = time.Now().Add(time.Minute)
+				rpmMirrors[key] = mirror
+				return rpmMirrorResult{base: mirror.base, err: err}
+			}
+			return rpmMirrorResult{err: err}
+		}
+		rpmMirrors[key] = rpmMirror{base: bases[0], expires: time.Now().Add(rpmMirrorTTL)}
+		return rpmMirrorResult{base: bases[0]}
+	})
+	result := value.(rpmMirrorResult)
+	return result.base, result.err
+}
+
+// rpmMirrorList fetches the mirrorlist or metalink of source and returns
+// the base URLs it lists, most preferred first.
+func rpmMirrorList(client *upstream.Client, source types.RPMSource) ([]string, error) {
+	listURL := source.Metalink
+	if listURL == "" {
+		listURL = source.Mirrorlist
+	}
+	req, err := http.NewRequest(http.MethodGet, listURL, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "hub")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", listURL, resp.Status)
+	}
+	body := io.LimitReader(resp.Body, 8*1024*1024)
+	if source.Metalink != "" {
+		return parseMetalink(body)
+	}
+	return parseMirrorlist(body)
+}
+
+// parseMirrorlist reads a mirrorlist: one base URL per line, with comments.
+func parseMirrorlist(r io.Reader) ([]string, error) {
+	var bases []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			bases = append(bases, strings.TrimSuffix(line, "/"))
+		}
+	}
+	return bases, scanner.Err()
+}
+
+// parseMetalink reads the URLs of repomd.xml listed in a metalink and
+// returns their base URLs, ordered by preference.
+func parseMetalink(r io.Reader) ([]string, error) {
+	type resource struct {
+		Preference int    `xml:"preference,attr"`
+		URL        string `xml:",chardata"`
+	}
+	var metalink struct {
+		URLs []resource `xml:"files>file>resources>url"`
+	}
+	if err := xml.NewDecoder(r).Decode(&metalink); err != nil {
+		return nil, err
+	}
+	urls := metalink.URLs
+	slices.SortStableFunc(urls, func(a, b resource) int {
+		return b.Preference - a.Preference
+	})
+	var bases []string
+	for _, u := range urls {
+		raw := strings.TrimSpace(u.URL)
+		if !strings.HasPrefix(raw, "http://") && !strings.HasPrefix(raw, "https://") {
+			continue
+		}
+		if base, ok := strings.CutSuffix(raw, "/repodata/repomd.xml"); ok {
+			bases = append(bases, base)
+		}
+	}
+	return bases, nil
+}
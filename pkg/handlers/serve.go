@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// missingFileTTL is how recently metadata must have been revalidated for a
+// file it doesn't list to be reported missing without asking upstream
+// again. It keeps requests for unknown files from downloading the metadata
+// on every request.
+const missingFileTTL = 30 * time.Second
+
+// serveFile sends a cached file, keeping it from being evicted while it is
+// being sent.
+func serveFile(c echo.Context, dest string) error {
+	release := storage.Acquire(dest)
+	defer release()
+	return c.File(dest)
+}
+
+// serveImmutable sends an artifact that never changes upstream. Cached
+// copies are sent without asking upstream; misses are streamed while they
+// are downloaded. checksum, when set, is only called on a miss and returns
+// the digest the download must match, or nil.
+func serveImmutable(c echo.Context, logger *zap.SugaredLogger, client *upstream.Client, url, dest string, headers types.RequestHeaders, checksum func() *misc.Checksum, contentType string) error {
+	if contentType != "" {
+		c.Response().Header().Set("Content-Type", contentType)
+	}
+	if upstream.Offline() {
+		return serveCached(c, dest, "HIT", offlineMissingArtifact)
+	}
+	if fileExists(dest) {
+		c.Response().Header().Add("X-Cache-Status", "HIT")
+		return serveFile(c, dest)
+	}
+
+	var sum *misc.Checksum
+	if checksum != nil {
+		sum = checksum()
+	}
+	started, status, err := streamDownload(c, client, url, dest, headers, sum, "MISS", contentType)
+	if started {
+		logger.Debugf("Remote %s streamed and saved as %s", url, dest)
+		return err
+	}
+	logger.Errorf("[Downloading] %s", err)
+	c.Response().Header().Del("Content-Type")
+	c.Response().Header().Add("X-Cache-Status", "ERROR")
+	return c.String(status, "Please check logs...")
+}
+
+// revalidatedMeta is the sidecar of a file revalidated by fetchRevalidated.
+type revalidatedMeta struct {
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	Checked      time.Time `json:"checked"`
+}
+
+// fetchRevalidated makes sure dest holds a current copy of the index or
+// metadata file at url. A copy checked less than ttl ago is used as is,
+// older ones are revalidated with a conditional request. It returns the
+// cache status to report, or the status to answer with when nothing can be
+// served.
+func fetchRevalidated(logger *zap.SugaredLogger, client *upstream.Client, url, dest string, headers types.RequestHeaders, ttl time.Duration) (cacheStatus string, status int, err error) {
+	cacheExists := fileExists(dest)
+	if upstream.Offline() {
+		if cacheExists {
+			return "STALE", http.StatusOK, nil
+		}
+		return "", offlineMissingIndex, upstream.ErrOffline
+	}
+
+	metaFile := storage.Sidecars(dest)[0]
+	meta := revalidatedMeta{}
+	if cacheExists {
+		if data, errRead := os.ReadFile(filepath.Clean(metaFile)); errRead == nil {
+			_ = json.Unmarshal(data, &meta)
+		}
+		if time.Since(meta.Checked) < ttl {
+			return "HIT", http.StatusOK, nil
+		}
+	}
+
+	status, newETag, newLastModified, notModified, err := misc.DownloadFileConditional(client, url, dest, headers, meta.ETag, meta.LastModified)
+	if err != nil {
+		logger.Errorf("[Downloading] %s", err)
+		if !cacheExists {
+			return "", status, err
+		}
+		logger.Debugf("Remote %s served from local file %s", url, dest)
+		return "STALE", http.StatusOK, nil
+	}
+
+	switch {
+	case notModified:
+		cacheStatus = "HIT"
+	case cacheExists:
+		cacheStatus = "EXPIRED"
+	default:
+		cacheStatus = "MISS"
+	}
+	if !notModified {
+		logger.Debugf("Remote %s saved as %s", url, dest)
+		meta = revalidatedMeta{}
+	}
+	if newETag != "" {
+		meta.ETag = newETag
+	}
+	if newLastModified != "" {
+		meta.LastModified = newLastModified
+	}
+	meta.Checked = time.Now()
+	if data, errMarshal := json.Marshal(meta); errMarshal == nil {
+		if errWrite := os.WriteFile(filepath.Clean(metaFile), data, 0o600); errWrite != nil {
+			logger.Errorf("Cache meta write error: %s", errWrite)
+		}
+	}
+	return cacheStatus, http.StatusOK, nil
+}
+
+// revalidationFailed answers a request for an index that fetchRevalidated
+// could not provide.
+func revalidationFailed(c echo.Context, status int, err error) error {
+	if errors.Is(err, upstream.ErrOffline) {
+		return offlineMiss(c, status)
+	}
+	c.Response().Header().Add("X-Cache-Status", "ERROR")
+	return c.String(status, "Please check logs...")
+}
+
+// listing is a cached metadata file that lists the files of a package, and
+// the URL it is revalidated from.
+type listing struct {
+	url  string
+	dest string
+	// fallback is set for another form of the previous listing, which is
+	// only revalidated when that one could not be.
+	fallback bool
+}
+
+// findListed returns what lookup finds in cached metadata. Files published
+// after the metadata was cached are missing from it, so on a miss the
+// listings returned by listings are revalidated in turn, each at most every
+// missingFileTTL, until lookup finds the file. When it is still missing,
+// status and err tell why the last listing could not be revalidated, if it
+// could not.
+func findListed[T any](logger *zap.SugaredLogger, client *upstream.Client, headers types.RequestHeaders, lookup func() (T, bool), listings func() ([]listing, int, error)) (result T, found bool, status int, err error) {
+	if result, found = lookup(); found {
+		return result, true, http.StatusOK, nil
+	}
+	files, status, err := listings()
+	if err != nil {
+		return result, false, status, err
+	}
+	for i, file := range files {
+		if file.fallback && i > 0 && err == nil {
+			continue
+		}
+		if _, status, err = fetchRevalidated(logger, client, file.url, file.dest, headers, missingFileTTL); err != nil {
+			continue
+		}
+		if result, found = lookup(); found {
+			return result, true, http.StatusOK, nil
+		}
+	}
+	return result, false, status, err
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/psvmcc/hub/pkg/misc"
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -17,48 +18,52 @@ func Static(key string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		cfg := c.Get("cfg").(types.ConfigFile)
 		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("static", key)
 		loggerNS := "static"
 		path := strings.TrimPrefix(c.Request().URL.String(), fmt.Sprintf("/static/%s/get/", key))
-		url := fmt.Sprintf("%s/%s", cfg.Server.Static[key], path)
+		url := fmt.Sprintf("%s/%s", cfg.Server.Static[key].URL, path)
 		dest := fmt.Sprintf("%s/static/%s/%s", cfg.Dir, key, path)
 
 		headers := types.RequestHeaders{
 			"User-Agent": "curl",
 		}
 
+		if upstream.Offline() {
+			return serveCached(c, dest, "STALE", offlineMissingArtifact)
+		}
+
 		cacheExists := true
 		if _, err := os.Stat(dest); errors.Is(err, os.ErrNotExist) {
 			cacheExists = false
 		} else {
-			equal, err := misc.FilesEqual(url, dest)
+			equal, err := misc.FilesEqual(client, url, dest)
 			if err != nil {
 				logger.Named(loggerNS).Errorf("[FilesEqual]: %s", err)
 			}
 
 			if equal {
 				c.Response().Header().Add("X-Cache-Status", "HIT")
-				return c.File(dest)
+				return serveFile(c, dest)
 			}
 		}
 
-		status, err := misc.DownloadFile(url, dest, headers)
-		if err != nil {
-			logger.Named(loggerNS).Errorf("[Downloading] %s", err)
-			if _, err := os.Stat(dest); errors.Is(err, os.ErrNotExist) {
-				logger.Named(loggerNS).Errorf("[FS]: %s", err)
-				c.Response().Header().Add("X-Cache-Status", "ERROR")
-				return c.String(status, "Please check logs...")
-			}
-			c.Response().Header().Add("X-Cache-Status", "STALE")
-			logger.Named(loggerNS).Debugf("Remote %s served from local file %s", url, dest)
-		} else {
-			if cacheExists {
-				c.Response().Header().Add("X-Cache-Status", "EXPIRED")
-			} else {
-				c.Response().Header().Add("X-Cache-Status", "MISS")
-			}
-			logger.Named(loggerNS).Debugf("Remote %s saved as %s", url, dest)
+		cacheStatus := "MISS"
+		if cacheExists {
+			cacheStatus = "EXPIRED"
+		}
+		started, status, err := streamDownload(c, client, url, dest, headers, nil, cacheStatus, "")
+		if started {
+			logger.Named(loggerNS).Debugf("Remote %s streamed and saved as %s", url, dest)
+			return err
+		}
+		logger.Named(loggerNS).Errorf("[Downloading] %s", err)
+		if _, err := os.Stat(dest); errors.Is(err, os.ErrNotExist) {
+			logger.Named(loggerNS).Errorf("[FS]: %s", err)
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(status, "Please check logs...")
 		}
-		return c.File(dest)
+		c.Response().Header().Add("X-Cache-Status", "STALE")
+		logger.Named(loggerNS).Debugf("Remote %s served from local file %s", url, dest)
+		return serveFile(c, dest)
 	}
 }
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+)
+
+// streamDownload fetches url into dest and streams the body to the client
+// while it is being written to the cache. Clients requesting a file that is
+// already being downloaded follow the same transfer. When the upstream
+// response could not be started nothing is written to the client and the
+// caller handles the error like a failed misc.DownloadFile.
+//
+// HEAD and Range requests are answered from the cached file once the
+// transfer is complete, like cache hits.
+func streamDownload(c echo.Context, client *upstream.Client, url, dest string, headers types.RequestHeaders, checksum *misc.Checksum, cacheStatus, contentType string) (started bool, status int, err error) {
+	transfer := misc.StartDownload(client, url, dest, headers, checksum)
+	if c.Request().Method == http.MethodHead || c.Request().Header.Get("Range") != "" {
+		if status, err = transfer.Wait(); err != nil {
+			return false, status, err
+		}
+		c.Response().Header().Add("X-Cache-Status", cacheStatus)
+		return true, http.StatusOK, serveFile(c, dest)
+	}
+
+	reader, size, status, err := transfer.Open()
+	if err != nil {
+		return false, status, err
+	}
+	defer reader.Close()
+	release := storage.Acquire(dest)
+	defer release()
+
+	// The content type is chosen like http.ServeContent does for cache hits:
+	// from the extension, else by sniffing the first bytes.
+	var body io.Reader = reader
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(dest))
+	}
+	if contentType == "" {
+		var sniffed [512]byte
+		n, errRead := io.ReadFull(reader, sniffed[:])
+		if errRead != nil && !errors.Is(errRead, io.EOF) && !errors.Is(errRead, io.ErrUnexpectedEOF) {
+			status, _ = transfer.Wait()
+			return false, status, errRead
+		}
+		contentType = http.DetectContentType(sniffed[:n])
+		body = io.MultiReader(bytes.NewReader(sniffed[:n]), reader)
+	}
+	c.Response().Header().Add("X-Cache-Status", cacheStatus)
+	if size >= 0 {
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(size, 10))
+	}
+	return true, http.StatusOK, c.Stream(http.StatusOK, contentType, body)
+}
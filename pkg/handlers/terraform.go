@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// terraformDiscoveryTTL is how long the service discovery document of
+	// upstream is served from the cache before being revalidated.
+	terraformDiscoveryTTL = time.Hour
+	// terraformMetadataTTL applies to version lists and provider download
+	// responses.
+	terraformMetadataTTL = 5 * time.Minute
+)
+
+// terraformDownload is the part of a provider download response used to
+// find the files of a provider version upstream.
+type terraformDownload struct {
+	Filename            string `json:"filename"`
+	DownloadURL         string `json:"download_url"`
+	ShasumsURL          string `json:"shasums_url"`
+	ShasumsSignatureURL string `json:"shasums_signature_url"`
+	Shasum              string `json:"shasum"`
+}
+
+// TerraformDiscovery answers the service discovery of Terraform and OpenTofu
+// with the registry APIs of repository key.
+func TerraformDiscovery(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		base := fmt.Sprintf("%s://%s/terraform/%s/v1/", c.Scheme(), c.Request().Host, key)
+		return c.JSON(http.StatusOK, map[string]string{
+			"providers.v1": base + "providers/",
+			"modules.v1":   base + "modules/",
+		})
+	}
+}
+
+// TerraformRootDiscovery answers service discovery at the root of the host.
+// Terraform looks for a single repository there: a host named after a
+// Terraform repository (e.g. "registry.example.com" for the key
+// "registry.example.com") gets that repository, any other host gets
+// fallback.
+func TerraformRootDiscovery(fallback string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		host := c.Request().Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if _, ok := cfg.Server.Terraform[host]; ok {
+			return TerraformDiscovery(host)(c)
+		}
+		return TerraformDiscovery(fallback)(c)
+	}
+}
+
+func Terraform(key string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := c.Get("cfg").(types.ConfigFile)
+		logger := c.Get("logger").(*zap.SugaredLogger)
+		client := upstream.Get("terraform", key)
+		loggerNS := "terraform"
+
+		requestedPath := c.Param("*")
+		name := strings.TrimPrefix(path.Clean("/"+requestedPath), "/")
+		if name == "" || strings.HasSuffix(requestedPath, "/") {
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+		if name == ".well-known/terraform.json" {
+			return TerraformDiscovery(key)(c)
+		}
+
+		repoDir := filepath.Join(cfg.Dir, "terraform", key)
+		headers := types.RequestHeaders{
+			"User-Agent": "hub",
+		}
+		parts := strings.Split(name, "/")
+		isFile := len(parts) == 5 && parts[0] == "providers"
+		switch {
+		case isFile && (upstream.Offline() || fileExists(filepath.Join(repoDir, filepath.FromSlash(name)))):
+			return serveImmutable(c, logger.Named(loggerNS), client, "", filepath.Join(repoDir, filepath.FromSlash(name)), headers, nil, "")
+		case !isFile && (len(parts) < 2 || parts[0] != "v1"):
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+
+		providers, modules, status, err := terraformServices(logger.Named(loggerNS), client, cfg, key)
+		if err != nil {
+			return revalidationFailed(c, status, err)
+		}
+		if isFile {
+			if providers == "" {
+				return c.String(http.StatusNotFound, "404 page not found")
+			}
+			downloads := providers + strings.Join(parts[1:4], "/") + "/download/"
+			return handleTerraformFile(c, logger.Named(loggerNS), client, repoDir, name, downloads, headers)
+		}
+		parts = parts[1:]
+		rel := strings.Join(parts[1:], "/")
+		switch {
+		case len(parts) == 4 && parts[0] == "providers" && parts[3] == "versions" && providers != "":
+			return serveTerraformMetadata(c, logger.Named(loggerNS), client, providers+rel, filepath.Join(repoDir, filepath.FromSlash(strings.Join(parts, "/"))), headers, nil)
+		case len(parts) == 7 && parts[0] == "providers" && parts[4] == "download" && providers != "":
+			upstreamURL := providers + rel
+			dest := filepath.Join(repoDir, "providers", parts[1], parts[2], parts[3], "download", parts[5]+"_"+parts[6]+".json")
+			files := fmt.Sprintf("%s://%s/terraform/%s/providers/%s/%s/%s/", c.Scheme(), c.Request().Host, key, parts[1], parts[2], parts[3])
+			return serveTerraformMetadata(c, logger.Named(loggerNS), client, upstreamURL, dest, headers, func(download map[string]any) {
+				for _, field := range []string{"download_url", "shasums_url", "shasums_signature_url"} {
+					if fileURL, ok := download[field].(string); ok && fileURL != "" {
+						download[field] = files + url.PathEscape(terraformFileName(upstreamURL, fileURL))
+					}
+				}
+			})
+		case len(parts) == 5 && parts[0] == "modules" && parts[4] == "versions" && modules != "":
+			return serveTerraformMetadata(c, logger.Named(loggerNS), client, modules+rel, filepath.Join(repoDir, filepath.FromSlash(strings.Join(parts, "/"))), headers, nil)
+		case len(parts) == 6 && parts[0] == "modules" && parts[5] == "download" && modules != "":
+			return handleTerraformModuleDownload(c, logger.Named(loggerNS), client, modules+rel, filepath.Join(repoDir, filepath.FromSlash(strings.Join(parts, "/")))+".json")
+		default:
+			return c.String(http.StatusNotFound, "404 page not found")
+		}
+	}
+}
+
+// terraformServices returns the base URLs of the provider and module
+// registry APIs of upstream, empty when it doesn't implement one.
+func terraformServices(logger *zap.SugaredLogger, client *upstream.Client, cfg types.ConfigFile, key string) (providers, modules string, status int, err error) {
+	discoveryURL := strings.TrimSuffix(cfg.Server.Terraform[key].URL, "/") + "/.well-known/terraform.json"
+	dest := filepath.Join(cfg.Dir, "terraform", key, ".well-known", "terraform.json")
+	if _, status, err = fetchRevalidated(logger, client, discoveryURL, dest, types.RequestHeaders{"User-Agent": "hub"}, terraformDiscoveryTTL); err != nil {
+		return "", "", status, err
+	}
+	data, err := os.ReadFile(filepath.Clean(dest))
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	var services map[string]any
+	if err = json.Unmarshal(data, &services); err != nil {
+		return "", "", http.StatusBadGateway, fmt.Errorf("service discovery: %v", err)
+	}
+	base, err := url.Parse(discoveryURL)
+	if err != nil {
+		return "", "", http.StatusInternalServerError, err
+	}
+	resolve := func(service string) string {
+		ref, ok := services[service].(string)
+		if !ok {
+			return ""
+		}
+		resolved, err := url.Parse(ref)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSuffix(base.ResolveReference(resolved).String(), "/") + "/"
+	}
+	return resolve("providers.v1"), resolve("modules.v1"), http.StatusOK, nil
+}
+
+// serveTerraformMetadata serves a JSON document of the registry API,
+// revalidated after terraformMetadataTTL, rewritten by rewrite if set.
+func serveTerraformMetadata(c echo.Context, logger *zap.SugaredLogger, client *upstream.Client, upstreamURL, dest string, headers types.RequestHeaders, rewrite func(document map[string]any)) error {
+	cacheStatus, status, err := fetchRevalidated(logger, client, upstreamURL, dest, headers, terraformMetadataTTL)
+	if err != nil {
+		return revalidationFailed(c, status, err)
+	}
+	c.Response().Header().Add("X-Cache-Status", cacheStatus)
+	if rewrite == nil {
+		c.Response().Header().Set("Content-Type", "application/json")
+		return serveFile(c, dest)
+	}
+
+	data, err := os.ReadFile(filepath.Clean(dest))
+	if err != nil {
+		return c.String(http.StatusNotFound, "404 page not found")
+	}
+	var document map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&document); err != nil {
+		logger.Errorf("Metadata unmarshal error: %s", err)
+		return c.String(http.StatusBadGateway, "Metadata error")
+	}
+	rewrite(document)
+	return c.JSON(http.StatusOK, document)
+}
+
+// terraformFileName returns the file name of a provider file URL listed in
+// the download response fetched from downloadURL. The URLs may be relative
+// to the response.
+func terraformFileName(downloadURL, fileURL string) string {
+	base, err := url.Parse(downloadURL)
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(fileURL)
+	if err != nil {
+		return ""
+	}
+	return path.Base(base.ResolveReference(ref).Path)
+}
+
+// handleTerraformFile serves a provider zip, SHA256SUMS or signature file
+// listed in a cached download response of its provider version, fetched
+// from below downloads. Zips are verified against SHA256SUMS, which is
+// fetched first.
+func handleTerraformFile(c echo.Context, logger *zap.SugaredLogger, client *upstream.Client, repoDir, name, downloads string, headers types.RequestHeaders) error {
+	dest := filepath.Join(repoDir, filepath.FromSlash(name))
+	versionDir := filepath.Dir(dest)
+	file := path.Base(name)
+	download, fileURL, ok := terraformFile(versionDir, downloads, file)
+	if !ok {
+		c.Response().Header().Add("X-Cache-Status", "ERROR")
+		return c.String(http.StatusNotFound, "File not found in cached download responses")
+	}
+	if path.Ext(file) != ".zip" {
+		return serveImmutable(c, logger, client, fileURL, dest, headers, nil, "")
+	}
+
+	checksum := func() *misc.Checksum {
+		sumsURL := download.resolve(download.ShasumsURL)
+		sums := filepath.Join(versionDir, path.Base(sumsURL))
+		if download.ShasumsURL != "" && !fileExists(sums) {
+			if _, err := misc.StartDownload(client, sumsURL, sums, headers, nil).Wait(); err != nil {
+				logger.Errorf("[Downloading] %s: %s", sumsURL, err)
+			}
+		}
+		if sum := storage.TerraformChecksum(repoDir, name); sum != nil {
+			return sum
+		}
+		if download.Shasum != "" {
+			return &misc.Checksum{Algorithm: "sha256", Value: download.Shasum}
+		}
+		logger.Debugf("No checksum for %s", name)
+		return nil
+	}
+	return serveImmutable(c, logger, client, fileURL, dest, headers, checksum, "")
+}
+
+// terraformCachedDownload is a cached download response with the URL it
+// was fetched from.
+type terraformCachedDownload struct {
+	terraformDownload
+	url string
+}
+
+func (d terraformCachedDownload) resolve(fileURL string) string {
+	base, err := url.Parse(d.url)
+	if err != nil {
+		return fileURL
+	}
+	ref, err := url.Parse(fileURL)
+	if err != nil {
+		return fileURL
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// terraformFile finds the upstream URL of a file of a provider version in
+// the cached download responses of the version. They are stored as
+// "download/<os>_<arch>.json" and were fetched from downloads+"<os>/<arch>".
+func terraformFile(versionDir, downloads, file string) (terraformCachedDownload, string, bool) {
+	responses, _ := filepath.Glob(filepath.Join(versionDir, "download", "*.json"))
+	for _, response := range responses {
+		data, err := os.ReadFile(filepath.Clean(response))
+		if err != nil {
+			continue
+		}
+		var download terraformCachedDownload
+		if json.Unmarshal(data, &download.terraformDownload) != nil {
+			continue
+		}
+		platform := strings.TrimSuffix(filepath.Base(response), ".json")
+		download.url = downloads + strings.Replace(platform, "_", "/", 1)
+		for _, fileURL := range []string{download.DownloadURL, download.ShasumsURL, download.ShasumsSignatureURL} {
+			if fileURL != "" && terraformFileName(download.url, fileURL) == file {
+				return download, download.resolve(fileURL), true
+			}
+		}
+	}
+	return terraformCachedDownload{}, "", false
+}
+
+// handleTerraformModuleDownload answers the download endpoint of the module
+// registry with the location of the module source upstream returns, in the
+// X-Terraform-Get header. The location is cached for when upstream is
+// unreachable; module sources, usually git repositories, are fetched by the
+// client.
+func handleTerraformModuleDownload(c echo.Context, logger *zap.SugaredLogger, client *upstream.Client, downloadURL, dest string) error {
+	var module struct {
+		Location string `json:"location"`
+	}
+	cacheStatus := "MISS"
+	location, err := terraformModuleLocation(client, downloadURL)
+	if err == nil {
+		module.Location = location
+		data, _ := json.Marshal(module)
+		if err = os.MkdirAll(filepath.Dir(dest), 0o750); err == nil {
+			err = os.WriteFile(filepath.Clean(dest), data, 0o600)
+		}
+		if err != nil {
+			logger.Errorf("Module location cache error: %s", err)
+		}
+	} else {
+		if !errors.Is(err, upstream.ErrOffline) {
+			logger.Errorf("[Downloading] %s", err)
+		}
+		data, errRead := os.ReadFile(filepath.Clean(dest))
+		if errRead != nil || json.Unmarshal(data, &module) != nil || module.Location == "" {
+			if errors.Is(err, upstream.ErrOffline) {
+				return offlineMiss(c, offlineMissingIndex)
+			}
+			c.Response().Header().Add("X-Cache-Status", "ERROR")
+			return c.String(http.StatusBadGateway, "Please check logs...")
+		}
+		cacheStatus = "STALE"
+	}
+	c.Response().Header().Add("X-Cache-Status", cacheStatus)
+	c.Response().Header().Set("X-Terraform-Get", module.Location)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// terraformModuleLocation asks upstream where the source of a module version
+// is. It is returned in the X-Terraform-Get header, or in the JSON body by
+// newer registries, and may be relative to downloadURL.
+func terraformModuleLocation(client *upstream.Client, downloadURL string) (string, error) {
+	if upstream.Offline() {
+		return "", upstream.ErrOffline
+	}
+	req, err := http.NewRequest(http.MethodGet, downloadURL, http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "hub")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return "", fmt.Errorf("%s returned %s", downloadURL, resp.Status)
+	}
+	location := resp.Header.Get("X-Terraform-Get")
+	if location == "" {
+		var body struct {
+			Location string `json:"location"`
+		}
+		if err = json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&body); err != nil {
+			return "", fmt.Errorf("%s: %v", downloadURL, err)
+		}
+		location = body.Location
+	}
+	if location == "" {
+		return "", fmt.Errorf("%s returned no module location", downloadURL)
+	}
+	if strings.HasPrefix(location, "/") || strings.HasPrefix(location, "./") || strings.HasPrefix(location, "../") {
+		base, err := url.Parse(downloadURL)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(location)
+		if err != nil {
+			return "", err
+		}
+		location = base.ResolveReference(ref).String()
+	}
+	return location, nil
+}
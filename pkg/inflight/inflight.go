@@ -0,0 +1,53 @@
+package inflight
+
+import (
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+type call struct {
+	done  chan struct{}
+	value any
+}
+
+// Group makes sure only one call per key runs at a time. Callers that
+// arrive while a call is running wait for it and get the same result
+// instead of hitting upstream again.
+type Group struct {
+	coalesced *metrics.Counter
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// New returns a Group counting the calls it coalesced in coalesced, which
+// may be nil.
+func New(coalesced *metrics.Counter) *Group {
+	return &Group{coalesced: coalesced, calls: map[string]*call{}}
+}
+
+func (g *Group) Do(key string, fn func() any) (value any, shared bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		if g.coalesced != nil {
+			g.coalesced.Inc()
+		}
+		<-c.done
+		return c.value, true
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.value = fn()
+	return c.value, false
+}
@@ -32,7 +32,9 @@ func Build(verbose bool) *zap.Logger {
 		cfg.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
 	}
 
-	logger, err := cfg.Build()
+	logger, err := cfg.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &redactCore{Core: core}
+	}))
 	if err != nil {
 		log.Fatalf("Can't build logger: %s", err.Error())
 	}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"strings"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+	redactor  = strings.NewReplacer()
+)
+
+// AddSecrets registers credentials that must never appear in log output.
+func AddSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, v := range values {
+		if len(v) >= 4 {
+			secrets = append(secrets, v)
+		}
+	}
+	pairs := make([]string, 0, len(secrets)*2)
+	for _, s := range secrets {
+		pairs = append(pairs, s, "***")
+	}
+	redactor = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces every registered secret in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	return redactor.Replace(s)
+}
+
+// redactCore strips registered secrets from messages and string fields
+// before they reach the underlying core.
+type redactCore struct {
+	zapcore.Core
+}
+
+func (r *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: r.Core.With(redactFields(fields))}
+}
+
+func (r *redactCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if r.Enabled(entry.Level) {
+		return checked.AddCore(entry, r)
+	}
+	return checked
+}
+
+func (r *redactCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = Redact(entry.Message)
+	return r.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	for i := range fields {
+		if fields[i].Type == zapcore.StringType {
+			fields[i].String = Redact(fields[i].String)
+		}
+	}
+	return fields
+}
@@ -2,48 +2,259 @@ package misc
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"math/big"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/psvmcc/hub/pkg/types"
+	"github.com/psvmcc/hub/pkg/upstream"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	transfersMu sync.Mutex
+	transfers   = map[string]*Transfer{}
+
+	coalescedDownloads = metrics.NewCounter("hub_download_coalesced_total")
 )
 
-func DownloadFile(url, destination string, headers types.RequestHeaders) (code int, err error) {
-	client := &http.Client{}
+// Transfer is a download of an upstream file into the cache. The body is
+// written to a temporary file which readers can follow while it grows; the
+// destination is only replaced once the whole body arrived and matched the
+// expected checksum.
+type Transfer struct {
+	client      *upstream.Client
+	url         string
+	destination string
+	headers     types.RequestHeaders
+	checksum    *Checksum
+	// etag and lastModified are the validators of the cached copy when the
+	// transfer is a revalidation.
+	etag         string
+	lastModified string
+
+	ready chan struct{}
+	done  chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	tempPath string
+	written  int64
+	size     int64
+	finished bool
+	code     int
+	err      error
+
+	newETag         string
+	newLastModified string
+	notModified     bool
+}
+
+// DownloadFile fetches url into destination. Concurrent calls for the same
+// destination share a single upstream request.
+func DownloadFile(client *upstream.Client, url, destination string, headers types.RequestHeaders) (code int, err error) {
+	return StartDownload(client, url, destination, headers, nil).Wait()
+}
+
+// StartDownload begins fetching url into destination in the background, or
+// joins the download already running for destination. When checksum is set
+// the file is only committed if its digest matches.
+func StartDownload(client *upstream.Client, url, destination string, headers types.RequestHeaders, checksum *Checksum) *Transfer {
+	return startTransfer(&Transfer{client: client, url: url, destination: destination, headers: headers, checksum: checksum})
+}
+
+// startTransfer runs n, or returns the transfer already running for its
+// destination when that one answers n too. Otherwise n starts once the
+// running transfer is finished, so that a destination is only ever written
+// by one transfer at a time.
+func startTransfer(n *Transfer) *Transfer {
+	n.destination = filepath.Clean(n.destination)
+	for {
+		transfersMu.Lock()
+		t, ok := transfers[n.destination]
+		if !ok {
+			n.ready = make(chan struct{})
+			n.done = make(chan struct{})
+			n.size = -1
+			n.cond = sync.NewCond(&n.mu)
+			transfers[n.destination] = n
+			transfersMu.Unlock()
+			go n.run()
+			return n
+		}
+		transfersMu.Unlock()
+		if t.answers(n) {
+			coalescedDownloads.Inc()
+			return t
+		}
+		<-t.done
+	}
+}
+
+// conditional reports whether t revalidates a cached copy.
+func (t *Transfer) conditional() bool {
+	return t.etag != "" || t.lastModified != ""
+}
+
+// answers reports whether the result of t is valid for n. A full download
+// answers any request, while a revalidation may leave the cached copy in
+// place, which only answers a revalidation made with the same validators.
+func (t *Transfer) answers(n *Transfer) bool {
+	if !t.conditional() {
+		return true
+	}
+	return n.etag == t.etag && n.lastModified == t.lastModified
+}
+
+// Wait blocks until the transfer is finished.
+func (t *Transfer) Wait() (code int, err error) {
+	<-t.done
+	return t.code, t.err
+}
+
+// Open waits for the upstream response and returns a reader that follows the
+// file as it is downloaded, along with its size (-1 when upstream did not
+// announce it). The last byte is held back until the
+// transfer has been verified, so a failed transfer never looks complete to
+// the client.
+func (t *Transfer) Open() (reader io.ReadCloser, size int64, code int, err error) {
+	<-t.ready
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.finished && t.err != nil {
+		return nil, -1, t.code, t.err
+	}
+	name := t.tempPath
+	if t.finished {
+		name = t.destination
+	}
+	file, err := os.Open(filepath.Clean(name))
+	if err != nil {
+		return nil, -1, http.StatusInternalServerError, fmt.Errorf("failed to open download: %v", err)
+	}
+	return &transferReader{transfer: t, file: file}, t.size, http.StatusOK, nil
+}
+
+// forget removes t from the running transfers, so that later requests for
+// its destination start a new one.
+func (t *Transfer) forget() {
+	transfersMu.Lock()
+	if transfers[t.destination] == t {
+		delete(transfers, t.destination)
+	}
+	transfersMu.Unlock()
+}
+
+func (t *Transfer) run() {
+	defer func() {
+		t.forget()
+		close(t.done)
+	}()
+
+	code, err := t.fetch()
+
+	// The temporary file is committed or removed in the same critical
+	// section that publishes the result, so that a reader joining meanwhile
+	// never opens a file that is gone.
+	t.mu.Lock()
+	if t.tempPath != "" {
+		if err == nil {
+			if errRename := os.Rename(t.tempPath, t.destination); errRename != nil {
+				err = fmt.Errorf("failed to rename temporary file to destination: %v", errRename)
+				code = http.StatusInternalServerError
+			}
+		}
+		if err != nil {
+			_ = os.Remove(t.tempPath)
+		}
+	}
+	// Callers retrying a failed transfer right away, like after a refused
+	// registry token, must not join it again.
+	if err != nil {
+		t.forget()
+	}
+	t.code = code
+	t.err = err
+	t.finished = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+
+	select {
+	case <-t.ready:
+	default:
+		close(t.ready)
+	}
+}
 
+func (t *Transfer) fetch() (code int, err error) {
 	var req *http.Request
 	var response *http.Response
 
-	req, err = http.NewRequest("GET", url, http.NoBody)
+	req, err = http.NewRequest("GET", t.url, http.NoBody)
 	if err != nil {
 		code = http.StatusBadRequest
 		return code, err
 	}
 	req.Header.Set("User-Agent", "hub")
 
-	for k, v := range headers {
+	for k, v := range t.headers {
 		req.Header.Set(k, v)
 	}
+	if t.etag != "" {
+		req.Header.Set("If-None-Match", t.etag)
+	}
+	if t.lastModified != "" {
+		req.Header.Set("If-Modified-Since", t.lastModified)
+	}
 
-	response, err = client.Do(req)
+	response, err = t.client.Do(req)
+	if errors.Is(err, upstream.ErrOffline) {
+		code = http.StatusGatewayTimeout
+		return code, err
+	}
 	if err != nil {
 		code = http.StatusBadGateway
 		return code, err
 	}
 	defer response.Body.Close()
 
+	t.mu.Lock()
+	t.newETag = response.Header.Get("ETag")
+	t.newLastModified = response.Header.Get("Last-Modified")
+	if response.StatusCode == http.StatusNotModified && t.conditional() {
+		t.notModified = true
+	}
+	t.mu.Unlock()
+	if t.notModified {
+		code = response.StatusCode
+		return code, nil
+	}
+
 	if response.StatusCode != http.StatusOK {
 		err = fmt.Errorf("upstream returned %s", response.Status)
 		code = response.StatusCode
 		return code, err
 	}
 
-	if err = os.MkdirAll(filepath.Dir(destination), 0o750); err != nil {
+	var hasher hash.Hash
+	if t.checksum != nil && t.checksum.Verify == nil {
+		if hasher, err = t.checksum.newHash(); err != nil {
+			code = http.StatusInternalServerError
+			return code, err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(t.destination), 0o750); err != nil {
 		err = fmt.Errorf("failed to create destination directory: %v", err)
 		code = http.StatusConflict
 		return code, err
@@ -55,23 +266,47 @@ func DownloadFile(url, destination string, headers types.RequestHeaders) (code i
 		return code, err
 	}
 
-	tempFileName := fmt.Sprintf(".tmp.%s.%d.%d", filepath.Base(filepath.Clean(destination)), time.Now().UnixNano(), n.Int64())
-	tempFilePath := fmt.Sprintf("%s/%s", filepath.Dir(filepath.Clean(destination)), tempFileName)
-	tempFile, err := os.Create(filepath.Join(filepath.Dir(destination), filepath.Clean(tempFileName)))
+	tempFileName := fmt.Sprintf(".tmp.%s.%d.%d", filepath.Base(t.destination), time.Now().UnixNano(), n.Int64())
+	tempFilePath := filepath.Join(filepath.Dir(t.destination), tempFileName)
+	tempFile, err := os.Create(filepath.Clean(tempFilePath))
 	if err != nil {
 		err = fmt.Errorf("failed to create temporary file: %v", err)
 		code = http.StatusInternalServerError
 		return code, err
 	}
-	defer os.Remove(tempFile.Name())
+	defer func() {
+		_ = tempFile.Close()
+	}()
 
-	_, err = io.Copy(tempFile, response.Body)
-	if err != nil {
+	t.mu.Lock()
+	t.tempPath = tempFilePath
+	t.size = response.ContentLength
+	t.mu.Unlock()
+	close(t.ready)
+
+	if err = t.copyBody(tempFile, response.Body, hasher); err != nil {
 		err = fmt.Errorf("failed to copy response body to file: %v", err)
 		code = http.StatusBadRequest
 		return code, err
 	}
 
+	if t.size >= 0 && t.written != t.size {
+		err = fmt.Errorf("short body: expected %d bytes, got %d", t.size, t.written)
+		code = http.StatusBadGateway
+		return code, err
+	}
+	if t.checksum != nil {
+		if t.checksum.Verify != nil {
+			err = t.checksum.Verify(tempFilePath)
+		} else {
+			err = t.checksum.verify(hasher)
+		}
+		if err != nil {
+			code = http.StatusBadGateway
+			return code, err
+		}
+	}
+
 	if lastModifiedHeader := response.Header.Get("Last-Modified"); lastModifiedHeader != "" {
 		var lastModifiedTime time.Time
 		if lastModifiedTime, err = time.Parse(http.TimeFormat, lastModifiedHeader); err == nil {
@@ -96,12 +331,72 @@ func DownloadFile(url, destination string, headers types.RequestHeaders) (code i
 		return code, err
 	}
 
-	if err := os.Rename(tempFile.Name(), destination); err != nil {
-		err = fmt.Errorf("failed to rename temporary file to destination: %v", err)
-		code = http.StatusInternalServerError
-		return code, err
-	}
-
 	code = http.StatusOK
 	return code, nil
 }
+
+func (t *Transfer) copyBody(dst *os.File, src io.Reader, hasher hash.Hash) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			if hasher != nil {
+				hasher.Write(buf[:n])
+			}
+			t.mu.Lock()
+			t.written += int64(n)
+			t.cond.Broadcast()
+			t.mu.Unlock()
+		}
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+type transferReader struct {
+	transfer *Transfer
+	file     *os.File
+	offset   int64
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+	t := r.transfer
+
+	t.mu.Lock()
+	for !t.finished && r.offset >= t.written-1 {
+		t.cond.Wait()
+	}
+	available := t.written
+	if !t.finished {
+		available--
+	}
+	finished, err := t.finished, t.err
+	t.mu.Unlock()
+
+	if finished && err != nil {
+		return 0, err
+	}
+	if r.offset >= available {
+		return 0, io.EOF
+	}
+	if remaining := available - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if errors.Is(err, io.EOF) && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *transferReader) Close() error {
+	return r.file.Close()
+}
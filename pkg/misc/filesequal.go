@@ -5,9 +5,11 @@ import (
 	"net/http"
 	"os"
 	"time"
+
+	"github.com/psvmcc/hub/pkg/upstream"
 )
 
-func FilesEqual(url, destination string) (bool, error) {
+func FilesEqual(client *upstream.Client, url, destination string) (bool, error) {
 	localFileInfo, err := os.Stat(destination)
 	if os.IsNotExist(err) {
 		return false, nil
@@ -15,12 +17,6 @@ func FilesEqual(url, destination string) (bool, error) {
 		return false, err
 	}
 
-	client := &http.Client{
-		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
-			return nil
-		},
-	}
-
 	response, err := client.Head(url)
 	if err != nil {
 		return false, err
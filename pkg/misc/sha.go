@@ -1,14 +1,72 @@
 package misc
 
 import (
+	"crypto/md5"  // #nosec G501 -- md5 is only used to match upstream published checksums
+	"crypto/sha1" // #nosec G505 -- sha1 is only used to match upstream published checksums
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// Checksum is a digest published by an upstream that a downloaded file must
+// match before it is committed to the cache.
+type Checksum struct {
+	Algorithm string
+	Value     string
+	// Verify, when set, checks the complete file instead of its digest, for
+	// formats whose checksums only cover parts of the file.
+	Verify func(path string) error
+}
+
+func (c *Checksum) newHash() (hash.Hash, error) {
+	switch strings.ToLower(c.Algorithm) {
+	case "md5":
+		return md5.New(), nil // #nosec G401
+	case "sha1":
+		return sha1.New(), nil // #nosec G401
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", c.Algorithm)
+	}
+}
+
+func (c *Checksum) verify(h hash.Hash) error {
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, c.Value) {
+		return fmt.Errorf("%s mismatch: expected %s, got %s", c.Algorithm, c.Value, actual)
+	}
+	return nil
+}
+
+// VerifyFile checks the digest of the file at path.
+func (c *Checksum) VerifyFile(path string) error {
+	if c.Verify != nil {
+		return c.Verify(path)
+	}
+	h, err := c.newHash()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	if _, err = io.Copy(h, file); err != nil {
+		return fmt.Errorf("failed to calculate hash: %v", err)
+	}
+	return c.verify(h)
+}
+
 func CalculateSHA256(filePath string) (string, error) {
 	file, err := os.Open(filepath.Clean(filePath))
 	if err != nil {
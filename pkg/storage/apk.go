@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1" // #nosec G505 -- sha1 is only used to match the checksums of APKINDEX
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+var apkIndexes = newIndexCache()
+
+// APKChecksum returns the checksum the cached APKINDEX.tar.gz next to the
+// package name lists for it, or nil. The checksum covers the control
+// segment of the package, which in turn holds the digest of the data
+// segment, so it is verified with Checksum.Verify.
+func APKChecksum(repoDir, name string) *misc.Checksum {
+	dir := filepath.Join(repoDir, filepath.FromSlash(path.Dir(name)))
+	index := filepath.Join(dir, "APKINDEX.tar.gz")
+	if !exists(index) {
+		return nil
+	}
+	checksum := apkIndexes.lookup(dir, []string{index}, path.Base(name), readAPKIndex)
+	if checksum == nil {
+		return nil
+	}
+	value := checksum.Value
+	checksum.Verify = func(file string) error {
+		return verifyAPK(file, value)
+	}
+	return checksum
+}
+
+// readAPKIndex maps the file name of every package of an APKINDEX.tar.gz to
+// its checksum, "Q1<base64 sha1>" or "Q2<base64 sha256>".
+func readAPKIndex(r io.Reader) (map[string]misc.Checksum, error) {
+	// The signature and the index are separate tar segments that read as a
+	// single archive.
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == "APKINDEX" {
+			return parseAPKIndex(archive)
+		}
+	}
+}
+
+func parseAPKIndex(r io.Reader) (map[string]misc.Checksum, error) {
+	sums := map[string]misc.Checksum{}
+	pkg, version, checksum := "", "", ""
+	add := func() {
+		if pkg != "" && version != "" && checksum != "" {
+			sums[pkg+"-"+version+".apk"] = misc.Checksum{Algorithm: "apk", Value: checksum}
+		}
+		pkg, version, checksum = "", "", ""
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ":")
+		switch field {
+		case "":
+			add()
+		case "P":
+			pkg = value
+		case "V":
+			version = value
+		case "C":
+			checksum = value
+		}
+	}
+	add()
+	return sums, scanner.Err()
+}
+
+// countingReader counts the bytes read through it. It implements
+// io.ByteReader so the gzip reader doesn't read ahead of the current
+// member.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// verifyAPK checks a package against its APKINDEX checksum. A package is a
+// signature, a control and a data gzip member. The checksum is the digest
+// of the compressed control member, whose .PKGINFO lists the SHA256 of the
+// compressed data member as datahash.
+func verifyAPK(file, checksum string) error {
+	var control hash.Hash
+	switch {
+	case strings.HasPrefix(checksum, "Q1"):
+		control = sha1.New() // #nosec G401
+	case strings.HasPrefix(checksum, "Q2"):
+		control = sha256.New()
+	default:
+		return fmt.Errorf("unsupported apk checksum %q", checksum)
+	}
+	expected, err := base64.StdEncoding.DecodeString(checksum[2:])
+	if err != nil {
+		return fmt.Errorf("invalid apk checksum %q", checksum)
+	}
+
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Find the boundaries of the control member and its datahash.
+	counter := &countingReader{r: bufio.NewReader(f)}
+	start := counter.n
+	first, dataHash, err := apkMember(counter)
+	if err == nil && strings.HasPrefix(first, ".SIGN.") {
+		start = counter.n
+		_, dataHash, err = apkMember(counter)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid apk: %v", err)
+	}
+	end := counter.n
+
+	if _, err = f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = io.CopyN(control, f, end-start); err != nil {
+		return err
+	}
+	if actual := control.Sum(nil); string(actual) != string(expected) {
+		return fmt.Errorf("apk control checksum mismatch: expected %s, got %s", checksum, checksum[:2]+base64.StdEncoding.EncodeToString(actual))
+	}
+	if dataHash == "" {
+		return errors.New("apk has no datahash")
+	}
+	data := sha256.New()
+	if _, err = io.Copy(data, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(data.Sum(nil)); actual != dataHash {
+		return fmt.Errorf("apk data sha256 mismatch: expected %s, got %s", dataHash, actual)
+	}
+	return nil
+}
+
+// apkMember reads the next gzip member of a package. It returns the name
+// of its first tar entry and the datahash of its .PKGINFO, if any.
+func apkMember(r *countingReader) (first, dataHash string, err error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", "", err
+	}
+	zr.Multistream(false)
+	archive := tar.NewReader(zr)
+	for header, errNext := archive.Next(); errNext == nil; header, errNext = archive.Next() {
+		if first == "" {
+			first = header.Name
+		}
+		if header.Name != ".PKGINFO" {
+			continue
+		}
+		info := bufio.NewScanner(archive)
+		for info.Scan() {
+			if value, ok := strings.CutPrefix(info.Text(), "datahash = "); ok {
+				dataHash = value
+			}
+		}
+	}
+	if first == "" {
+		return "", "", errors.New("empty segment")
+	}
+	_, err = io.Copy(io.Discard, zr)
+	return first, dataHash, err
+}
+
+// apkArtifact splits "<name>-<version>-r<release>.apk" into the name and
+// "<version>-r<release>".
+func apkArtifact(name string) (pkg, version string, ok bool) {
+	base, ok := strings.CutSuffix(path.Base(name), ".apk")
+	if !ok {
+		return "", "", false
+	}
+	release := strings.LastIndex(base, "-r")
+	if release <= 0 {
+		return "", "", false
+	}
+	versionStart := strings.LastIndex(base[:release], "-")
+	if versionStart <= 0 {
+		return "", "", false
+	}
+	return base[:versionStart], base[versionStart+1:], true
+}
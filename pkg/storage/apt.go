@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+// AptIndexFile is a Packages index listed in a cached Release file.
+type AptIndexFile struct {
+	// Name is the path relative to the repository directory, like
+	// "dists/bookworm/main/binary-amd64/Packages.gz".
+	Name   string
+	SHA256 string
+	Size   int64
+}
+
+// ByHash returns the path f is published under when the repository
+// supports Acquire-By-Hash.
+func (f AptIndexFile) ByHash() string {
+	return path.Join(path.Dir(f.Name), "by-hash", "SHA256", f.SHA256)
+}
+
+// aptByHashAlgorithms maps the by-hash directory names to checksum
+// algorithms.
+var aptByHashAlgorithms = map[string]string{
+	"MD5Sum": "md5",
+	"SHA1":   "sha1",
+	"SHA256": "sha256",
+	"SHA512": "sha512",
+}
+
+// aptReadable lists the compressions of Packages indexes that can be read
+// to look up checksums.
+var aptReadable = []string{"", ".gz", ".bz2", ".zst"}
+
+var aptIndexes = newIndexCache()
+
+// AptByHashChecksum returns the checksum a by-hash file is named after.
+func AptByHashChecksum(name string) *misc.Checksum {
+	parts := strings.Split(name, "/")
+	n := len(parts)
+	if n < 3 || parts[n-3] != "by-hash" {
+		return nil
+	}
+	algorithm, ok := aptByHashAlgorithms[parts[n-2]]
+	if !ok {
+		return nil
+	}
+	return &misc.Checksum{Algorithm: algorithm, Value: parts[n-1]}
+}
+
+// AptPackagesIndexes lists the Packages indexes of the suites whose Release
+// file is cached in repoDir.
+func AptPackagesIndexes(repoDir string) []AptIndexFile {
+	var indexes []AptIndexFile
+	for _, pattern := range []string{"dists/*", "dists/*/*"} {
+		suites, _ := filepath.Glob(filepath.Join(repoDir, filepath.FromSlash(pattern)))
+		for _, suite := range suites {
+			rel, err := filepath.Rel(repoDir, suite)
+			if err != nil {
+				continue
+			}
+			for _, release := range []string{"InRelease", "Release"} {
+				data, err := os.ReadFile(filepath.Join(suite, release))
+				if err == nil {
+					indexes = append(indexes, parseAptRelease(string(data), filepath.ToSlash(rel))...)
+					break
+				}
+			}
+		}
+	}
+	return indexes
+}
+
+// parseAptRelease returns the Packages indexes listed in the SHA256 field of
+// a Release or InRelease file of suite, "dists/<suite>".
+func parseAptRelease(data, suite string) []AptIndexFile {
+	var indexes []AptIndexFile
+	field := ""
+	for line := range strings.Lines(data) {
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "-----BEGIN PGP SIGNATURE") {
+			break
+		}
+		if !strings.HasPrefix(line, " ") {
+			field, _, _ = strings.Cut(line, ":")
+			continue
+		}
+		fields := strings.Fields(line)
+		if field != "SHA256" || len(fields) != 3 || !strings.HasPrefix(path.Base(fields[2]), "Packages") {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, AptIndexFile{Name: path.Join(suite, fields[2]), SHA256: fields[0], Size: size})
+	}
+	return indexes
+}
+
+// AptChecksum returns the SHA256 of the pool file name found in the readable
+// Packages indexes cached in repoDir, or nil.
+func AptChecksum(repoDir, name string) *misc.Checksum {
+	var files []string
+	for _, f := range AptPackagesIndexes(repoDir) {
+		if !aptIsReadable(f.Name) {
+			continue
+		}
+		for _, rel := range []string{f.ByHash(), f.Name} {
+			file := filepath.Join(repoDir, filepath.FromSlash(rel))
+			if exists(file) {
+				files = append(files, file)
+				break
+			}
+		}
+	}
+	return aptIndexes.lookup(repoDir, files, name, readAptPackages)
+}
+
+// AptMissingIndexes returns, for each Packages index that is cached only in
+// a compression that can't be read, a readable variant listed next to it.
+func AptMissingIndexes(repoDir string) []AptIndexFile {
+	type group struct {
+		cached, readable bool
+		variants         map[string]AptIndexFile
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, f := range AptPackagesIndexes(repoDir) {
+		dir := path.Dir(f.Name)
+		g, ok := groups[dir]
+		if !ok {
+			g = &group{variants: map[string]AptIndexFile{}}
+			groups[dir] = g
+			order = append(order, dir)
+		}
+		g.variants[path.Ext(strings.TrimPrefix(path.Base(f.Name), "Packages"))] = f
+		if exists(filepath.Join(repoDir, filepath.FromSlash(f.ByHash()))) || exists(filepath.Join(repoDir, filepath.FromSlash(f.Name))) {
+			g.cached = true
+			g.readable = g.readable || aptIsReadable(f.Name)
+		}
+	}
+
+	var missing []AptIndexFile
+	for _, dir := range order {
+		g := groups[dir]
+		if !g.cached || g.readable {
+			continue
+		}
+		for _, ext := range []string{".gz", "", ".bz2"} {
+			if f, ok := g.variants[ext]; ok {
+				missing = append(missing, f)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+func aptIsReadable(name string) bool {
+	ext, ok := strings.CutPrefix(path.Base(name), "Packages")
+	return ok && slices.Contains(aptReadable, ext)
+}
+
+// readAptPackages maps the Filename of every stanza of a Packages index to
+// its SHA256.
+func readAptPackages(r io.Reader) (map[string]misc.Checksum, error) {
+	sums := map[string]misc.Checksum{}
+	filename, sha256 := "", ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if filename != "" && sha256 != "" {
+				sums[filename] = misc.Checksum{Algorithm: "sha256", Value: sha256}
+			}
+			filename, sha256 = "", ""
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "Filename:"); ok {
+			filename = strings.TrimSpace(value)
+		} else if value, ok := strings.CutPrefix(line, "SHA256:"); ok {
+			sha256 = strings.TrimSpace(value)
+		}
+	}
+	if filename != "" && sha256 != "" {
+		sums[filename] = misc.Checksum{Algorithm: "sha256", Value: sha256}
+	}
+	return sums, scanner.Err()
+}
+
+// aptArtifact splits a pool file name, "<name>_<version>_<arch>.deb" or
+// "<source>_<version>.dsc" and the like, into the package and its version.
+func aptArtifact(name string) (pkg, version string, ok bool) {
+	if !strings.HasPrefix(name, "pool/") {
+		return "", "", false
+	}
+	parts := strings.Split(path.Base(name), "_")
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	version = parts[1]
+	if len(parts) == 2 {
+		for _, sep := range []string{".orig", ".debian.", ".tar.", ".diff.", ".dsc"} {
+			if i := strings.Index(version, sep); i > 0 {
+				version = version[:i]
+				break
+			}
+		}
+	}
+	return parts[0], version, true
+}
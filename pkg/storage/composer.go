@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+// ComposerDist is the archive of a package version listed in Composer
+// metadata.
+type ComposerDist struct {
+	Type      string `json:"type"`
+	URL       string `json:"url"`
+	Reference string `json:"reference"`
+	Shasum    string `json:"shasum"`
+}
+
+// ComposerPackageDist looks up the dist of pkg ("vendor/package") with the
+// given reference in the cached p2 metadata of its tagged and dev versions.
+// Fields missing from minified metadata are inherited from the previous
+// version, but dist references differ between versions, so entries are
+// matched as they are.
+func ComposerPackageDist(repoDir, pkg, reference string) (ComposerDist, bool) {
+	for _, file := range []string{pkg + ".json", pkg + "~dev.json"} {
+		data, err := os.ReadFile(filepath.Join(repoDir, "p2", filepath.FromSlash(file)))
+		if err != nil {
+			continue
+		}
+		var metadata struct {
+			Packages map[string][]struct {
+				Dist json.RawMessage `json:"dist"`
+			} `json:"packages"`
+		}
+		if json.Unmarshal(data, &metadata) != nil {
+			continue
+		}
+		for _, version := range metadata.Packages[pkg] {
+			// Removed fields are "__unset" strings, which don't decode.
+			var dist ComposerDist
+			if json.Unmarshal(version.Dist, &dist) == nil && dist.Reference == reference && dist.URL != "" {
+				return dist, true
+			}
+		}
+	}
+	return ComposerDist{}, false
+}
+
+// composerArtifact splits "dists/<vendor>/<package>/<reference>.<type>".
+func composerArtifact(name string) (pkg, reference string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "dists" {
+		return "", "", false
+	}
+	return parts[1] + "/" + parts[2], strings.TrimSuffix(parts[3], path.Ext(parts[3])), true
+}
+
+// composerChecksum returns the SHA1 the cached metadata lists for a dist,
+// or nil. Packagist leaves it empty for GitHub archives.
+func composerChecksum(repoDir, name string) *misc.Checksum {
+	pkg, reference, ok := composerArtifact(name)
+	if !ok {
+		return nil
+	}
+	dist, ok := ComposerPackageDist(repoDir, pkg, reference)
+	if !ok || dist.Shasum == "" {
+		return nil
+	}
+	return &misc.Checksum{Algorithm: "sha1", Value: dist.Shasum}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+var condaRepodata = newIndexCache()
+
+// IsCondaPackage reports whether name is a conda package.
+func IsCondaPackage(name string) bool {
+	return strings.HasSuffix(name, ".conda") || strings.HasSuffix(name, ".tar.bz2")
+}
+
+// CondaRepodata returns the cached repodata of the subdir holding the
+// package name, the most recently fetched of repodata.json and
+// repodata.json.zst, or an empty string.
+func CondaRepodata(repoDir, name string) string {
+	dir := filepath.Join(repoDir, filepath.FromSlash(path.Dir(name)))
+	newest, modified := "", int64(0)
+	for _, file := range []string{"repodata.json", "repodata.json.zst"} {
+		if info, err := os.Stat(filepath.Join(dir, file)); err == nil && info.ModTime().UnixNano() > modified {
+			newest, modified = filepath.Join(dir, file), info.ModTime().UnixNano()
+		}
+	}
+	return newest
+}
+
+// CondaChecksum returns the checksum the cached repodata of its subdir lists
+// for the package name, or nil.
+func CondaChecksum(repoDir, name string) *misc.Checksum {
+	repodata := CondaRepodata(repoDir, name)
+	if repodata == "" {
+		return nil
+	}
+	return condaRepodata.lookup(filepath.Dir(repodata), []string{repodata}, path.Base(name), readCondaRepodata)
+}
+
+// readCondaRepodata maps the file name of every package of repodata.json to
+// its SHA256, or MD5 for old packages without one. repodata.json of large
+// channels is hundreds of megabytes, so it is decoded one package at a time.
+func readCondaRepodata(r io.Reader) (map[string]misc.Checksum, error) {
+	sums := map[string]misc.Checksum{}
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("repodata is not an object")
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if field := token.(string); field != "packages" && field != "packages.conda" {
+			var skip json.RawMessage
+			if err = decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if token, err = decoder.Token(); err != nil || token != json.Delim('{') {
+			return nil, errors.New("repodata packages are not an object")
+		}
+		for decoder.More() {
+			token, err = decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			var pkg struct {
+				SHA256 string `json:"sha256"`
+				MD5    string `json:"md5"`
+			}
+			if err = decoder.Decode(&pkg); err != nil {
+				return nil, err
+			}
+			switch {
+			case pkg.SHA256 != "":
+				sums[token.(string)] = misc.Checksum{Algorithm: "sha256", Value: pkg.SHA256}
+			case pkg.MD5 != "":
+				sums[token.(string)] = misc.Checksum{Algorithm: "md5", Value: pkg.MD5}
+			}
+		}
+		if _, err = decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return sums, nil
+}
+
+// condaArtifact splits "<name>-<version>-<build>.conda" into the name and
+// the version.
+func condaArtifact(name string) (pkg, version string, ok bool) {
+	if !IsCondaPackage(name) {
+		return "", "", false
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(path.Base(name), ".conda"), ".tar.bz2")
+	build := strings.LastIndex(base, "-")
+	if build <= 0 {
+		return "", "", false
+	}
+	versionStart := strings.LastIndex(base[:build], "-")
+	if versionStart <= 0 {
+		return "", "", false
+	}
+	return base[:versionStart], base[versionStart+1 : build], true
+}
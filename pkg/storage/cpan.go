@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"path"
+	"strings"
+)
+
+// IsCPANDistribution reports whether rel is a file uploaded by an author,
+// below authors/id. Uploads can't be replaced, unlike the CHECKSUMS file of
+// the author directory.
+func IsCPANDistribution(rel string) bool {
+	return strings.HasPrefix(rel, "authors/id/") && path.Base(rel) != "CHECKSUMS"
+}
+
+// cpanArtifact splits "authors/id/<A>/<AU>/<AUTHOR>/<Dist-Name>-<version>.tar.gz"
+// into the distribution name and the version.
+func cpanArtifact(name string) (pkg, version string, ok bool) {
+	if !IsCPANDistribution(name) {
+		return "", "", false
+	}
+	base := path.Base(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar.bz2", ".zip"} {
+		if stem, found := strings.CutSuffix(base, ext); found {
+			i := strings.LastIndex(stem, "-")
+			if i <= 0 || i == len(stem)-1 {
+				return "", "", false
+			}
+			return stem[:i], stem[i+1:], true
+		}
+	}
+	return "", "", false
+}
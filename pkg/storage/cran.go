@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"path"
+	"strings"
+)
+
+// IsCRANPackage reports whether rel is a source or binary package of a CRAN
+// repository, "<name>_<version>.<ext>" below src/contrib (and its Archive)
+// or bin. Their names are versioned, so they never change.
+func IsCRANPackage(rel string) bool {
+	_, _, ok := cranArtifact(rel)
+	return ok
+}
+
+// cranArtifact splits the path of a CRAN package into the name and the
+// version.
+func cranArtifact(name string) (pkg, version string, ok bool) {
+	if !strings.HasPrefix(name, "src/contrib/") && !strings.HasPrefix(name, "bin/") {
+		return "", "", false
+	}
+	base := path.Base(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip"} {
+		if stem, found := strings.CutSuffix(base, ext); found {
+			pkg, version, ok = strings.Cut(stem, "_")
+			return pkg, version, ok && pkg != "" && version != ""
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// GCResult lists what a garbage collection removed, or would remove in a
+// dry run.
+type GCResult struct {
+	Temporary []string
+	Orphans   []string
+	Dirs      []string
+	Bytes     int64
+}
+
+// GC removes temporary files of downloads that were interrupted more than
+// olderThan ago, sidecars whose file is gone and empty directories.
+func GC(dir string, skip []string, olderThan time.Duration, dryRun bool) (GCResult, error) {
+	var result GCResult
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return result, err
+	}
+	skipped := map[string]bool{}
+	for _, s := range skip {
+		if abs, errAbs := filepath.Abs(s); errAbs == nil {
+			skipped[abs] = true
+		}
+	}
+
+	var dirs []string
+	deadline := time.Now().Add(-olderThan)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if skipped[path] {
+				return filepath.SkipDir
+			}
+			if path != root {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		switch {
+		case IsTemporary(path):
+			if info.ModTime().After(deadline) {
+				return nil
+			}
+			result.Temporary = append(result.Temporary, path)
+		case IsSidecar(path):
+			base := path[:len(path)-len(sidecarSuffix)]
+			if exists(base) || exists(base+".json") {
+				return nil
+			}
+			result.Orphans = append(result.Orphans, path)
+		default:
+			return nil
+		}
+		result.Bytes += info.Size()
+		if !dryRun {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// Deepest directories first, so parents emptied by the removal of
+	// their children are removed as well.
+	slices.Reverse(dirs)
+	for _, d := range dirs {
+		entries, errRead := os.ReadDir(d)
+		if errRead != nil || len(entries) > 0 && !(dryRun && allRemoved(d, entries, result)) {
+			continue
+		}
+		result.Dirs = append(result.Dirs, d)
+		if !dryRun {
+			_ = os.Remove(d)
+		}
+	}
+	return result, nil
+}
+
+// allRemoved reports whether every entry of dir is removed by result, which
+// is how a dry run knows a directory would end up empty.
+func allRemoved(dir string, entries []fs.DirEntry, result GCResult) bool {
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		if !slices.Contains(result.Temporary, p) && !slices.Contains(result.Orphans, p) && !slices.Contains(result.Dirs, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
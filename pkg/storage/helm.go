@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/inflight"
+	"github.com/psvmcc/hub/pkg/misc"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HelmChart is a chart version listed in a Helm repository index.yaml.
+type HelmChart struct {
+	Version string   `yaml:"version"`
+	URLs    []string `yaml:"urls"`
+	Digest  string   `yaml:"digest"`
+}
+
+type helmIndex struct {
+	modified time.Time
+	size     int64
+	entries  map[string][]HelmChart
+}
+
+// helmIndexes keeps the last parsed index.yaml of each repository, as large
+// ones take seconds to parse. Parsing runs without holding helmIndexesMu;
+// concurrent parses of the same index file are coalesced by helmParses.
+var (
+	helmIndexesMu sync.Mutex
+	helmIndexes   = map[string]helmIndex{}
+	helmParses    = inflight.New(nil)
+)
+
+// HelmChartVersion looks up a chart version in the cached index.yaml file.
+func HelmChartVersion(indexFile, name, version string) (HelmChart, bool) {
+	info, err := os.Stat(indexFile)
+	if err != nil {
+		return HelmChart{}, false
+	}
+
+	helmIndexesMu.Lock()
+	index, ok := helmIndexes[indexFile]
+	helmIndexesMu.Unlock()
+	if !ok || !index.modified.Equal(info.ModTime()) || index.size != info.Size() {
+		flight := fmt.Sprintf("%s\x00%d\x00%d", indexFile, info.ModTime().UnixNano(), info.Size())
+		value, _ := helmParses.Do(flight, func() any {
+			data, err := os.ReadFile(filepath.Clean(indexFile))
+			if err != nil {
+				return nil
+			}
+			var decoded struct {
+				Entries map[string][]HelmChart `yaml:"entries"`
+			}
+			if err = yaml.Unmarshal(data, &decoded); err != nil {
+				return nil
+			}
+			parsed := helmIndex{modified: info.ModTime(), size: info.Size(), entries: decoded.Entries}
+			helmIndexesMu.Lock()
+			helmIndexes[indexFile] = parsed
+			helmIndexesMu.Unlock()
+			return parsed
+		})
+		if index, ok = value.(helmIndex); !ok {
+			return HelmChart{}, false
+		}
+	}
+	for _, chart := range index.entries[name] {
+		if chart.Version == version {
+			return chart, true
+		}
+	}
+	return HelmChart{}, false
+}
+
+// helmArtifact splits "charts/<name>/<version>/<file>".
+func helmArtifact(name string) (pkg, version string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "charts" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// helmChecksum returns the digest the cached index.yaml of its repository
+// lists for the chart name, or nil.
+func helmChecksum(repoDir, name string) *misc.Checksum {
+	pkg, version, ok := helmArtifact(name)
+	if !ok || path.Ext(name) != ".tgz" {
+		return nil
+	}
+	chart, ok := HelmChartVersion(filepath.Join(repoDir, "index.yaml"), pkg, version)
+	if !ok || chart.Digest == "" {
+		return nil
+	}
+	return &misc.Checksum{Algorithm: "sha256", Value: chart.Digest}
+}
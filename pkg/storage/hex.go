@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+// HexTarball splits "tarballs/<name>-<version>.tar" into the package name
+// and the version. Package names can't hold dashes, versions can.
+func HexTarball(name string) (pkg, version string, ok bool) {
+	file, ok := strings.CutPrefix(name, "tarballs/")
+	if !ok || strings.Contains(file, "/") || path.Ext(file) != ".tar" {
+		return "", "", false
+	}
+	pkg, version, ok = strings.Cut(strings.TrimSuffix(file, ".tar"), "-")
+	if !ok || pkg == "" || version == "" {
+		return "", "", false
+	}
+	return pkg, version, true
+}
+
+// HexChecksum returns the outer checksum, the SHA256 of the whole tarball,
+// that the cached package resource lists for the tarball name, or nil.
+// Releases published before outer checksums were introduced have none.
+func HexChecksum(repoDir, name string) *misc.Checksum {
+	pkg, version, ok := HexTarball(name)
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(repoDir, "packages", filepath.Base(pkg)))
+	if err != nil {
+		return nil
+	}
+	sum, err := hexOuterChecksum(data, version)
+	if err != nil || sum == nil {
+		return nil
+	}
+	return &misc.Checksum{Algorithm: "sha256", Value: hex.EncodeToString(sum)}
+}
+
+// hexOuterChecksum finds version in a package resource: a gzipped Signed
+// message whose payload is a Package message.
+func hexOuterChecksum(data []byte, version string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	signed, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	if err = protoFields(signed, func(field uint64, value []byte) error {
+		if field == 1 {
+			payload = value
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var sum []byte
+	err = protoFields(payload, func(field uint64, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var releaseVersion string
+		var outer []byte
+		if errRelease := protoFields(value, func(field uint64, value []byte) error {
+			switch field {
+			case 1:
+				releaseVersion = string(value)
+			case 5:
+				outer = value
+			}
+			return nil
+		}); errRelease != nil {
+			return errRelease
+		}
+		if releaseVersion == version {
+			sum = outer
+		}
+		return nil
+	})
+	return sum, err
+}
+
+// protoFields calls fn with the number and the value of every
+// length-delimited field of the protobuf message data. Fields of other wire
+// types are skipped.
+func protoFields(data []byte, fn func(field uint64, value []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid protobuf tag")
+		}
+		data = data[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			data = data[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return errors.New("truncated protobuf field")
+			}
+			data = data[size:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errors.New("truncated protobuf field")
+			}
+			if err := fn(tag>>3, data[n:n+int(size)]); err != nil {
+				return err
+			}
+			data = data[n+int(size):]
+		default:
+			return errors.New("unsupported protobuf wire type")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The helpers below encode messages of the Hex registry schema
+// (hex_core package.proto and signed.proto).
+
+func protoTag(field, wireType uint64) []byte {
+	return binary.AppendUvarint(nil, field<<3|wireType)
+}
+
+func protoBytes(field uint64, value []byte) []byte {
+	b := protoTag(field, 2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func protoVarint(field, value uint64) []byte {
+	return binary.AppendUvarint(protoTag(field, 0), value)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hexRelease encodes a Release: version, inner_checksum, a dependency and,
+// when set, outer_checksum.
+func hexRelease(version string, outer []byte) []byte {
+	dependency := concat(
+		protoBytes(1, []byte("decimal")),
+		protoBytes(2, []byte("~> 1.0 or ~> 2.0")),
+		protoVarint(3, 1),
+		protoBytes(4, []byte("decimal")),
+	)
+	release := concat(
+		protoBytes(1, []byte(version)),
+		protoBytes(2, bytes.Repeat([]byte{0x11}, 32)),
+		protoBytes(3, dependency),
+	)
+	if outer != nil {
+		release = append(release, protoBytes(5, outer)...)
+	}
+	return release
+}
+
+// hexResource encodes a package resource: a gzipped Signed message holding
+// a Package.
+func hexResource(t *testing.T, releases ...[]byte) []byte {
+	t.Helper()
+	var pkg []byte
+	for _, r := range releases {
+		pkg = append(pkg, protoBytes(1, r)...)
+	}
+	pkg = concat(pkg, protoBytes(2, []byte("jason")), protoBytes(3, []byte("hexpm")))
+	return gzipped(t, concat(protoBytes(1, pkg), protoBytes(2, bytes.Repeat([]byte{0x5a}, 256))))
+}
+
+func TestHexOuterChecksum(t *testing.T) {
+	outer := bytes.Repeat([]byte{0xab}, 32)
+	retired := concat(
+		protoBytes(1, []byte("1.3.0")),
+		protoBytes(2, bytes.Repeat([]byte{0x22}, 32)),
+		protoBytes(4, concat(protoVarint(1, 1), protoBytes(2, []byte("security issue")))),
+		protoBytes(5, bytes.Repeat([]byte{0xcd}, 32)),
+	)
+	resource := hexResource(t,
+		hexRelease("1.0.0", nil),
+		hexRelease("1.1.0-rc.1", bytes.Repeat([]byte{0x01}, 32)),
+		hexRelease("1.2.0", outer),
+		retired,
+	)
+
+	// Fields and wire types the decoder doesn't know must be skipped.
+	fixed64 := concat(protoTag(10, 1), bytes.Repeat([]byte{0xff}, 8))
+	fixed32 := concat(protoTag(11, 5), bytes.Repeat([]byte{0xff}, 4))
+	unknownRelease := concat(
+		protoVarint(9, 300),
+		protoBytes(1, []byte("2.0.0")),
+		fixed64,
+		protoBytes(12, []byte("future field")),
+		protoBytes(5, outer),
+		fixed32,
+	)
+	unknownPackage := concat(
+		protoVarint(7, 1),
+		protoBytes(1, unknownRelease),
+		protoBytes(8, []byte("unknown")),
+		protoBytes(2, []byte("jason")),
+	)
+	unknown := gzipped(t, concat(protoVarint(3, 42), protoBytes(1, unknownPackage), protoBytes(2, []byte("sig"))))
+
+	plain := concat(protoBytes(1, protoBytes(1, hexRelease("1.2.0", outer))), protoBytes(2, []byte("sig")))
+	truncatedField := plain[:len(plain)-10]
+
+	tests := []struct {
+		name    string
+		data    []byte
+		version string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "release with outer checksum", data: resource, version: "1.2.0", want: outer},
+		{name: "prerelease", data: resource, version: "1.1.0-rc.1", want: bytes.Repeat([]byte{0x01}, 32)},
+		{name: "retired release", data: resource, version: "1.3.0", want: bytes.Repeat([]byte{0xcd}, 32)},
+		{name: "release without outer checksum", data: resource, version: "1.0.0"},
+		{name: "unlisted version", data: resource, version: "9.9.9"},
+		{name: "version prefix", data: resource, version: "1.2"},
+		{name: "unknown fields", data: unknown, version: "2.0.0", want: outer},
+		{name: "empty package", data: gzipped(t, nil), version: "1.0.0"},
+		{name: "not gzipped", data: plain, version: "1.2.0", wantErr: true},
+		{name: "truncated gzip", data: resource[:len(resource)/2], version: "1.2.0", wantErr: true},
+		{name: "truncated field", data: gzipped(t, truncatedField), version: "1.2.0", wantErr: true},
+		{name: "truncated varint", data: gzipped(t, concat(protoBytes(2, []byte("sig")), []byte{0x08, 0x80})), version: "1.2.0", wantErr: true},
+		{name: "truncated tag", data: gzipped(t, []byte{0x80}), version: "1.2.0", wantErr: true},
+		{name: "truncated fixed64", data: gzipped(t, concat(protoTag(4, 1), []byte{1, 2, 3})), version: "1.2.0", wantErr: true},
+		{name: "oversized length", data: gzipped(t, concat(protoTag(1, 2), binary.AppendUvarint(nil, 1<<62), []byte("x"))), version: "1.2.0", wantErr: true},
+		{name: "group wire type", data: gzipped(t, protoTag(1, 3)), version: "1.2.0", wantErr: true},
+		{name: "invalid release", data: gzipped(t, protoBytes(1, protoBytes(1, []byte{0x0a, 0x05, '1'}))), version: "1.2.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hexOuterChecksum(tt.data, tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("checksum = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHexChecksum(t *testing.T) {
+	outer := bytes.Repeat([]byte{0xab}, 32)
+	repoDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repoDir, "packages"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	resource := hexResource(t, hexRelease("1.0.0", nil), hexRelease("1.2.0", outer))
+	if err := os.WriteFile(filepath.Join(repoDir, "packages", "jason"), resource, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{name: "listed", file: "tarballs/jason-1.2.0.tar", want: hex.EncodeToString(outer)},
+		{name: "no outer checksum", file: "tarballs/jason-1.0.0.tar"},
+		{name: "unlisted", file: "tarballs/jason-2.0.0.tar"},
+		{name: "uncached package", file: "tarballs/poison-1.0.0.tar"},
+		{name: "not a tarball", file: "packages/jason"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum := HexChecksum(repoDir, tt.file)
+			if tt.want == "" {
+				if sum != nil {
+					t.Errorf("checksum = %+v, want none", sum)
+				}
+				return
+			}
+			if sum == nil || sum.Algorithm != "sha256" || sum.Value != tt.want {
+				t.Errorf("checksum = %+v, want sha256 %s", sum, tt.want)
+			}
+		})
+	}
+}
+
+func TestHexTarball(t *testing.T) {
+	tests := []struct {
+		name, pkg, version string
+		ok                 bool
+	}{
+		{name: "tarballs/jason-1.2.0.tar", pkg: "jason", version: "1.2.0", ok: true},
+		{name: "tarballs/jason-1.1.0-rc.1.tar", pkg: "jason", version: "1.1.0-rc.1", ok: true},
+		{name: "tarballs/jason.tar"},
+		{name: "tarballs/-1.0.0.tar"},
+		{name: "tarballs/jason-1.0.0.tgz"},
+		{name: "tarballs/a/jason-1.0.0.tar"},
+		{name: "packages/jason"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.ReplaceAll(tt.name, "/", "_"), func(t *testing.T) {
+			pkg, version, ok := HexTarball(tt.name)
+			if pkg != tt.pkg || version != tt.version || ok != tt.ok {
+				t.Errorf("HexTarball(%q) = %q, %q, %v, want %q, %q, %v", tt.name, pkg, version, ok, tt.pkg, tt.version, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/inflight"
+	"github.com/psvmcc/hub/pkg/misc"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// indexCache keeps the checksums read from large index files, like APT
+// Packages indexes and RPM primary.xml, keyed by path. An index is read
+// again when its size or modification time changes. Indexes are read
+// without holding mu; concurrent reads of the same index are coalesced.
+type indexCache struct {
+	mu      sync.Mutex
+	indexes map[string]cachedIndex
+	reads   *inflight.Group
+}
+
+type cachedIndex struct {
+	modified time.Time
+	size     int64
+	sums     map[string]misc.Checksum
+}
+
+func newIndexCache() *indexCache {
+	return &indexCache{indexes: map[string]cachedIndex{}, reads: inflight.New(nil)}
+}
+
+// lookup returns the checksum of name in the first of files listing it.
+// Indexes below dir that are not in files, such as those of superseded
+// releases, are dropped.
+func (ic *indexCache) lookup(dir string, files []string, name string, read func(r io.Reader) (map[string]misc.Checksum, error)) *misc.Checksum {
+	ic.mu.Lock()
+	for file := range ic.indexes {
+		if strings.HasPrefix(file, dir+string(filepath.Separator)) && !slices.Contains(files, file) {
+			delete(ic.indexes, file)
+		}
+	}
+	ic.mu.Unlock()
+	for _, file := range files {
+		if sum, ok := ic.sums(file, read)[name]; ok {
+			return &sum
+		}
+	}
+	return nil
+}
+
+// sums returns the checksums of file, reading it when needed.
+func (ic *indexCache) sums(file string, read func(r io.Reader) (map[string]misc.Checksum, error)) map[string]misc.Checksum {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+	ic.mu.Lock()
+	index, ok := ic.indexes[file]
+	ic.mu.Unlock()
+	if ok && index.modified.Equal(info.ModTime()) && index.size == info.Size() {
+		return index.sums
+	}
+
+	flight := fmt.Sprintf("%s\x00%d\x00%d", file, info.ModTime().UnixNano(), info.Size())
+	value, _ := ic.reads.Do(flight, func() any {
+		f, err := openIndex(file)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		sums, err := read(f)
+		if err != nil {
+			return nil
+		}
+		ic.mu.Lock()
+		ic.indexes[file] = cachedIndex{modified: info.ModTime(), size: info.Size(), sums: sums}
+		ic.mu.Unlock()
+		return sums
+	})
+	sums, _ := value.(map[string]misc.Checksum)
+	return sums
+}
+
+// errXZ is returned for xz compressed indexes, which can't be read.
+var errXZ = errors.New("xz compression is not supported")
+
+// openIndex opens an index file, decompressing it. The compression is told
+// from the content, as indexes stored by hash have no extension.
+func openIndex(file string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 6)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return readCloser{gz, func() { _ = gz.Close(); _ = f.Close() }}, nil
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return readCloser{bzip2.NewReader(f), func() { _ = f.Close() }}, nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return readCloser{zr, func() { zr.Close(); _ = f.Close() }}, nil
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		_ = f.Close()
+		return nil, errXZ
+	default:
+		return f, nil
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	close func()
+}
+
+func (r readCloser) Close() error {
+	r.close()
+	return nil
+}
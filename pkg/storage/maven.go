@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"encoding/hex"
+	"path"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+// mavenChecksumSizes maps the checksum files published next to Maven
+// artifacts to the digest size of their algorithm.
+var mavenChecksumSizes = map[string]int{
+	"md5":    16,
+	"sha1":   20,
+	"sha256": 32,
+	"sha512": 64,
+}
+
+// MavenMutable reports whether a Maven repository file can change upstream:
+// maven-metadata.xml and files of non-unique SNAPSHOT versions, along with
+// their checksums. Releases and timestamped snapshots never change.
+func MavenMutable(name string) bool {
+	dir, file := path.Split(name)
+	if strings.HasPrefix(file, "maven-metadata") {
+		return true
+	}
+	return strings.HasSuffix(strings.TrimSuffix(dir, "/"), "-SNAPSHOT") && strings.Contains(file, "-SNAPSHOT")
+}
+
+// IsMavenChecksum reports whether name is a checksum or signature file.
+func IsMavenChecksum(name string) bool {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	_, ok := mavenChecksumSizes[ext]
+	return ok || ext == "asc"
+}
+
+// ParseMavenChecksum reads a Maven checksum file. It holds the hex digest,
+// sometimes followed or preceded by the file name.
+func ParseMavenChecksum(algorithm string, data []byte) *misc.Checksum {
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil
+	}
+	for _, field := range []string{fields[0], fields[len(fields)-1]} {
+		value := strings.ToLower(field)
+		if sum, err := hex.DecodeString(value); err == nil && len(sum) == mavenChecksumSizes[algorithm] {
+			return &misc.Checksum{Algorithm: algorithm, Value: value}
+		}
+	}
+	return nil
+}
+
+// mavenArtifact splits "<group path>/<artifact>/<version>/<file>" into the
+// "<group>:<artifact>" coordinates and the version.
+func mavenArtifact(name string) (pkg, version string, ok bool) {
+	parts := strings.Split(name, "/")
+	n := len(parts)
+	if n < 4 || strings.HasPrefix(parts[n-1], "maven-metadata") || !strings.HasPrefix(parts[n-1], parts[n-3]+"-") {
+		return "", "", false
+	}
+	return strings.Join(parts[:n-3], ".") + ":" + parts[n-3], parts[n-2], true
+}
+
+// mavenPackagePath returns the directory of "<group>:<artifact>".
+func mavenPackagePath(pkg string) string {
+	group, artifact, _ := strings.Cut(pkg, ":")
+	return strings.ReplaceAll(group, ".", "/") + "/" + artifact
+}
@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"strings"
+)
+
+// nugetArtifact splits "v3-flatcontainer/<id>/<version>/<id>.<version>.nupkg".
+func nugetArtifact(name string) (pkg, version string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "v3-flatcontainer" || parts[3] != parts[1]+"."+parts[2]+".nupkg" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
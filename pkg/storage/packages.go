@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// artifacts extracts the package name and version from the path of a cached
+// file, relative to its repository directory.
+var artifacts = map[string]func(name string) (pkg, version string, ok bool){
+	"pypi": func(name string) (string, string, bool) {
+		dir, file := path.Split(name)
+		if dir == "" || file == "index.json" {
+			return "", "", false
+		}
+		return strings.TrimSuffix(dir, "/"), PypiVersion(file), true
+	},
+	"npm": func(name string) (string, string, bool) {
+		rest, ok := strings.CutPrefix(name, "tarballs/")
+		if !ok {
+			return "", "", false
+		}
+		pkg, file, found := strings.Cut(rest, "/-/")
+		if !found {
+			return "", "", false
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(file, path.Base(pkg)+"-"), ".tgz")
+		return pkg, version, true
+	},
+	"cargo": func(name string) (string, string, bool) {
+		rest, ok := strings.CutPrefix(name, "crates/")
+		if !ok {
+			return "", "", false
+		}
+		crate, file := path.Split(rest)
+		crate = strings.TrimSuffix(crate, "/")
+		return crate, strings.TrimSuffix(strings.TrimPrefix(file, crate+"-"), ".crate"), crate != ""
+	},
+	"goproxy": func(name string) (string, string, bool) {
+		module, file, found := strings.Cut(name, "/@v/")
+		if !found || file == "list" {
+			return "", "", false
+		}
+		return module, strings.TrimSuffix(file, path.Ext(file)), true
+	},
+	"galaxy": func(name string) (string, string, bool) {
+		rest, ok := strings.CutPrefix(name, "binary/")
+		if !ok {
+			return "", "", false
+		}
+		parts := strings.Split(rest, "/")
+		if len(parts) != 3 {
+			return "", "", false
+		}
+		prefix := parts[0] + "-" + parts[1] + "-"
+		return parts[0] + "." + parts[1], strings.TrimSuffix(strings.TrimPrefix(parts[2], prefix), ".tar.gz"), true
+	},
+	"rubygems": func(name string) (string, string, bool) {
+		file, ok := strings.CutPrefix(name, "gems/")
+		if !ok {
+			return "", "", false
+		}
+		pkg, version := splitNameVersion(strings.TrimSuffix(file, ".gem"))
+		return pkg, version, true
+	},
+	"oci": func(name string) (string, string, bool) {
+		image, reference, _ := ociManifest(name)
+		return image, reference, image != ""
+	},
+	"maven":     mavenArtifact,
+	"apt":       aptArtifact,
+	"rpm":       rpmArtifact,
+	"apk":       apkArtifact,
+	"helm":      helmArtifact,
+	"nuget":     nugetArtifact,
+	"composer":  composerArtifact,
+	"terraform": terraformArtifact,
+	"conda":     condaArtifact,
+	"hex":       HexTarball,
+	"pub":       pubArtifact,
+	"cran":      cranArtifact,
+	"cpan":      cpanArtifact,
+	"static": func(name string) (string, string, bool) {
+		return name, "", true
+	},
+}
+
+// ParseArtifact returns the package and version a cached file belongs to.
+// Files that are not part of a package version, such as indexes, are
+// reported with ok set to false.
+func ParseArtifact(e Entry) (pkg, version string, ok bool) {
+	parse, found := artifacts[e.Ecosystem]
+	if !found || IsSidecar(e.Name) {
+		return "", "", false
+	}
+	return parse(e.Name)
+}
+
+// PackagePaths returns the files and directories holding the metadata and
+// artifacts of pkg, relative to its repository directory.
+func PackagePaths(ecosystem, pkg string) []string {
+	switch ecosystem {
+	case "pypi", "static":
+		return []string{pkg}
+	case "npm":
+		return []string{"metadata/" + pkg, "tarballs/" + pkg}
+	case "cargo":
+		index := "index/" + CargoIndexPath(pkg)
+		return []string{"crates/" + pkg, index, index + sidecarSuffix}
+	case "goproxy":
+		// Nested modules live below the module directory, so only its own
+		// files are listed.
+		return []string{pkg + "/@v", pkg + "/@latest"}
+	case "galaxy":
+		namespace, name, _ := strings.Cut(pkg, ".")
+		return []string{"binary/" + namespace + "/" + name, "index/" + namespace + "/" + name}
+	case "rubygems":
+		return []string{"info/" + pkg}
+	case "maven":
+		return []string{mavenPackagePath(pkg)}
+	case "helm":
+		return []string{"charts/" + pkg}
+	case "nuget":
+		return []string{"v3-flatcontainer/" + strings.ToLower(pkg)}
+	case "composer":
+		tagged, dev := "p2/"+pkg+".json", "p2/"+pkg+"~dev.json"
+		return []string{tagged, tagged + sidecarSuffix, dev, dev + sidecarSuffix, "dists/" + pkg}
+	case "terraform":
+		return []string{"providers/" + pkg, "modules/" + pkg}
+	case "hex":
+		return []string{"packages/" + pkg, "packages/" + pkg + sidecarSuffix}
+	case "pub":
+		metadata, advisories := "api/packages/"+pkg, "advisories/"+pkg
+		return []string{metadata, metadata + sidecarSuffix, advisories, advisories + sidecarSuffix, "packages/" + pkg}
+	case "oci":
+		return []string{"manifests/" + pkg + "/tags", "manifests/" + pkg + "/digests"}
+	default:
+		return nil
+	}
+}
+
+// InPackage reports whether e is an artifact or a metadata file of pkg.
+func InPackage(e Entry, pkg string) bool {
+	if p, _, ok := ParseArtifact(e); ok && p == pkg {
+		return true
+	}
+	for _, rel := range PackagePaths(e.Ecosystem, pkg) {
+		if e.Name == rel || strings.HasPrefix(e.Name, rel+"/") || e.Name == rel+sidecarSuffix {
+			return true
+		}
+	}
+	return false
+}
+
+// ociManifest splits the path of a cached OCI manifest,
+// "manifests/<image>/tags/<tag>" or "manifests/<image>/digests/<alg>/<hex>",
+// into the image and the tag or digest. Blobs have no image.
+func ociManifest(name string) (image, reference string, isTag bool) {
+	rest, ok := strings.CutPrefix(name, "manifests/")
+	if !ok {
+		return "", "", false
+	}
+	if i := strings.LastIndex(rest, "/tags/"); i > 0 && !strings.Contains(rest[i+len("/tags/"):], "/") {
+		return rest[:i], rest[i+len("/tags/"):], true
+	}
+	parts := strings.Split(rest, "/")
+	if n := len(parts); n >= 4 && parts[n-3] == "digests" {
+		return strings.Join(parts[:n-3], "/"), parts[n-2] + ":" + parts[n-1], false
+	}
+	return "", "", false
+}
+
+// CargoIndexPath returns the sparse index path of a crate.
+func CargoIndexPath(crate string) string {
+	crate = strings.ToLower(crate)
+	switch len(crate) {
+	case 0:
+		return ""
+	case 1:
+		return "1/" + crate
+	case 2:
+		return "2/" + crate
+	case 3:
+		return "3/" + crate[:1] + "/" + crate
+	default:
+		return crate[:2] + "/" + crate[2:4] + "/" + crate
+	}
+}
+
+// PypiVersion extracts the version from a wheel or source distribution file
+// name.
+func PypiVersion(file string) string {
+	if strings.HasSuffix(file, ".whl") {
+		if parts := strings.Split(file, "-"); len(parts) >= 2 {
+			return parts[1]
+		}
+		return ""
+	}
+	for _, ext := range []string{".tar.gz", ".tar.bz2", ".tar.xz", ".zip", ".egg", ".tgz"} {
+		if base, ok := strings.CutSuffix(file, ext); ok {
+			if i := strings.LastIndex(base, "-"); i >= 0 {
+				return base[i+1:]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// splitNameVersion splits "name-1.2.3[-platform]" at the first dash that is
+// followed by a digit.
+func splitNameVersion(s string) (name, version string) {
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] == '-' && unicode.IsDigit(rune(s[i+1])) {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+// PurgeTargets returns the files and directories to remove to purge a
+// repository ("<type>/<key>"), one of its packages or a single package
+// version.
+func PurgeTargets(dir string, entries []Entry, repo, pkg, version string) ([]string, error) {
+	ecosystem, key, found := strings.Cut(repo, "/")
+	if !found || !filepath.IsLocal(ecosystem) || !filepath.IsLocal(key) || strings.ContainsRune(key, '/') {
+		return nil, fmt.Errorf("invalid repository %q", repo)
+	}
+	repoDir := filepath.Join(dir, ecosystem, key)
+	if pkg == "" {
+		return []string{repoDir}, nil
+	}
+
+	var targets []string
+	for _, e := range entries {
+		if e.Repository != repo {
+			continue
+		}
+		if p, v, ok := ParseArtifact(e); ok && p == pkg && (version == "" || v == version) {
+			targets = append(targets, e.Path)
+			targets = append(targets, Sidecars(e.Path)...)
+		}
+	}
+	if version == "" {
+		for _, rel := range PackagePaths(ecosystem, pkg) {
+			if !filepath.IsLocal(filepath.FromSlash(rel)) {
+				return nil, fmt.Errorf("invalid package name %q", pkg)
+			}
+			targets = append(targets, filepath.Join(repoDir, filepath.FromSlash(rel)))
+		}
+	}
+	return targets, nil
+}
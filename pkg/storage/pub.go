@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+// PubArchive is a version of a package as listed by the pub repository API.
+type PubArchive struct {
+	Version string `json:"version"`
+	URL     string `json:"archive_url"`
+	SHA256  string `json:"archive_sha256"`
+}
+
+// PubPackageArchive looks version up in the cached metadata of pkg.
+func PubPackageArchive(repoDir, pkg, version string) (PubArchive, bool) {
+	data, err := os.ReadFile(filepath.Join(repoDir, "api", "packages", filepath.Base(pkg)))
+	if err != nil {
+		return PubArchive{}, false
+	}
+	var metadata struct {
+		Versions []PubArchive `json:"versions"`
+	}
+	if json.Unmarshal(data, &metadata) != nil {
+		return PubArchive{}, false
+	}
+	for _, archive := range metadata.Versions {
+		if archive.Version == version && archive.URL != "" {
+			return archive, true
+		}
+	}
+	return PubArchive{}, false
+}
+
+// pubArtifact splits "packages/<name>/versions/<version>.tar.gz" into the
+// name and the version.
+func pubArtifact(name string) (pkg, version string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 4 || parts[0] != "packages" || parts[2] != "versions" || !strings.HasSuffix(parts[3], ".tar.gz") {
+		return "", "", false
+	}
+	return parts[1], strings.TrimSuffix(parts[3], ".tar.gz"), true
+}
+
+// pubChecksum returns the SHA256 the cached metadata lists for an archive,
+// or nil.
+func pubChecksum(repoDir, name string) *misc.Checksum {
+	pkg, version, ok := pubArtifact(name)
+	if !ok {
+		return nil
+	}
+	archive, ok := PubPackageArchive(repoDir, pkg, version)
+	if !ok || archive.SHA256 == "" {
+		return nil
+	}
+	return &misc.Checksum{Algorithm: "sha256", Value: archive.SHA256}
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+// rpmRepomd is the part of repodata/repomd.xml used to find and verify the
+// other metadata files.
+type rpmRepomd struct {
+	Data []struct {
+		Type     string      `xml:"type,attr"`
+		Checksum rpmChecksum `xml:"checksum"`
+		Location struct {
+			Href string `xml:"href,attr"`
+		} `xml:"location"`
+	} `xml:"data"`
+}
+
+type rpmChecksum struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (c rpmChecksum) checksum() misc.Checksum {
+	algorithm := strings.ToLower(c.Type)
+	if algorithm == "sha" {
+		algorithm = "sha1"
+	}
+	return misc.Checksum{Algorithm: algorithm, Value: strings.TrimSpace(c.Value)}
+}
+
+var rpmPrimaries = newIndexCache()
+
+// IsRPMPackage reports whether name is a binary, source or delta RPM.
+func IsRPMPackage(name string) bool {
+	return strings.HasSuffix(name, ".rpm") || strings.HasSuffix(name, ".drpm")
+}
+
+// RPMMutable reports whether a file of an RPM repository can change
+// upstream. Packages and metadata files named after their checksum, like
+// "repodata/<sha256>-primary.xml.zst", never change; repomd.xml and
+// everything else does.
+func RPMMutable(name string) bool {
+	if IsRPMPackage(name) {
+		return false
+	}
+	dir, file := path.Split(name)
+	if path.Base(dir) != "repodata" {
+		return true
+	}
+	prefix, _, found := strings.Cut(file, "-")
+	if _, err := hex.DecodeString(prefix); !found || err != nil || len(prefix) < 32 {
+		return true
+	}
+	return false
+}
+
+// rpmRepository returns the directory, relative to the repository
+// directory, of the nearest RPM repository above name with a cached
+// repomd.xml.
+func rpmRepository(repoDir, name string) (string, bool) {
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if exists(filepath.Join(repoDir, filepath.FromSlash(dir), "repodata", "repomd.xml")) {
+			return dir, true
+		}
+		if dir == "." || dir == "/" {
+			return "", false
+		}
+	}
+}
+
+func readRPMRepomd(file string) (rpmRepomd, error) {
+	var repomd rpmRepomd
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return repomd, err
+	}
+	err = xml.Unmarshal(data, &repomd)
+	return repomd, err
+}
+
+// RPMMetadataChecksum returns the checksum the cached repomd.xml lists for
+// the metadata file name, or nil.
+func RPMMetadataChecksum(repoDir, name string) *misc.Checksum {
+	dir, ok := rpmRepository(repoDir, name)
+	if !ok {
+		return nil
+	}
+	repomd, err := readRPMRepomd(filepath.Join(repoDir, filepath.FromSlash(dir), "repodata", "repomd.xml"))
+	if err != nil {
+		return nil
+	}
+	for _, data := range repomd.Data {
+		if path.Join(dir, data.Location.Href) == name {
+			checksum := data.Checksum.checksum()
+			return &checksum
+		}
+	}
+	return nil
+}
+
+// RPMChecksum returns the checksum of the package name listed in the cached
+// primary.xml of its repository, or nil.
+func RPMChecksum(repoDir, name string) *misc.Checksum {
+	dir, ok := rpmRepository(repoDir, name)
+	if !ok {
+		return nil
+	}
+	repomd, err := readRPMRepomd(filepath.Join(repoDir, filepath.FromSlash(dir), "repodata", "repomd.xml"))
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, data := range repomd.Data {
+		if data.Type == "primary" {
+			files = append(files, filepath.Join(repoDir, filepath.FromSlash(path.Join(dir, data.Location.Href))))
+		}
+	}
+	rel := strings.TrimPrefix(name, dir+"/")
+	if dir == "." {
+		rel = name
+	}
+	return rpmPrimaries.lookup(filepath.Join(repoDir, filepath.FromSlash(dir)), files, rel, readRPMPrimary)
+}
+
+// readRPMPrimary maps the location of every package of primary.xml to its
+// checksum.
+func readRPMPrimary(r io.Reader) (map[string]misc.Checksum, error) {
+	sums := map[string]misc.Checksum{}
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "package" {
+			continue
+		}
+		var pkg struct {
+			Checksum rpmChecksum `xml:"checksum"`
+			Location struct {
+				Href string `xml:"href,attr"`
+			} `xml:"location"`
+		}
+		if err = decoder.DecodeElement(&pkg, &start); err != nil {
+			return nil, err
+		}
+		if pkg.Location.Href != "" && pkg.Checksum.Value != "" {
+			sums[pkg.Location.Href] = pkg.Checksum.checksum()
+		}
+	}
+}
+
+// rpmArtifact splits "<name>-<version>-<release>.<arch>.rpm" into the name
+// and "<version>-<release>".
+func rpmArtifact(name string) (pkg, version string, ok bool) {
+	if !IsRPMPackage(name) {
+		return "", "", false
+	}
+	nvr := strings.TrimSuffix(strings.TrimSuffix(path.Base(name), ".drpm"), ".rpm")
+	if i := strings.LastIndex(nvr, "."); i > 0 {
+		nvr = nvr[:i]
+	}
+	release := strings.LastIndex(nvr, "-")
+	if release <= 0 {
+		return "", "", false
+	}
+	versionStart := strings.LastIndex(nvr[:release], "-")
+	if versionStart <= 0 {
+		return "", "", false
+	}
+	return nvr[:versionStart], nvr[versionStart+1:], true
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metadata tells index and metadata files apart from artifacts for each
+// repository type. Paths are relative to the repository directory. Types
+// without an entry only store artifacts.
+var metadata = map[string]func(rel string) bool{
+	"pypi": func(rel string) bool {
+		return filepath.Base(rel) == "index.json"
+	},
+	"rubygems": func(rel string) bool {
+		return !strings.HasPrefix(rel, "gems/")
+	},
+	"goproxy": func(rel string) bool {
+		return !strings.HasSuffix(rel, ".zip")
+	},
+	"npm": func(rel string) bool {
+		return !strings.HasPrefix(rel, "tarballs/")
+	},
+	"cargo": func(rel string) bool {
+		return !strings.HasPrefix(rel, "crates/")
+	},
+	"galaxy": func(rel string) bool {
+		return !strings.HasPrefix(rel, "binary/")
+	},
+	"maven": MavenMutable,
+	"apk": func(rel string) bool {
+		return !strings.HasSuffix(rel, ".apk")
+	},
+	"rpm": func(rel string) bool {
+		return !IsRPMPackage(rel)
+	},
+	"apt": func(rel string) bool {
+		return !strings.HasPrefix(rel, "pool/")
+	},
+	"helm": func(rel string) bool {
+		return !strings.HasPrefix(rel, "charts/")
+	},
+	"nuget": func(rel string) bool {
+		return !strings.HasSuffix(rel, ".nupkg")
+	},
+	"composer": func(rel string) bool {
+		return !strings.HasPrefix(rel, "dists/")
+	},
+	"terraform": func(rel string) bool {
+		return !strings.HasSuffix(rel, ".zip")
+	},
+	"conda": func(rel string) bool {
+		return !IsCondaPackage(rel)
+	},
+	"hex": func(rel string) bool {
+		return !strings.HasPrefix(rel, "tarballs/")
+	},
+	"pub": func(rel string) bool {
+		return !strings.HasPrefix(rel, "packages/")
+	},
+	"cran": func(rel string) bool {
+		return !IsCRANPackage(rel)
+	},
+	"cpan": func(rel string) bool {
+		return !IsCPANDistribution(rel)
+	},
+	// Manifests by tag change upstream, blobs and manifests by digest don't.
+	"oci": func(rel string) bool {
+		_, _, isTag := ociManifest(rel)
+		return isTag
+	},
+}
+
+// Entry is a file in the cache directory.
+type Entry struct {
+	Path string
+	// Ecosystem and Repository ("<type>/<key>") are taken from the first two
+	// path elements below the cache directory.
+	Ecosystem  string
+	Repository string
+	// Name is the path relative to the repository directory.
+	Name     string
+	Size     int64
+	Modified time.Time
+	Accessed time.Time
+	// Changed is when the file was last written into the cache or had its
+	// times updated. Modified holds the upstream Last-Modified time instead.
+	Changed  time.Time
+	Metadata bool
+}
+
+const sidecarSuffix = ".meta.json"
+
+// IsSidecar reports whether path stores the upstream validators (ETag,
+// Last-Modified) of another cached file.
+func IsSidecar(path string) bool {
+	return strings.HasSuffix(path, sidecarSuffix)
+}
+
+// Sidecars returns the paths a sidecar of path may have.
+func Sidecars(path string) []string {
+	return []string{
+		path + sidecarSuffix,
+		strings.TrimSuffix(path, ".json") + sidecarSuffix,
+	}
+}
+
+// IsTemporary reports whether path is a download in progress.
+func IsTemporary(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), ".tmp.")
+}
+
+// Scan lists the files below dir. Directories listed in skip and in-flight
+// downloads are left out.
+func Scan(dir string, skip []string) ([]Entry, error) {
+	return scan(dir, "", skip)
+}
+
+// ScanRepository lists the files of one repository ("<type>/<key>").
+func ScanRepository(dir, repo string) ([]Entry, error) {
+	if !filepath.IsLocal(filepath.FromSlash(repo)) || strings.Count(repo, "/") != 1 {
+		return nil, fmt.Errorf("invalid repository %q", repo)
+	}
+	return scan(dir, filepath.FromSlash(repo), nil)
+}
+
+func scan(dir, sub string, skip []string) ([]Entry, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	skipped := map[string]bool{}
+	for _, s := range skip {
+		if abs, errAbs := filepath.Abs(s); errAbs == nil {
+			skipped[abs] = true
+		}
+	}
+
+	var entries []Entry
+	err = filepath.WalkDir(filepath.Join(root, sub), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if skipped[path] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || IsTemporary(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		entries = append(entries, newEntry(root, path, info))
+		return nil
+	})
+	return entries, err
+}
+
+func newEntry(root, path string, info os.FileInfo) Entry {
+	e := Entry{
+		Path:     path,
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+		Accessed: accessTime(info),
+		Changed:  changeTime(info),
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return e
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 3)
+	if len(parts) < 3 {
+		e.Name = filepath.ToSlash(rel)
+		return e
+	}
+	e.Ecosystem = parts[0]
+	e.Repository = parts[0] + "/" + parts[1]
+	e.Name = parts[2]
+	e.Metadata = IsSidecar(e.Name)
+	if isMetadata, ok := metadata[e.Ecosystem]; ok && !e.Metadata {
+		e.Metadata = isMetadata(e.Name)
+	}
+	return e
+}
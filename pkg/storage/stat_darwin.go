@@ -0,0 +1,23 @@
+//go:build darwin
+
+package storage
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func accessTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Unix())
+	}
+	return info.ModTime()
+}
+
+func changeTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Ctimespec.Unix())
+	}
+	return info.ModTime()
+}
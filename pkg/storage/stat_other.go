@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package storage
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime falls back to the modification time where the access time is
+// not available, so eviction follows download order there.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+func changeTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// CacheStatuses are the X-Cache-Status values counted per repository.
+var CacheStatuses = []string{"HIT", "MISS", "EXPIRED", "STALE", "ERROR"}
+
+func requestsCounter(repo, status string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf("hub_cache_requests_total{repository=%q,status=%q}", repo, status))
+}
+
+// RecordRequest counts a repository response by its cache status.
+func RecordRequest(repo, status string) {
+	if repo == "" || !slices.Contains(CacheStatuses, status) {
+		return
+	}
+	requestsCounter(repo, status).Inc()
+}
+
+// Requests returns the number of responses of a repository per cache
+// status since the server started.
+func Requests(repo string) map[string]uint64 {
+	counts := make(map[string]uint64, len(CacheStatuses))
+	for _, status := range CacheStatuses {
+		counts[status] = requestsCounter(repo, status).Get()
+	}
+	return counts
+}
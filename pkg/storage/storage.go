@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/VictoriaMetrics/metrics"
+	"go.uber.org/zap"
+)
+
+const defaultInterval = time.Minute
+
+// accessUpdateInterval is how old the access time of a file must be for
+// serving it to update it.
+const accessUpdateInterval = time.Minute
+
+var (
+	evictedFiles = metrics.NewCounter("hub_cache_evicted_files_total")
+	evictedBytes = metrics.NewCounter("hub_cache_evicted_bytes_total")
+	cacheSize    atomic.Int64
+	_            = metrics.NewGauge("hub_cache_size_bytes", func() float64 {
+		return float64(cacheSize.Load())
+	})
+)
+
+var (
+	mu   sync.Mutex
+	pins = map[string]int{}
+	hits = map[string]uint64{}
+
+	// tracking is set when quotas are configured, as the hit counts and
+	// access times are only used by the eviction policy.
+	tracking atomic.Bool
+)
+
+// Acquire marks path as being served: it is not evicted until release is
+// called. With quotas configured, the hit count and access time used by the
+// eviction policy are updated as well, the latter at most every
+// accessUpdateInterval.
+func Acquire(path string) (release func()) {
+	path = key(path)
+	track := tracking.Load()
+	mu.Lock()
+	pins[path]++
+	if track {
+		hits[path]++
+	}
+	mu.Unlock()
+
+	if track {
+		if info, err := os.Stat(path); err == nil && time.Since(accessTime(info)) > accessUpdateInterval {
+			_ = os.Chtimes(path, time.Now(), info.ModTime())
+		}
+	}
+
+	return func() {
+		mu.Lock()
+		if pins[path]--; pins[path] <= 0 {
+			delete(pins, path)
+		}
+		mu.Unlock()
+	}
+}
+
+// Hits returns how many times path was served since the server started.
+func Hits(path string) uint64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return hits[key(path)]
+}
+
+// key makes paths given by handlers comparable with the absolute paths
+// returned by Scan.
+func key(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// remove deletes path and its sidecars unless the file is being served.
+func remove(path string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if pins[path] > 0 {
+		return false
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		zap.S().Named("storage").Warnf("Evict %s error: %v", path, err)
+		return false
+	}
+	for _, sidecar := range Sidecars(path) {
+		_ = os.Remove(sidecar)
+	}
+	delete(hits, path)
+	return true
+}
+
+// RemoveAll deletes path and, for a directory, everything below it, like
+// remove does for evicted files: files being served, their sidecars and
+// downloads in progress are kept and returned in skipped.
+func RemoveAll(path string) (skipped []string, err error) {
+	var files, dirs []string
+	err = filepath.WalkDir(key(path), func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+		} else {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	inUse := func(p string) bool {
+		if IsTemporary(p) || pins[p] > 0 {
+			return true
+		}
+		if IsSidecar(p) {
+			base := strings.TrimSuffix(p, sidecarSuffix)
+			return pins[base] > 0 || pins[base+".json"] > 0
+		}
+		return false
+	}
+	for _, file := range files {
+		if inUse(file) {
+			skipped = append(skipped, file)
+			continue
+		}
+		if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return skipped, err
+		}
+		delete(hits, file)
+	}
+	// Directories still holding skipped files are kept.
+	for _, dir := range slices.Backward(dirs) {
+		_ = os.Remove(dir)
+	}
+	return skipped, nil
+}
+
+// Setup starts the background eviction when a quota is configured.
+func Setup(cfg types.ConfigFile) error {
+	switch cfg.Cache.Policy {
+	case "", "lru", "lfu":
+	default:
+		return fmt.Errorf("unknown cache policy %q", cfg.Cache.Policy)
+	}
+	if !cfg.Cache.Enabled() {
+		return nil
+	}
+	tracking.Store(true)
+	interval := cfg.Cache.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	go func() {
+		for {
+			Sweep(cfg)
+			time.Sleep(interval)
+		}
+	}()
+	return nil
+}
+
+// LocalDirs returns the directories served as-is that must never be evicted.
+func LocalDirs(cfg types.ConfigFile) []string {
+	var dirs []string
+	for _, v := range cfg.Server.Galaxy {
+		if v.Dir != "" {
+			dirs = append(dirs, v.Dir)
+		}
+	}
+	return dirs
+}
+
+type candidate struct {
+	Entry
+	hits    uint64
+	evicted bool
+}
+
+// Sweep evicts files until the repository, ecosystem and global quotas are
+// met. Artifacts are evicted before metadata.
+func Sweep(cfg types.ConfigFile) {
+	logger := zap.S().Named("storage")
+
+	entries, err := Scan(cfg.Dir, LocalDirs(cfg))
+	if err != nil {
+		logger.Errorf("Scan %s error: %v", cfg.Dir, err)
+		return
+	}
+
+	// Sidecars are evicted together with the file they describe, so their
+	// size is accounted to it.
+	byPath := make(map[string]*candidate, len(entries))
+	candidates := make([]*candidate, 0, len(entries))
+	mu.Lock()
+	for _, e := range entries {
+		c := &candidate{Entry: e, hits: hits[e.Path]}
+		byPath[e.Path] = c
+		candidates = append(candidates, c)
+	}
+	mu.Unlock()
+	candidates = slices.DeleteFunc(candidates, func(c *candidate) bool {
+		if !IsSidecar(c.Path) {
+			return false
+		}
+		base := c.Path[:len(c.Path)-len(sidecarSuffix)]
+		for _, owner := range []string{base, base + ".json"} {
+			if o, ok := byPath[owner]; ok {
+				o.Size += c.Size
+				return true
+			}
+		}
+		return false
+	})
+
+	var total int64
+	ecosystems := map[string]int64{}
+	repositories := map[string]int64{}
+	for _, c := range candidates {
+		total += c.Size
+		ecosystems[c.Ecosystem] += c.Size
+		repositories[c.Repository] += c.Size
+	}
+
+	byLeastUsed := func(a, b *candidate) int {
+		if a.Metadata != b.Metadata {
+			if a.Metadata {
+				return 1
+			}
+			return -1
+		}
+		if cfg.Cache.Policy == "lfu" && a.hits != b.hits {
+			return cmp.Compare(a.hits, b.hits)
+		}
+		return a.Accessed.Compare(b.Accessed)
+	}
+	slices.SortFunc(candidates, byLeastUsed)
+
+	evict := func(match func(*candidate) bool, used func() int64, limit int64) {
+		for _, c := range candidates {
+			if used() <= limit {
+				return
+			}
+			if c.evicted || !match(c) || !remove(c.Path) {
+				continue
+			}
+			c.evicted = true
+			total -= c.Size
+			ecosystems[c.Ecosystem] -= c.Size
+			repositories[c.Repository] -= c.Size
+			evictedFiles.Inc()
+			evictedBytes.Add(int(c.Size))
+			removeEmptyDirs(cfg.Dir, filepath.Dir(c.Path))
+			logger.Debugf("Evicted %s (%d bytes)", c.Path, c.Size)
+		}
+	}
+
+	for repo, limit := range cfg.Cache.Repositories {
+		evict(func(c *candidate) bool { return c.Repository == repo },
+			func() int64 { return repositories[repo] }, int64(limit))
+	}
+	for ecosystem, limit := range cfg.Cache.Ecosystems {
+		evict(func(c *candidate) bool { return c.Ecosystem == ecosystem },
+			func() int64 { return ecosystems[ecosystem] }, int64(limit))
+	}
+	if cfg.Cache.MaxSize > 0 {
+		evict(func(*candidate) bool { return true },
+			func() int64 { return total }, int64(cfg.Cache.MaxSize))
+		if total > int64(cfg.Cache.MaxSize) {
+			logger.Warnf("Cache size %s is above max_size %s, remaining files are in use", types.ByteSize(total), cfg.Cache.MaxSize)
+		}
+	}
+	cacheSize.Store(total)
+
+	mu.Lock()
+	for path := range hits {
+		if _, ok := byPath[path]; !ok {
+			delete(hits, path)
+		}
+	}
+	mu.Unlock()
+}
+
+// removeEmptyDirs removes dir and its parents while they are empty, stopping
+// at the repository directory.
+func removeEmptyDirs(root, dir string) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return
+	}
+	for {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || strings.HasPrefix(rel, "..") || strings.Count(filepath.ToSlash(rel), "/") < 2 {
+			return
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Invalidate makes the next request for the cached file at path go to
+// upstream: its validators are dropped and it is marked as outdated. The
+// file itself is kept as a fallback for when upstream is unreachable.
+func Invalidate(path string) error {
+	for _, sidecar := range Sidecars(path) {
+		if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, accessTime(info), time.Unix(0, 0))
+}
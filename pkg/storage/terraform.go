@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+)
+
+// TerraformChecksum returns the SHA256 the cached SHA256SUMS file of its
+// provider version lists for the provider zip name, or nil.
+func TerraformChecksum(repoDir, name string) *misc.Checksum {
+	dir := filepath.Join(repoDir, filepath.FromSlash(path.Dir(name)))
+	files, _ := filepath.Glob(filepath.Join(dir, "*SHA256SUMS"))
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Clean(file))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == path.Base(name) {
+				return &misc.Checksum{Algorithm: "sha256", Value: fields[0]}
+			}
+		}
+	}
+	return nil
+}
+
+// terraformArtifact splits "providers/<namespace>/<type>/<version>/<file>.zip"
+// into "<namespace>/<type>" and the version.
+func terraformArtifact(name string) (pkg, version string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 5 || parts[0] != "providers" || path.Ext(name) != ".zip" {
+		return "", "", false
+	}
+	return parts[1] + "/" + parts[2], parts[3], true
+}
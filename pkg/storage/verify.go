@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/misc"
+	"github.com/psvmcc/hub/pkg/types"
+)
+
+// ErrNoChecksum is returned for artifacts without a checksum in the cached
+// metadata.
+var ErrNoChecksum = errors.New("no checksum known")
+
+// Verifier checks cached artifacts against the checksums found in the cached
+// index files. The last index file read is kept, as artifacts of the same
+// package are usually verified one after another.
+type Verifier struct {
+	root     string
+	lastName string
+	lastData []byte
+}
+
+func NewVerifier(dir string) (*Verifier, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{root: root}, nil
+}
+
+// Verify checks e against its published checksum. It returns ErrNoChecksum
+// when the metadata of e has no checksum for it.
+func (v *Verifier) Verify(e Entry) error {
+	checksum, err := v.Checksum(e)
+	if err != nil {
+		return err
+	}
+	return checksum.VerifyFile(e.Path)
+}
+
+// Checksum returns the checksum published for the artifact e.
+func (v *Verifier) Checksum(e Entry) (*misc.Checksum, error) {
+	if e.Ecosystem == "oci" {
+		return ociChecksum(e.Name)
+	}
+	pkg, version, ok := ParseArtifact(e)
+	if !ok || e.Metadata {
+		return nil, ErrNoChecksum
+	}
+	repo := filepath.Join(v.root, filepath.FromSlash(e.Repository))
+
+	switch e.Ecosystem {
+	case "pypi":
+		var index types.PypiMetadata
+		if !v.decode(filepath.Join(repo, filepath.FromSlash(pkg), "index.json"), &index) {
+			break
+		}
+		file := path.Base(e.Name)
+		for _, f := range index.Files {
+			if f.Filename == file && f.Hashes.Sha256 != "" {
+				return &misc.Checksum{Algorithm: "sha256", Value: f.Hashes.Sha256}, nil
+			}
+		}
+	case "galaxy":
+		namespace, name, _ := strings.Cut(pkg, ".")
+		var info types.GalaxyCollectionVersionInfo
+		if v.decode(filepath.Join(repo, "index", namespace, name, "versions", version, "index.json"), &info) && info.Artifact.Sha256 != "" {
+			return &misc.Checksum{Algorithm: "sha256", Value: info.Artifact.Sha256}, nil
+		}
+	case "cargo":
+		data := v.read(filepath.Join(repo, "index", filepath.FromSlash(CargoIndexPath(pkg))))
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var line struct {
+				Vers  string `json:"vers"`
+				Cksum string `json:"cksum"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &line) == nil && line.Vers == version && line.Cksum != "" {
+				return &misc.Checksum{Algorithm: "sha256", Value: line.Cksum}, nil
+			}
+		}
+	case "maven":
+		for _, algorithm := range []string{"sha512", "sha256", "sha1", "md5"} {
+			if checksum := ParseMavenChecksum(algorithm, v.read(e.Path+"."+algorithm)); checksum != nil {
+				return checksum, nil
+			}
+		}
+	case "apt":
+		if checksum := AptChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "apk":
+		if checksum := APKChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "rpm":
+		if checksum := RPMChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "helm":
+		if checksum := helmChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "composer":
+		if checksum := composerChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "terraform":
+		if checksum := TerraformChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "conda":
+		if checksum := CondaChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "hex":
+		if checksum := HexChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "pub":
+		if checksum := pubChecksum(repo, e.Name); checksum != nil {
+			return checksum, nil
+		}
+	case "npm":
+		return v.npmChecksum(filepath.Join(repo, "metadata", filepath.FromSlash(pkg)), version)
+	case "rubygems":
+		// Compact index lines look like "1.2.3 dep:>= 1|checksum:<sha256>".
+		data := v.read(filepath.Join(repo, "info", pkg))
+		for line := range strings.Lines(string(data)) {
+			lineVersion, rest, found := strings.Cut(strings.TrimSpace(line), " ")
+			if !found || lineVersion != version {
+				continue
+			}
+			_, requirements, _ := strings.Cut(rest, "|")
+			for field := range strings.SplitSeq(requirements, ",") {
+				if sum, ok := strings.CutPrefix(field, "checksum:"); ok {
+					return &misc.Checksum{Algorithm: "sha256", Value: sum}, nil
+				}
+			}
+		}
+	}
+	return nil, ErrNoChecksum
+}
+
+// ociChecksum returns the digest that blobs and manifests fetched by digest
+// are stored under.
+func ociChecksum(name string) (*misc.Checksum, error) {
+	if _, reference, isTag := ociManifest(name); reference != "" && !isTag {
+		algorithm, value, _ := strings.Cut(reference, ":")
+		return &misc.Checksum{Algorithm: algorithm, Value: value}, nil
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) == 3 && parts[0] == "blobs" {
+		return &misc.Checksum{Algorithm: parts[1], Value: parts[2]}, nil
+	}
+	return nil, ErrNoChecksum
+}
+
+// npmChecksum looks up the dist checksum of version in any cached packument
+// of the package.
+func (v *Verifier) npmChecksum(dir, version string) (*misc.Checksum, error) {
+	packuments, _ := filepath.Glob(filepath.Join(dir, "packument.*.json"))
+	for _, p := range packuments {
+		if IsSidecar(p) {
+			continue
+		}
+		var packument struct {
+			Versions map[string]struct {
+				Dist struct {
+					Integrity string `json:"integrity"`
+					Shasum    string `json:"shasum"`
+				} `json:"dist"`
+			} `json:"versions"`
+		}
+		if !v.decode(p, &packument) {
+			continue
+		}
+		dist := packument.Versions[version].Dist
+		if algorithm, sum, ok := strings.Cut(dist.Integrity, "-"); ok {
+			if raw, err := base64.StdEncoding.DecodeString(sum); err == nil {
+				return &misc.Checksum{Algorithm: algorithm, Value: hex.EncodeToString(raw)}, nil
+			}
+		}
+		if dist.Shasum != "" {
+			return &misc.Checksum{Algorithm: "sha1", Value: dist.Shasum}, nil
+		}
+	}
+	return nil, ErrNoChecksum
+}
+
+func (v *Verifier) read(name string) []byte {
+	if name == v.lastName {
+		return v.lastData
+	}
+	data, err := os.ReadFile(filepath.Clean(name))
+	if err != nil {
+		data = nil
+	}
+	v.lastName, v.lastData = name, data
+	return data
+}
+
+func (v *Verifier) decode(name string, target any) bool {
+	data := v.read(name)
+	return data != nil && json.Unmarshal(data, target) == nil
+}
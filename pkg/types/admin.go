@@ -0,0 +1,10 @@
+package types
+
+// AdminConfig enables the /-/admin/ API. Clients are authenticated like
+// repository clients and must match one of the Access principals.
+type AdminConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Bind serves the API on a separate listener instead of the main one.
+	Bind   string   `yaml:"bind"`
+	Access []string `yaml:"access"`
+}
@@ -0,0 +1,49 @@
+package types
+
+// AuthConfig configures client authentication and per-repository access
+// control. When no users, tokens or trusted header are configured every
+// repository is open to anyone.
+type AuthConfig struct {
+	Users         map[string]AuthUser `yaml:"users"`
+	Tokens        []AuthToken         `yaml:"tokens"`
+	TrustedHeader TrustedHeaderAuth   `yaml:"trusted_header"`
+	// Default applies to repositories without an ACL entry. It allows
+	// reads for every authenticated client when omitted.
+	Default *AccessRule `yaml:"default"`
+	// ACL maps "<type>/<key>" (e.g. "npm/npmjs") to its access rule.
+	ACL map[string]AccessRule `yaml:"acl"`
+}
+
+// AuthUser is an HTTP basic user with a bcrypt password hash.
+type AuthUser struct {
+	Password string   `yaml:"password"`
+	Groups   []string `yaml:"groups"`
+}
+
+// AuthToken is a static bearer token mapped to a user name and groups.
+type AuthToken struct {
+	User   string   `yaml:"user"`
+	Token  Secret   `yaml:"token"`
+	Groups []string `yaml:"groups"`
+}
+
+// TrustedHeaderAuth takes the user name (and optionally a comma separated
+// group list) from headers set by a reverse proxy. Requests from addresses
+// outside Proxies never use these headers.
+type TrustedHeaderAuth struct {
+	User    string   `yaml:"user"`
+	Groups  string   `yaml:"groups"`
+	Proxies []string `yaml:"proxies"`
+}
+
+// AccessRule lists who may read and write a repository. Entries are user
+// names, "@group", "@authenticated" for any signed-in client, or "*" for
+// everyone including anonymous clients.
+type AccessRule struct {
+	Read  []string `yaml:"read"`
+	Write []string `yaml:"write"`
+}
+
+func (a AuthConfig) Enabled() bool {
+	return len(a.Users) > 0 || len(a.Tokens) > 0 || a.TrustedHeader.User != ""
+}
@@ -0,0 +1,96 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CacheConfig limits the size of the cache directory. Quotas are enforced
+// by a background sweep that evicts the least recently (or least
+// frequently) used files until every quota is met again.
+type CacheConfig struct {
+	MaxSize ByteSize `yaml:"max_size"`
+	// Policy is "lru" (default) or "lfu".
+	Policy   string        `yaml:"policy"`
+	Interval time.Duration `yaml:"interval"`
+	// Ecosystems maps a repository type (e.g. "npm") to its quota.
+	Ecosystems map[string]ByteSize `yaml:"ecosystems"`
+	// Repositories maps "<type>/<key>" (e.g. "npm/npmjs") to its quota.
+	Repositories map[string]ByteSize `yaml:"repositories"`
+}
+
+func (c CacheConfig) Enabled() bool {
+	return c.MaxSize > 0 || len(c.Ecosystems) > 0 || len(c.Repositories) > 0
+}
+
+// ByteSize is a size in bytes. In the config it is written as a plain number
+// or with a unit: "512MB", "10GiB", "1T".
+type ByteSize int64
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+// ParseByteSize parses a size such as "10GiB".
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	multiplier, ok := byteUnits[unit]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	return ByteSize(value * float64(multiplier)), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("size must be a string or number")
+	}
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+func (b ByteSize) String() string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(b)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", int64(b))
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
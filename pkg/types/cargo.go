@@ -11,6 +11,9 @@ type CargoSource struct {
 	Index string `yaml:"index"`
 	DL    string `yaml:"dl"`
 	API   string `yaml:"api"`
+
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Auth     UpstreamAuth   `yaml:"auth"`
 }
 
 func (c *CargoSource) UnmarshalYAML(value *yaml.Node) error {
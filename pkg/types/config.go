@@ -8,19 +8,41 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+type GalaxySource struct {
+	URL      string         `yaml:"url"`
+	Dir      string         `yaml:"dir"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Auth     UpstreamAuth   `yaml:"auth"`
+}
+
 type ConfigFile struct {
-	Dir    string `yaml:"dir"`
-	Server struct {
-		Cargo  map[string]CargoSource `yaml:"cargo"`
-		Galaxy map[string]struct {
-			URL string `yaml:"url"`
-			Dir string `yaml:"dir"`
-		} `yaml:"galaxy"`
-		PYPI     map[string]string `yaml:"pypi"`
-		RUBYGEMS map[string]string `yaml:"rubygems"`
-		Static   map[string]string `yaml:"static"`
-		GOPROXY  map[string]string `yaml:"goproxy"`
-		NPM      map[string]string `yaml:"npm"`
+	Dir      string         `yaml:"dir"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Cache    CacheConfig    `yaml:"cache"`
+	Admin    AdminConfig    `yaml:"admin"`
+	Server   struct {
+		Cargo     map[string]CargoSource    `yaml:"cargo"`
+		Galaxy    map[string]GalaxySource   `yaml:"galaxy"`
+		PYPI      map[string]UpstreamSource `yaml:"pypi"`
+		RUBYGEMS  map[string]UpstreamSource `yaml:"rubygems"`
+		Static    map[string]UpstreamSource `yaml:"static"`
+		GOPROXY   map[string]UpstreamSource `yaml:"goproxy"`
+		NPM       map[string]UpstreamSource `yaml:"npm"`
+		Maven     map[string]UpstreamSource `yaml:"maven"`
+		APT       map[string]UpstreamSource `yaml:"apt"`
+		RPM       map[string]RPMSource      `yaml:"rpm"`
+		APK       map[string]UpstreamSource `yaml:"apk"`
+		Helm      map[string]UpstreamSource `yaml:"helm"`
+		NuGet     map[string]UpstreamSource `yaml:"nuget"`
+		Composer  map[string]UpstreamSource `yaml:"composer"`
+		Terraform map[string]UpstreamSource `yaml:"terraform"`
+		Conda     map[string]UpstreamSource `yaml:"conda"`
+		Hex       map[string]UpstreamSource `yaml:"hex"`
+		Pub       map[string]UpstreamSource `yaml:"pub"`
+		CRAN      map[string]UpstreamSource `yaml:"cran"`
+		CPAN      map[string]UpstreamSource `yaml:"cpan"`
+		OCI       map[string]OCISource      `yaml:"oci"`
 	} `yaml:"server"`
 }
 
@@ -0,0 +1,38 @@
+package types
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OCISource is an upstream container registry. Like UpstreamSource it can
+// be written as a plain URL.
+type OCISource struct {
+	URL string `yaml:"url"`
+	// ManifestTTL is how long a manifest fetched by tag is served before it
+	// is checked against upstream again.
+	ManifestTTL time.Duration `yaml:"manifest_ttl"`
+
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Auth     UpstreamAuth   `yaml:"auth"`
+}
+
+func (o *OCISource) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		o.URL = value.Value
+		return nil
+	case yaml.MappingNode:
+		type raw OCISource
+		var decoded raw
+		if err := value.Decode(&decoded); err != nil {
+			return err
+		}
+		*o = OCISource(decoded)
+		return nil
+	default:
+		return fmt.Errorf("oci source must be string or map")
+	}
+}
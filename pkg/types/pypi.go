@@ -8,21 +8,23 @@ import (
 	"time"
 )
 
+type PypiFile struct {
+	CoreMetadata         any    `json:"core-metadata"`
+	DataDistInfoMetadata any    `json:"data-dist-info-metadata"`
+	Filename             string `json:"filename"`
+	Hashes               struct {
+		Sha256 string `json:"sha256"`
+	} `json:"hashes"`
+	RequiresPython string    `json:"requires-python"`
+	Size           int       `json:"size"`
+	UploadTime     time.Time `json:"upload-time"`
+	URL            string    `json:"url"`
+	Yanked         any       `json:"yanked"`
+}
+
 type PypiMetadata struct {
-	Files []struct {
-		CoreMetadata         any    `json:"core-metadata"`
-		DataDistInfoMetadata any    `json:"data-dist-info-metadata"`
-		Filename             string `json:"filename"`
-		Hashes               struct {
-			Sha256 string `json:"sha256"`
-		} `json:"hashes"`
-		RequiresPython string    `json:"requires-python"`
-		Size           int       `json:"size"`
-		UploadTime     time.Time `json:"upload-time"`
-		URL            string    `json:"url"`
-		Yanked         any       `json:"yanked"`
-	} `json:"files"`
-	Meta struct {
+	Files []PypiFile `json:"files"`
+	Meta  struct {
 		LastSerial int    `json:"_last-serial"`
 		APIVersion string `json:"api-version"`
 	} `json:"meta"`
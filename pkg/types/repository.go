@@ -0,0 +1,104 @@
+package types
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// RepositoryTypes maps the first path segment of a repository route to the
+// repository type used in ACL and quota keys.
+var RepositoryTypes = map[string]string{
+	"pypi":      "pypi",
+	"rubygems":  "rubygems",
+	"static":    "static",
+	"goproxy":   "goproxy",
+	"npm":       "npm",
+	"cargo":     "cargo",
+	"galaxy":    "galaxy",
+	"maven":     "maven",
+	"apt":       "apt",
+	"rpm":       "rpm",
+	"apk":       "apk",
+	"helm":      "helm",
+	"nuget":     "nuget",
+	"composer":  "composer",
+	"terraform": "terraform",
+	"conda":     "conda",
+	"hex":       "hex",
+	"pub":       "pub",
+	"cran":      "cran",
+	"cpan":      "cpan",
+	// Registry clients expect the API at /v2/, so OCI repositories are
+	// served below /v2/<key>/.
+	"v2": "oci",
+}
+
+// RepositoryFromPath returns the "<type>/<key>" name of the repository a
+// request path belongs to, or an empty string for paths outside of
+// repositories.
+func RepositoryFromPath(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return ""
+	}
+	repoType, ok := RepositoryTypes[parts[0]]
+	if !ok {
+		return ""
+	}
+	return repoType + "/" + parts[1]
+}
+
+// Repository is a repository of the config file.
+type Repository struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	URL  string `json:"url,omitempty"`
+	Dir  string `json:"dir,omitempty"`
+}
+
+// ConfiguredRepositories lists the repositories of the config file, sorted
+// by name.
+func ConfiguredRepositories(cfg ConfigFile) []Repository {
+	var repos []Repository
+	sources := func(repoType string, m map[string]UpstreamSource) {
+		for k, v := range m {
+			repos = append(repos, Repository{Type: repoType, Key: k, URL: v.URL})
+		}
+	}
+	sources("pypi", cfg.Server.PYPI)
+	sources("rubygems", cfg.Server.RUBYGEMS)
+	sources("static", cfg.Server.Static)
+	sources("goproxy", cfg.Server.GOPROXY)
+	sources("npm", cfg.Server.NPM)
+	sources("maven", cfg.Server.Maven)
+	sources("apt", cfg.Server.APT)
+	sources("apk", cfg.Server.APK)
+	sources("helm", cfg.Server.Helm)
+	sources("nuget", cfg.Server.NuGet)
+	sources("composer", cfg.Server.Composer)
+	sources("terraform", cfg.Server.Terraform)
+	sources("conda", cfg.Server.Conda)
+	sources("hex", cfg.Server.Hex)
+	sources("pub", cfg.Server.Pub)
+	sources("cran", cfg.Server.CRAN)
+	sources("cpan", cfg.Server.CPAN)
+	for k, v := range cfg.Server.Cargo {
+		repos = append(repos, Repository{Type: "cargo", Key: k, URL: v.Base})
+	}
+	for k, v := range cfg.Server.RPM {
+		repos = append(repos, Repository{Type: "rpm", Key: k, URL: cmp.Or(v.URL, v.Metalink, v.Mirrorlist)})
+	}
+	for k, v := range cfg.Server.OCI {
+		repos = append(repos, Repository{Type: "oci", Key: k, URL: v.URL})
+	}
+	for k, v := range cfg.Server.Galaxy {
+		repos = append(repos, Repository{Type: "galaxy", Key: k, URL: v.URL, Dir: v.Dir})
+	}
+	for i := range repos {
+		repos[i].Name = repos[i].Type + "/" + repos[i].Key
+	}
+	slices.SortFunc(repos, func(a, b Repository) int { return strings.Compare(a.Name, b.Name) })
+	return repos
+}
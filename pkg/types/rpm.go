@@ -0,0 +1,37 @@
+package types
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RPMSource is an upstream RPM repository. Like UpstreamSource it can be
+// written as a plain URL. Instead of a base URL, a mirrorlist or a
+// metalink can be set, a base URL is then picked from it.
+type RPMSource struct {
+	URL        string `yaml:"url"`
+	Mirrorlist string `yaml:"mirrorlist"`
+	Metalink   string `yaml:"metalink"`
+
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Auth     UpstreamAuth   `yaml:"auth"`
+}
+
+func (r *RPMSource) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		r.URL = value.Value
+		return nil
+	case yaml.MappingNode:
+		type raw RPMSource
+		var decoded raw
+		if err := value.Decode(&decoded); err != nil {
+			return err
+		}
+		*r = RPMSource(decoded)
+		return nil
+	default:
+		return fmt.Errorf("rpm source must be string or map")
+	}
+}
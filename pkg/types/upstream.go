@@ -0,0 +1,187 @@
+package types
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UpstreamConfig tunes the HTTP client used to talk to upstream registries.
+// It is set globally under `upstream` and can be overridden per repository;
+// the fields set by the repository win, CA files are added to the global
+// ones. Numeric fields are pointers so that an explicit 0 (no retries, no
+// timeout) overrides the global value instead of inheriting it.
+type UpstreamConfig struct {
+	ConnectTimeout        *time.Duration `yaml:"connect_timeout"`
+	ResponseHeaderTimeout *time.Duration `yaml:"response_header_timeout"`
+	ReadTimeout           *time.Duration `yaml:"read_timeout"`
+	IdleConnTimeout       *time.Duration `yaml:"idle_conn_timeout"`
+	MaxIdleConnsPerHost   *int           `yaml:"max_idle_conns_per_host"`
+	Retries               *int           `yaml:"retries"`
+	RetryBackoff          *time.Duration `yaml:"retry_backoff"`
+	RetryMaxBackoff       *time.Duration `yaml:"retry_max_backoff"`
+
+	// Proxy is an http://, https://, socks5:// or socks5h:// URL. When empty
+	// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are
+	// used; "none" disables proxying.
+	Proxy      string   `yaml:"proxy"`
+	CAFiles    []string `yaml:"ca_files"`
+	ClientCert string   `yaml:"client_cert"`
+	ClientKey  string   `yaml:"client_key"`
+}
+
+// DefaultUpstreamConfig holds the values used when neither the global nor
+// the repository config sets a field.
+var DefaultUpstreamConfig = UpstreamConfig{
+	ConnectTimeout:        ptr(10 * time.Second),
+	ResponseHeaderTimeout: ptr(time.Minute),
+	ReadTimeout:           ptr(time.Minute),
+	IdleConnTimeout:       ptr(90 * time.Second),
+	MaxIdleConnsPerHost:   ptr(16),
+	Retries:               ptr(2),
+	RetryBackoff:          ptr(500 * time.Millisecond),
+	RetryMaxBackoff:       ptr(10 * time.Second),
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Merge returns u with every field set in override applied on top.
+func (u UpstreamConfig) Merge(override UpstreamConfig) UpstreamConfig {
+	if override.ConnectTimeout != nil {
+		u.ConnectTimeout = override.ConnectTimeout
+	}
+	if override.ResponseHeaderTimeout != nil {
+		u.ResponseHeaderTimeout = override.ResponseHeaderTimeout
+	}
+	if override.ReadTimeout != nil {
+		u.ReadTimeout = override.ReadTimeout
+	}
+	if override.IdleConnTimeout != nil {
+		u.IdleConnTimeout = override.IdleConnTimeout
+	}
+	if override.MaxIdleConnsPerHost != nil {
+		u.MaxIdleConnsPerHost = override.MaxIdleConnsPerHost
+	}
+	if override.Retries != nil {
+		u.Retries = override.Retries
+	}
+	if override.RetryBackoff != nil {
+		u.RetryBackoff = override.RetryBackoff
+	}
+	if override.RetryMaxBackoff != nil {
+		u.RetryMaxBackoff = override.RetryMaxBackoff
+	}
+	if override.Proxy != "" {
+		u.Proxy = override.Proxy
+	}
+	if len(override.CAFiles) > 0 {
+		u.CAFiles = append(append([]string{}, u.CAFiles...), override.CAFiles...)
+	}
+	if override.ClientCert != "" || override.ClientKey != "" {
+		u.ClientCert = override.ClientCert
+		u.ClientKey = override.ClientKey
+	}
+	return u
+}
+
+// UpstreamSource is a repository upstream URL. It can be written as a plain
+// URL or as a map with per-repository client settings and credentials.
+type UpstreamSource struct {
+	URL      string         `yaml:"url"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Auth     UpstreamAuth   `yaml:"auth"`
+}
+
+func (s *UpstreamSource) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		s.URL = value.Value
+		return nil
+	case yaml.MappingNode:
+		type raw UpstreamSource
+		var decoded raw
+		if err := value.Decode(&decoded); err != nil {
+			return err
+		}
+		*s = UpstreamSource(decoded)
+		return nil
+	default:
+		return fmt.Errorf("upstream source must be string or map")
+	}
+}
+
+// UpstreamAuth holds the credentials sent to a private upstream registry.
+// Either username/password (HTTP basic) or a token is used. A token is sent
+// as "Authorization: Bearer <token>" unless header or scheme are set.
+type UpstreamAuth struct {
+	Username string `yaml:"username"`
+	Password Secret `yaml:"password"`
+	Token    Secret `yaml:"token"`
+	Header   string `yaml:"header"`
+	Scheme   string `yaml:"scheme"`
+	// Hosts lists extra hosts that may receive the credentials. The hosts of
+	// the repository URLs are always allowed.
+	Hosts []string `yaml:"hosts"`
+}
+
+func (a UpstreamAuth) IsSet() bool {
+	return a.Username != "" || a.Token.IsSet()
+}
+
+// Secret is a credential given inline, read from a file or taken from an
+// environment variable. A plain string is an inline value.
+type Secret struct {
+	Value string `yaml:"value"`
+	File  string `yaml:"file"`
+	Env   string `yaml:"env"`
+}
+
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		s.Value = value.Value
+		return nil
+	case yaml.MappingNode:
+		type raw Secret
+		var decoded raw
+		if err := value.Decode(&decoded); err != nil {
+			return err
+		}
+		*s = Secret(decoded)
+		return nil
+	default:
+		return fmt.Errorf("secret must be string or map")
+	}
+}
+
+func (s Secret) IsSet() bool {
+	return s.Value != "" || s.File != "" || s.Env != ""
+}
+
+// Resolve returns the secret value.
+func (s Secret) Resolve() (string, error) {
+	switch {
+	case s.Value != "":
+		return s.Value, nil
+	case s.File != "":
+		data, err := os.ReadFile(filepath.Clean(s.File))
+		if err != nil {
+			return "", fmt.Errorf("read secret file: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	case s.Env != "":
+		value := os.Getenv(s.Env)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is empty", s.Env)
+		}
+		return value, nil
+	default:
+		return "", nil
+	}
+}
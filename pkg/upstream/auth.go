@@ -0,0 +1,119 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/types"
+)
+
+// credentials are attached to requests for the hosts of a private
+// repository and stripped when upstream redirects somewhere else, e.g. to a
+// CDN serving the artifact.
+type credentials struct {
+	username string
+	password string
+	header   string
+	token    string
+	value    string
+	hosts    map[string]struct{}
+}
+
+func newCredentials(auth types.UpstreamAuth, urls []string) (*credentials, error) {
+	cr := &credentials{hosts: map[string]struct{}{}}
+
+	switch {
+	case auth.Username != "":
+		password, err := auth.Password.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("auth password: %v", err)
+		}
+		cr.username = auth.Username
+		cr.password = password
+	case auth.Token.IsSet():
+		token, err := auth.Token.Resolve()
+		if err != nil {
+			return nil, fmt.Errorf("auth token: %v", err)
+		}
+		if token == "" {
+			return nil, errors.New("auth token is empty")
+		}
+		cr.header = auth.Header
+		scheme := auth.Scheme
+		if cr.header == "" {
+			cr.header = "Authorization"
+			if scheme == "" {
+				scheme = "Bearer"
+			}
+		}
+		cr.token = token
+		cr.value = token
+		if scheme != "" {
+			cr.value = scheme + " " + token
+		}
+	default:
+		return nil, nil
+	}
+
+	for _, raw := range urls {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid repository URL %q", raw)
+		}
+		cr.hosts[strings.ToLower(u.Hostname())] = struct{}{}
+	}
+	for _, host := range auth.Hosts {
+		cr.hosts[strings.ToLower(host)] = struct{}{}
+	}
+	return cr, nil
+}
+
+func (cr *credentials) allowed(req *http.Request) bool {
+	_, ok := cr.hosts[strings.ToLower(req.URL.Hostname())]
+	return ok
+}
+
+func (cr *credentials) apply(req *http.Request) {
+	if !cr.allowed(req) {
+		cr.strip(req)
+		return
+	}
+	if cr.username != "" {
+		req.SetBasicAuth(cr.username, cr.password)
+		return
+	}
+	req.Header.Set(cr.header, cr.value)
+}
+
+func (cr *credentials) strip(req *http.Request) {
+	if cr.username != "" {
+		req.Header.Del("Authorization")
+		return
+	}
+	req.Header.Del(cr.header)
+}
+
+func (cr *credentials) secrets() []string {
+	return []string{cr.password, cr.token}
+}
+
+// urlSecrets returns passwords embedded in repository URLs.
+func urlSecrets(urls []string) []string {
+	var found []string
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if password, ok := u.User.Password(); ok {
+			found = append(found, password)
+		}
+	}
+	return found
+}
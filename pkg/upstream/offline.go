@@ -0,0 +1,32 @@
+package upstream
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// ErrOffline is returned for requests sent while hub is in offline mode.
+var ErrOffline = errors.New("offline mode, upstream is not contacted")
+
+var (
+	offline atomic.Bool
+	_       = metrics.NewGauge("hub_offline", func() float64 {
+		if offline.Load() {
+			return 1
+		}
+		return 0
+	})
+)
+
+// SetOffline switches offline mode. While offline, hub only serves what is
+// in the cache directory and clients never reach upstream.
+func SetOffline(enabled bool) {
+	offline.Store(enabled)
+}
+
+// Offline reports whether hub is in offline mode.
+func Offline() bool {
+	return offline.Load()
+}
@@ -0,0 +1,238 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/inflight"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var coalescedTokenRequests = metrics.NewCounter("hub_registry_token_coalesced_total")
+
+// registryAuth implements the token handshake of OCI registries: the
+// registry answers anonymous requests with a WWW-Authenticate challenge
+// naming a token service, which hands out short lived bearer tokens per
+// repository scope, optionally in exchange for credentials.
+//
+// mu only guards the cached state: probes and token requests run without it,
+// concurrent ones for the same scope being coalesced by refreshes, so that a
+// slow token service doesn't hold up pulls with a valid token.
+type registryAuth struct {
+	username  string
+	password  string
+	refreshes *inflight.Group
+
+	mu        sync.Mutex
+	probed    bool
+	scheme    string
+	challenge map[string]string
+	tokens    map[string]registryToken
+}
+
+type registryToken struct {
+	value   string
+	expires time.Time
+}
+
+// defaultTokenLifetime is used when the token service doesn't tell, as the
+// distribution spec suggests.
+const defaultTokenLifetime = 60 * time.Second
+
+func newRegistryAuth(username, password string) *registryAuth {
+	return &registryAuth{
+		username:  username,
+		password:  password,
+		refreshes: inflight.New(coalescedTokenRequests),
+		tokens:    map[string]registryToken{},
+	}
+}
+
+// RegistryAuthorization returns the Authorization header to pull repository
+// name from the registry at base, or an empty string when the registry
+// doesn't ask for one. Tokens are cached until they expire.
+func (c *Client) RegistryAuthorization(base, name string) (string, error) {
+	ra := c.registry
+	if ra == nil {
+		return "", nil
+	}
+	scope := fmt.Sprintf("repository:%s:pull", name)
+
+	ra.mu.Lock()
+	probed := ra.probed
+	ra.mu.Unlock()
+	if !probed {
+		value, _ := ra.refreshes.Do("probe", func() any {
+			return ra.probe(c, base)
+		})
+		if err, _ := value.(error); err != nil {
+			return "", err
+		}
+	}
+
+	ra.mu.Lock()
+	scheme, challenge := ra.scheme, ra.challenge
+	token, cached := ra.tokens[scope]
+	ra.mu.Unlock()
+
+	switch scheme {
+	case "basic":
+		if ra.username == "" {
+			return "", nil
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(ra.username+":"+ra.password)), nil
+	case "bearer":
+		if cached && time.Now().Before(token.expires) {
+			return "Bearer " + token.value, nil
+		}
+		value, _ := ra.refreshes.Do(scope, func() any {
+			token, err := ra.fetchToken(c, challenge, scope)
+			if err != nil {
+				return err
+			}
+			ra.mu.Lock()
+			ra.tokens[scope] = token
+			ra.mu.Unlock()
+			return token
+		})
+		switch result := value.(type) {
+		case registryToken:
+			return "Bearer " + result.value, nil
+		case error:
+			return "", result
+		default:
+			return "", fmt.Errorf("token request for %s did not complete", scope)
+		}
+	default:
+		return "", nil
+	}
+}
+
+// ForgetRegistryToken drops the cached token of name after the registry
+// rejected it, and makes the next request probe the registry again.
+func (c *Client) ForgetRegistryToken(name string) {
+	ra := c.registry
+	if ra == nil {
+		return
+	}
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	delete(ra.tokens, fmt.Sprintf("repository:%s:pull", name))
+	ra.probed = false
+}
+
+func (ra *registryAuth) probe(c *Client, base string) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(base, "/")+"/v2/", http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "hub")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	var scheme string
+	var challenge map[string]string
+	if resp.StatusCode == http.StatusUnauthorized {
+		scheme, challenge = parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		if scheme == "bearer" && challenge["realm"] == "" {
+			return fmt.Errorf("registry challenge without realm: %q", resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+	ra.mu.Lock()
+	ra.scheme, ra.challenge, ra.probed = scheme, challenge, true
+	ra.mu.Unlock()
+	return nil
+}
+
+func (ra *registryAuth) fetchToken(c *Client, challenge map[string]string, scope string) (registryToken, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil {
+		return registryToken{}, fmt.Errorf("invalid token realm: %v", err)
+	}
+	query := realm.Query()
+	if service := challenge["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), http.NoBody)
+	if err != nil {
+		return registryToken{}, err
+	}
+	req.Header.Set("User-Agent", "hub")
+	if ra.username != "" {
+		req.SetBasicAuth(ra.username, ra.password)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return registryToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return registryToken{}, fmt.Errorf("token service returned %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return registryToken{}, fmt.Errorf("token service response: %v", err)
+	}
+	token := registryToken{value: body.Token}
+	if token.value == "" {
+		token.value = body.AccessToken
+	}
+	if token.value == "" {
+		return registryToken{}, fmt.Errorf("token service returned no token")
+	}
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	// Leave some room for the requests made with the token.
+	token.expires = time.Now().Add(lifetime * 9 / 10)
+	return token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`
+// into its lower-cased scheme and parameters.
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params = map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(params[key])
+		}
+		rest = strings.TrimLeft(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return strings.ToLower(scheme), params
+}
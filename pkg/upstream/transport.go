@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/psvmcc/hub/pkg/types"
+)
+
+// proxyFunc returns the proxy selector for the configured proxy URL. HTTP
+// and HTTPS proxies are used with CONNECT for TLS upstreams, SOCKS5 proxies
+// are dialed directly by the transport.
+func proxyFunc(raw string) (func(*http.Request) (*url.URL, error), error) {
+	switch raw {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "none":
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL has no host")
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// tlsClientConfig adds the configured CA bundles to the system pool and
+// loads the client certificate used for mutual TLS.
+func tlsClientConfig(cfg types.UpstreamConfig) (*tls.Config, error) {
+	if len(cfg.CAFiles) == 0 && cfg.ClientCert == "" && cfg.ClientKey == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(cfg.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range cfg.CAFiles {
+			pem, err := os.ReadFile(filepath.Clean(file))
+			if err != nil {
+				return nil, fmt.Errorf("read CA file: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA file %s", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, fmt.Errorf("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
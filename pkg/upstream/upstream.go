@@ -0,0 +1,328 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/psvmcc/hub/pkg/logging"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Client is the HTTP client used for one upstream repository. Clients share
+// connections per repository and retry idempotent requests on 5xx responses
+// and dropped connections.
+type Client struct {
+	name       string
+	http       *http.Client
+	auth       *credentials
+	registry   *registryAuth
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// readTimeout is how long a response body may send nothing before
+	// reading it fails.
+	readTimeout time.Duration
+}
+
+var (
+	mu            sync.RWMutex
+	clients       = map[string]*Client{}
+	defaultClient = &Client{name: "default", http: &http.Client{}}
+)
+
+type repository struct {
+	upstream types.UpstreamConfig
+	auth     types.UpstreamAuth
+	urls     []string
+	registry *registryAuth
+}
+
+// Setup builds a client for every configured repository. Repository
+// settings are merged on top of the global `upstream` section.
+func Setup(cfg types.ConfigFile) error {
+	global := types.DefaultUpstreamConfig.Merge(cfg.Upstream)
+	built := map[string]*Client{}
+
+	repositories := map[string]repository{}
+	sources := func(ecosystem string, m map[string]types.UpstreamSource) {
+		for k, v := range m {
+			repositories[ecosystem+"/"+k] = repository{upstream: v.Upstream, auth: v.Auth, urls: []string{v.URL}}
+		}
+	}
+	sources("pypi", cfg.Server.PYPI)
+	sources("rubygems", cfg.Server.RUBYGEMS)
+	sources("static", cfg.Server.Static)
+	sources("goproxy", cfg.Server.GOPROXY)
+	sources("npm", cfg.Server.NPM)
+	sources("maven", cfg.Server.Maven)
+	sources("apt", cfg.Server.APT)
+	sources("apk", cfg.Server.APK)
+	sources("helm", cfg.Server.Helm)
+	sources("nuget", cfg.Server.NuGet)
+	sources("composer", cfg.Server.Composer)
+	sources("terraform", cfg.Server.Terraform)
+	sources("conda", cfg.Server.Conda)
+	sources("hex", cfg.Server.Hex)
+	sources("pub", cfg.Server.Pub)
+	sources("cran", cfg.Server.CRAN)
+	sources("cpan", cfg.Server.CPAN)
+	for k, v := range cfg.Server.Cargo {
+		repositories["cargo/"+k] = repository{upstream: v.Upstream, auth: v.Auth, urls: []string{v.Base, v.Index, v.DL, v.API}}
+	}
+	for k, v := range cfg.Server.RPM {
+		repositories["rpm/"+k] = repository{upstream: v.Upstream, auth: v.Auth, urls: []string{v.URL, v.Mirrorlist, v.Metalink}}
+	}
+	for k, v := range cfg.Server.OCI {
+		// Registry usernames and passwords are exchanged for bearer tokens
+		// by RegistryAuthorization, only tokens are sent as is.
+		password, err := v.Auth.Password.Resolve()
+		if err != nil {
+			return fmt.Errorf("oci/%s: auth password: %v", k, err)
+		}
+		logging.AddSecrets(password)
+		auth := v.Auth
+		auth.Username, auth.Password = "", types.Secret{}
+		repositories["oci/"+k] = repository{upstream: v.Upstream, auth: auth, urls: []string{v.URL}, registry: newRegistryAuth(v.Auth.Username, password)}
+	}
+	for k, v := range cfg.Server.Galaxy {
+		if v.URL != "" {
+			repositories["galaxy/"+k] = repository{upstream: v.Upstream, auth: v.Auth, urls: []string{v.URL}}
+		}
+	}
+
+	for name, repo := range repositories {
+		client, err := New(name, global.Merge(repo.upstream))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		logging.AddSecrets(urlSecrets(repo.urls)...)
+		if err = client.setCredentials(repo.auth, repo.urls); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		client.registry = repo.registry
+		built[name] = client
+	}
+	fallback, err := New("default", global)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	clients = built
+	defaultClient = fallback
+	mu.Unlock()
+	return nil
+}
+
+// Get returns the client for a repository, falling back to the global one.
+func Get(ecosystem, key string) *Client {
+	mu.RLock()
+	defer mu.RUnlock()
+	if c, ok := clients[ecosystem+"/"+key]; ok {
+		return c
+	}
+	return defaultClient
+}
+
+// Default returns the client built from the global settings.
+func Default() *Client {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultClient
+}
+
+// New builds a client from the given settings.
+func New(name string, cfg types.UpstreamConfig) (*Client, error) {
+	proxy, err := proxyFunc(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsClientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   value(cfg.ConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   value(cfg.ConnectTimeout),
+		ResponseHeaderTimeout: value(cfg.ResponseHeaderTimeout),
+		IdleConnTimeout:       value(cfg.IdleConnTimeout),
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   value(cfg.MaxIdleConnsPerHost),
+		ExpectContinueTimeout: time.Second,
+	}
+	retries := max(value(cfg.Retries), 0)
+	if retries > 0 && value(cfg.RetryBackoff) <= 0 {
+		return nil, errors.New("retry_backoff must be above 0 when retries are enabled")
+	}
+	return &Client{
+		name:        name,
+		http:        &http.Client{Transport: transport},
+		retries:     retries,
+		backoff:     value(cfg.RetryBackoff),
+		maxBackoff:  value(cfg.RetryMaxBackoff),
+		readTimeout: value(cfg.ReadTimeout),
+	}, nil
+}
+
+// value returns the setting p points to, or the zero value when it is unset.
+func value[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
+
+// setCredentials makes the client authenticate to the repository hosts.
+func (c *Client) setCredentials(auth types.UpstreamAuth, urls []string) error {
+	if !auth.IsSet() {
+		return nil
+	}
+	cr, err := newCredentials(auth, urls)
+	if err != nil {
+		return err
+	}
+	logging.AddSecrets(cr.secrets()...)
+	c.auth = cr
+	c.http.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		cr.apply(req)
+		return nil
+	}
+	return nil
+}
+
+// Name returns the repository the client belongs to, e.g. "npm/npmjs".
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Do sends req, retrying with exponential backoff when upstream answers
+// with a 5xx status or the connection is reset. Requests with a body that
+// cannot be replayed are sent once. Reading the response body fails once
+// upstream sent nothing for the read timeout. Nothing is sent in offline
+// mode.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if Offline() {
+		return nil, ErrOffline
+	}
+	if c.readTimeout <= 0 {
+		return c.do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	body := &idleBody{ReadCloser: resp.Body, timeout: c.readTimeout, cancel: cancel}
+	body.timer = time.AfterFunc(c.readTimeout, func() {
+		body.stalled.Store(true)
+		cancel()
+	})
+	resp.Body = body
+	return resp, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	delay := c.backoff
+	if c.auth != nil {
+		c.auth.apply(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := c.http.Do(req)
+		if attempt >= c.retries || !replayable || !retryable(resp, err) {
+			return resp, err
+		}
+
+		if err == nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			_ = resp.Body.Close()
+		}
+		metrics.GetOrCreateCounter(fmt.Sprintf("hub_upstream_retries_total{upstream=%q}", c.name)).Inc()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if c.maxBackoff > 0 && delay > c.maxBackoff {
+			delay = c.maxBackoff
+		}
+	}
+}
+
+// idleBody is a response body that is aborted when upstream stalls, so that
+// a transfer and the requests waiting for it are not held forever.
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.stalled.Load() {
+		return n, fmt.Errorf("no data received from upstream for %s", b.timeout)
+	}
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Head issues a HEAD request for url.
+func (c *Client) Head(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "hub")
+	return c.Do(req)
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, io.EOF) ||
+			errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,434 @@
+package warm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Package is a dependency found in a lockfile. Packages without a version
+// only get their metadata cached.
+type Package struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	// ModOnly marks go.sum entries that only pin the go.mod file.
+	ModOnly bool `json:"-"`
+}
+
+func (p Package) String() string {
+	if p.Version == "" {
+		return p.Ecosystem + " " + p.Name
+	}
+	return p.Ecosystem + " " + p.Name + " " + p.Version
+}
+
+var parsers = map[string]func(data []byte) ([]Package, error){
+	"requirements.txt":  parseRequirementsTxt,
+	"poetry.lock":       parsePoetryLock,
+	"package-lock.json": parsePackageLock,
+	"yarn.lock":         parseYarnLock,
+	"pnpm-lock.yaml":    parsePnpmLock,
+	"Cargo.lock":        parseCargoLock,
+	"go.sum":            parseGoSum,
+	"Gemfile.lock":      parseGemfileLock,
+	"requirements.yml":  parseGalaxyRequirements,
+}
+
+// Kinds lists the supported lockfile kinds.
+func Kinds() []string {
+	kinds := make([]string, 0, len(parsers))
+	for k := range parsers {
+		kinds = append(kinds, k)
+	}
+	slices.Sort(kinds)
+	return kinds
+}
+
+// Detect returns the lockfile kind of a file name.
+func Detect(filename string) (string, bool) {
+	base := filepath.Base(filename)
+	switch {
+	case base == "npm-shrinkwrap.json":
+		return "package-lock.json", true
+	case base == "requirements.yaml":
+		return "requirements.yml", true
+	case strings.HasPrefix(base, "requirements") && strings.HasSuffix(base, ".txt"):
+		return "requirements.txt", true
+	}
+	_, ok := parsers[base]
+	return base, ok
+}
+
+// Parse extracts the packages of a lockfile of the given kind.
+func Parse(kind string, data []byte) ([]Package, error) {
+	parse, ok := parsers[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported lockfile %q, supported: %s", kind, strings.Join(Kinds(), ", "))
+	}
+	packages, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", kind, err)
+	}
+	return packages, nil
+}
+
+var requirementRe = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)\s*(\[[^\]]*\])?\s*(===|==|~=|>=|<=|!=|<|>)?\s*([^\s,;]*)`)
+
+func parseRequirementsTxt(data []byte) ([]Package, error) {
+	var packages []Package
+	text := strings.ReplaceAll(string(data), "\\\n", " ")
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-") || strings.Contains(line, "://") {
+			continue
+		}
+		m := requirementRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		p := Package{Ecosystem: "pypi", Name: m[1]}
+		if (m[3] == "==" || m[3] == "===") && !strings.Contains(m[4], "*") {
+			p.Version = m[4]
+		}
+		packages = append(packages, p)
+	}
+	return packages, nil
+}
+
+func parsePoetryLock(data []byte) ([]Package, error) {
+	var lock struct {
+		Package []struct {
+			Name    string `toml:"name"`
+			Version string `toml:"version"`
+			Source  struct {
+				Type string `toml:"type"`
+			} `toml:"source"`
+		} `toml:"package"`
+	}
+	if _, err := toml.Decode(string(data), &lock); err != nil {
+		return nil, err
+	}
+	var packages []Package
+	for _, p := range lock.Package {
+		switch p.Source.Type {
+		case "", "legacy":
+			packages = append(packages, Package{Ecosystem: "pypi", Name: p.Name, Version: p.Version})
+		}
+	}
+	return packages, nil
+}
+
+func parsePackageLock(data []byte) ([]Package, error) {
+	type dependency struct {
+		Version      string                `json:"version"`
+		Resolved     string                `json:"resolved"`
+		Dependencies map[string]dependency `json:"dependencies"`
+	}
+	var lock struct {
+		Packages map[string]struct {
+			Name     string `json:"name"`
+			Version  string `json:"version"`
+			Resolved string `json:"resolved"`
+			Link     bool   `json:"link"`
+		} `json:"packages"`
+		Dependencies map[string]dependency `json:"dependencies"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+
+	seen := map[Package]bool{}
+	var packages []Package
+	add := func(name, version, resolved string) {
+		// Aliases are recorded as "npm:<name>@<version>".
+		if alias, ok := strings.CutPrefix(version, "npm:"); ok {
+			if i := strings.LastIndex(alias, "@"); i > 0 {
+				name, version = alias[:i], alias[i+1:]
+			}
+		}
+		if name == "" || !npmRegistryVersion(version, resolved) {
+			return
+		}
+		p := Package{Ecosystem: "npm", Name: name, Version: version}
+		if !seen[p] {
+			seen[p] = true
+			packages = append(packages, p)
+		}
+	}
+
+	if len(lock.Packages) > 0 {
+		for key, p := range lock.Packages {
+			i := strings.LastIndex(key, "node_modules/")
+			if key == "" || p.Link || i < 0 {
+				continue
+			}
+			name := key[i+len("node_modules/"):]
+			if p.Name != "" {
+				name = p.Name
+			}
+			add(name, p.Version, p.Resolved)
+		}
+	} else {
+		var walk func(map[string]dependency)
+		walk = func(deps map[string]dependency) {
+			for name, d := range deps {
+				add(name, d.Version, d.Resolved)
+				walk(d.Dependencies)
+			}
+		}
+		walk(lock.Dependencies)
+	}
+	sortPackages(packages)
+	return packages, nil
+}
+
+// npmRegistryVersion reports whether a lockfile entry comes from a registry
+// rather than git, a tarball URL or the local file system.
+func npmRegistryVersion(version, resolved string) bool {
+	if version == "" || strings.ContainsAny(version, ":/") {
+		return false
+	}
+	return resolved == "" || strings.Contains(resolved, "/-/")
+}
+
+func parseYarnLock(data []byte) ([]Package, error) {
+	seen := map[Package]bool{}
+	var packages []Package
+	var spec, version, resolution string
+	flush := func() {
+		defer func() { spec, version, resolution = "", "", "" }()
+		if spec == "" || version == "" {
+			return
+		}
+		name := ""
+		if resolution != "" {
+			// Berry: resolution "name@npm:1.2.3"; workspaces, patches and
+			// git dependencies use other protocols.
+			n, v, ok := strings.Cut(resolution, "@npm:")
+			if !ok || strings.Contains(v, ":") {
+				return
+			}
+			name, version = n, v
+		} else {
+			first, _, _ := strings.Cut(spec, ",")
+			first = strings.Trim(strings.TrimSpace(first), `"`)
+			if _, target, ok := strings.Cut(first, "@npm:"); ok {
+				first = target
+			}
+			i := strings.LastIndex(first, "@")
+			if i <= 0 {
+				return
+			}
+			name = first[:i]
+			if strings.ContainsAny(first[i+1:], ":/") && !strings.HasPrefix(first[i+1:], "npm:") {
+				return
+			}
+		}
+		p := Package{Ecosystem: "npm", Name: name, Version: version}
+		if !seen[p] {
+			seen[p] = true
+			packages = append(packages, p)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			continue
+		case !strings.HasPrefix(line, " "):
+			flush()
+			spec = strings.TrimSuffix(trimmed, ":")
+			if strings.HasPrefix(spec, "__metadata") {
+				spec = ""
+			}
+		case strings.HasPrefix(line, "  ") && !strings.HasPrefix(line, "   "):
+			key, value, _ := strings.Cut(trimmed, " ")
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			switch strings.TrimSuffix(key, ":") {
+			case "version":
+				version = value
+			case "resolution":
+				resolution = value
+			}
+		}
+	}
+	flush()
+	sortPackages(packages)
+	return packages, scanner.Err()
+}
+
+func parsePnpmLock(data []byte) ([]Package, error) {
+	var lock struct {
+		LockfileVersion string `yaml:"lockfileVersion"`
+		Packages        map[string]struct {
+			Resolution struct {
+				Tarball string `yaml:"tarball"`
+				Type    string `yaml:"type"`
+			} `yaml:"resolution"`
+		} `yaml:"packages"`
+	}
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	seen := map[Package]bool{}
+	var packages []Package
+	for key, entry := range lock.Packages {
+		if entry.Resolution.Type != "" || entry.Resolution.Tarball != "" && !strings.Contains(entry.Resolution.Tarball, "/-/") {
+			continue
+		}
+		key = strings.TrimPrefix(key, "/")
+		if i := strings.Index(key, "("); i > 0 {
+			key = key[:i]
+		}
+		var name, version string
+		if strings.HasPrefix(lock.LockfileVersion, "5") {
+			// "name/1.2.3_peer@1.0.0", with slashes of peers encoded as "+"
+			if i := strings.LastIndex(key, "/"); i > 0 {
+				name, version = key[:i], key[i+1:]
+				version, _, _ = strings.Cut(version, "_")
+			}
+		} else if i := strings.LastIndex(key, "@"); i > 0 {
+			// "name@1.2.3"
+			name, version = key[:i], key[i+1:]
+		}
+		if name == "" || strings.ContainsAny(version, ":/") {
+			continue
+		}
+		p := Package{Ecosystem: "npm", Name: name, Version: version}
+		if !seen[p] {
+			seen[p] = true
+			packages = append(packages, p)
+		}
+	}
+	sortPackages(packages)
+	return packages, nil
+}
+
+func parseCargoLock(data []byte) ([]Package, error) {
+	var lock struct {
+		Package []struct {
+			Name    string `toml:"name"`
+			Version string `toml:"version"`
+			Source  string `toml:"source"`
+		} `toml:"package"`
+	}
+	if _, err := toml.Decode(string(data), &lock); err != nil {
+		return nil, err
+	}
+	var packages []Package
+	for _, p := range lock.Package {
+		if strings.HasPrefix(p.Source, "registry+") || strings.HasPrefix(p.Source, "sparse+") {
+			packages = append(packages, Package{Ecosystem: "cargo", Name: p.Name, Version: p.Version})
+		}
+	}
+	return packages, nil
+}
+
+func parseGoSum(data []byte) ([]Package, error) {
+	modOnly := map[Package]bool{}
+	var order []Package
+	for line := range strings.Lines(string(data)) {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		version, onlyMod := strings.CutSuffix(fields[1], "/go.mod")
+		p := Package{Ecosystem: "goproxy", Name: fields[0], Version: version}
+		current, seen := modOnly[p]
+		if !seen {
+			order = append(order, p)
+		}
+		modOnly[p] = (current || !seen) && onlyMod
+	}
+	packages := make([]Package, 0, len(order))
+	for _, p := range order {
+		p.ModOnly = modOnly[p]
+		packages = append(packages, p)
+	}
+	return packages, nil
+}
+
+var gemSpecRe = regexp.MustCompile(`^    ([^\s(]+) \(([^)]+)\)$`)
+
+func parseGemfileLock(data []byte) ([]Package, error) {
+	var packages []Package
+	inGem := false
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" && !strings.HasPrefix(line, " ") {
+			inGem = line == "GEM"
+			continue
+		}
+		if !inGem {
+			continue
+		}
+		if m := gemSpecRe.FindStringSubmatch(line); m != nil {
+			packages = append(packages, Package{Ecosystem: "rubygems", Name: m[1], Version: m[2]})
+		}
+	}
+	return packages, nil
+}
+
+func parseGalaxyRequirements(data []byte) ([]Package, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	// The old format is a plain list of roles, which hub doesn't serve.
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	var requirements struct {
+		Collections []yaml.Node `yaml:"collections"`
+	}
+	if err := doc.Decode(&requirements); err != nil {
+		return nil, err
+	}
+	var packages []Package
+	for _, node := range requirements.Collections {
+		var c struct {
+			Name    string `yaml:"name"`
+			Version string `yaml:"version"`
+			Type    string `yaml:"type"`
+		}
+		if node.Kind == yaml.ScalarNode {
+			c.Name = node.Value
+		} else if err := node.Decode(&c); err != nil {
+			return nil, err
+		}
+		if c.Type != "" && c.Type != "galaxy" || strings.Count(c.Name, ".") != 1 || strings.ContainsAny(c.Name, "/:") {
+			continue
+		}
+		version := strings.TrimPrefix(strings.TrimSpace(c.Version), "==")
+		if version == "*" || strings.ContainsAny(version, "<>=!,") {
+			version = ""
+		}
+		packages = append(packages, Package{Ecosystem: "galaxy", Name: c.Name, Version: version})
+	}
+	return packages, nil
+}
+
+func sortPackages(packages []Package) {
+	slices.SortFunc(packages, func(a, b Package) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Version, b.Version)
+	})
+}
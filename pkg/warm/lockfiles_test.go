@@ -0,0 +1,223 @@
+package warm
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	pypi := func(name, version string) Package { return Package{Ecosystem: "pypi", Name: name, Version: version} }
+	npm := func(name, version string) Package { return Package{Ecosystem: "npm", Name: name, Version: version} }
+	gomod := func(name, version string, modOnly bool) Package {
+		return Package{Ecosystem: "goproxy", Name: name, Version: version, ModOnly: modOnly}
+	}
+
+	tests := []struct {
+		file string
+		kind string
+		want []Package
+	}{
+		{
+			// Only == and === pins without wildcards keep their version.
+			file: "requirements.txt",
+			kind: "requirements.txt",
+			want: []Package{
+				pypi("requests", "2.31.0"),
+				pypi("Django", "4.2.7"),
+				pypi("flask", ""),
+				pypi("numpy", ""),
+				pypi("urllib3", "2.0.7"),
+				pypi("six", "1.16.0"),
+				pypi("pyyaml", ""),
+			},
+		},
+		{
+			// Git and directory sources are skipped, legacy ones are kept.
+			file: "poetry.lock",
+			kind: "poetry.lock",
+			want: []Package{
+				pypi("requests", "2.31.0"),
+				pypi("internal-lib", "0.1.0"),
+			},
+		},
+		{
+			file: "package-lock-v1.json",
+			kind: "package-lock.json",
+			want: []Package{
+				npm("@types/node", "20.8.0"),
+				npm("lodash", "4.17.21"),
+				npm("semver", "5.7.2"),
+				npm("strip-ansi", "6.0.1"),
+				npm("wrap", "1.0.0"),
+			},
+		},
+		{
+			file: "package-lock-v3.json",
+			kind: "package-lock.json",
+			want: []Package{
+				npm("@babel/core", "7.23.0"),
+				npm("lodash", "4.17.21"),
+				npm("semver", "6.3.1"),
+				npm("semver", "7.5.4"),
+				npm("string-width", "4.2.3"),
+			},
+		},
+		{
+			file: "yarn-v1.lock",
+			kind: "yarn.lock",
+			want: []Package{
+				npm("@babel/code-frame", "7.22.13"),
+				npm("lodash", "4.17.21"),
+				npm("string-width", "4.2.3"),
+			},
+		},
+		{
+			file: "yarn-berry.lock",
+			kind: "yarn.lock",
+			want: []Package{
+				npm("@babel/core", "7.23.0"),
+				npm("lodash", "4.17.21"),
+			},
+		},
+		{
+			file: "pnpm-lock-v5.yaml",
+			kind: "pnpm-lock.yaml",
+			want: []Package{
+				npm("@babel/core", "7.23.0"),
+				npm("react-dom", "18.2.0"),
+			},
+		},
+		{
+			file: "pnpm-lock-v6.yaml",
+			kind: "pnpm-lock.yaml",
+			want: []Package{
+				npm("@babel/core", "7.23.0"),
+				npm("react", "18.2.0"),
+				npm("react-dom", "18.2.0"),
+			},
+		},
+		{
+			file: "pnpm-lock-v9.yaml",
+			kind: "pnpm-lock.yaml",
+			want: []Package{
+				npm("@babel/core", "7.23.0"),
+				npm("lodash", "4.17.21"),
+				npm("private", "1.0.0"),
+			},
+		},
+		{
+			file: "Cargo.lock",
+			kind: "Cargo.lock",
+			want: []Package{
+				{Ecosystem: "cargo", Name: "serde", Version: "1.0.190"},
+				{Ecosystem: "cargo", Name: "tokio", Version: "1.33.0"},
+			},
+		},
+		{
+			// Versions only listed with their /go.mod hash need no zip.
+			file: "go.sum",
+			kind: "go.sum",
+			want: []Package{
+				gomod("github.com/pkg/errors", "v0.9.1", false),
+				gomod("golang.org/x/text", "v0.3.0", true),
+				gomod("golang.org/x/text", "v0.14.0", false),
+				gomod("gopkg.in/yaml.v3", "v3.0.1", false),
+			},
+		},
+		{
+			file: "Gemfile.lock",
+			kind: "Gemfile.lock",
+			want: []Package{
+				{Ecosystem: "rubygems", Name: "actionpack", Version: "7.1.1"},
+				{Ecosystem: "rubygems", Name: "nokogiri", Version: "1.15.4-x86_64-linux"},
+				{Ecosystem: "rubygems", Name: "rack", Version: "3.0.8"},
+			},
+		},
+		{
+			file: "requirements.yml",
+			kind: "requirements.yml",
+			want: []Package{
+				{Ecosystem: "galaxy", Name: "community.general"},
+				{Ecosystem: "galaxy", Name: "ansible.posix", Version: "1.5.4"},
+				{Ecosystem: "galaxy", Name: "community.docker"},
+				{Ecosystem: "galaxy", Name: "kubernetes.core", Version: "2.4.0"},
+				{Ecosystem: "galaxy", Name: "amazon.aws"},
+			},
+		},
+		{
+			// The old format only lists roles.
+			file: "requirements-roles.yml",
+			kind: "requirements.yml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Parse(tt.kind, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Parse(%q) =\n%+v\nwant\n%+v", tt.kind, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		kind string
+		data string
+	}{
+		{kind: "poetry.lock", data: "[[package]\n"},
+		{kind: "package-lock.json", data: "{"},
+		{kind: "pnpm-lock.yaml", data: "packages: [\n"},
+		{kind: "Cargo.lock", data: "version = \n"},
+		{kind: "requirements.yml", data: "collections: {\n"},
+		{kind: "pom.xml", data: "<project/>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			if _, err := Parse(tt.kind, []byte(tt.data)); err == nil {
+				t.Errorf("Parse(%q) succeeded", tt.kind)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		filename string
+		kind     string
+		ok       bool
+	}{
+		{filename: "requirements.txt", kind: "requirements.txt", ok: true},
+		{filename: "ci/requirements-dev.txt", kind: "requirements.txt", ok: true},
+		{filename: "poetry.lock", kind: "poetry.lock", ok: true},
+		{filename: "web/package-lock.json", kind: "package-lock.json", ok: true},
+		{filename: "npm-shrinkwrap.json", kind: "package-lock.json", ok: true},
+		{filename: "yarn.lock", kind: "yarn.lock", ok: true},
+		{filename: "pnpm-lock.yaml", kind: "pnpm-lock.yaml", ok: true},
+		{filename: "Cargo.lock", kind: "Cargo.lock", ok: true},
+		{filename: "go.sum", kind: "go.sum", ok: true},
+		{filename: "Gemfile.lock", kind: "Gemfile.lock", ok: true},
+		{filename: "requirements.yml", kind: "requirements.yml", ok: true},
+		{filename: "collections/requirements.yaml", kind: "requirements.yml", ok: true},
+		{filename: "package.json"},
+		{filename: "requirements.in"},
+		{filename: "go.mod"},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.filename), func(t *testing.T) {
+			kind, ok := Detect(tt.filename)
+			if ok != tt.ok || (ok && kind != tt.kind) {
+				t.Errorf("Detect(%q) = %q, %v, want %q, %v", tt.filename, kind, ok, tt.kind, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package warm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/types"
+
+	"golang.org/x/mod/module"
+)
+
+const DefaultConcurrency = 8
+
+type Options struct {
+	// Repositories maps a repository type to the key of the repository to
+	// warm. Types without an entry use their only configured repository.
+	Repositories map[string]string
+	Concurrency  int
+}
+
+type Failure struct {
+	Package Package `json:"package"`
+	Error   string  `json:"error"`
+}
+
+type Report struct {
+	Packages int       `json:"packages"`
+	Files    int       `json:"files"`
+	Failures []Failure `json:"failures"`
+}
+
+// Resolve picks the repository key for each repository type used by
+// packages.
+func Resolve(cfg types.ConfigFile, packages []Package, explicit map[string]string) (map[string]string, error) {
+	configured := map[string][]string{}
+	for _, r := range types.ConfiguredRepositories(cfg) {
+		if r.Type == "galaxy" && r.URL == "" {
+			continue
+		}
+		configured[r.Type] = append(configured[r.Type], r.Key)
+	}
+
+	keys := map[string]string{}
+	for _, p := range packages {
+		if _, ok := keys[p.Ecosystem]; ok {
+			continue
+		}
+		candidates := configured[p.Ecosystem]
+		if key, ok := explicit[p.Ecosystem]; ok {
+			if !slices.Contains(candidates, key) {
+				return nil, fmt.Errorf("no %s repository %q configured", p.Ecosystem, key)
+			}
+			keys[p.Ecosystem] = key
+			continue
+		}
+		switch len(candidates) {
+		case 0:
+			return nil, fmt.Errorf("no %s repository configured", p.Ecosystem)
+		case 1:
+			keys[p.Ecosystem] = candidates[0]
+		default:
+			return nil, fmt.Errorf("several %s repositories configured (%s), choose one with %s=<key>", p.Ecosystem, strings.Join(candidates, ", "), p.Ecosystem)
+		}
+	}
+	return keys, nil
+}
+
+// Run fetches the metadata and artifacts of packages through handler, so
+// they are cached exactly as if a client had requested them.
+func Run(ctx context.Context, handler http.Handler, cfg types.ConfigFile, packages []Package, opts Options) (Report, error) {
+	keys, err := Resolve(cfg, packages, opts.Repositories)
+	if err != nil {
+		return Report{}, err
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	seen := map[Package]bool{}
+	var unique []Package
+	for _, p := range packages {
+		if !seen[p] {
+			seen[p] = true
+			unique = append(unique, p)
+		}
+	}
+
+	report := Report{Packages: len(unique), Failures: []Failure{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan Package)
+	for range min(concurrency, len(unique)) {
+		wg.Go(func() {
+			for p := range queue {
+				f := &fetcher{ctx: ctx, handler: handler}
+				err := warmers[p.Ecosystem](f, keys[p.Ecosystem], p)
+				mu.Lock()
+				report.Files += f.files
+				if err != nil {
+					report.Failures = append(report.Failures, Failure{Package: p, Error: err.Error()})
+				}
+				mu.Unlock()
+			}
+		})
+	}
+	for _, p := range unique {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+
+	slices.SortFunc(report.Failures, func(a, b Failure) int { return strings.Compare(a.Package.String(), b.Package.String()) })
+	return report, nil
+}
+
+// fetcher sends requests to the hub handlers in-process.
+type fetcher struct {
+	ctx     context.Context
+	handler http.Handler
+	files   int
+}
+
+func (f *fetcher) get(path string, header http.Header, keep bool) ([]byte, error) {
+	u, err := url.Parse("http://hub" + path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(req.Header, header)
+	req.RequestURI = u.RequestURI()
+	w := &recorder{header: http.Header{}, keep: keep}
+	f.handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", path, w.status)
+	}
+	f.files++
+	return w.body.Bytes(), nil
+}
+
+// recorder is a ResponseWriter that drops the body unless it's needed to
+// find the files to fetch next.
+type recorder struct {
+	header http.Header
+	status int
+	keep   bool
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.keep && r.status == http.StatusOK {
+		return r.body.Write(b)
+	}
+	return len(b), nil
+}
+
+func (r *recorder) Flush() {}
+
+var warmers = map[string]func(f *fetcher, key string, p Package) error{
+	"pypi":     warmPypi,
+	"npm":      warmNpm,
+	"cargo":    warmCargo,
+	"goproxy":  warmGoProxy,
+	"rubygems": warmRubyGems,
+	"galaxy":   warmGalaxy,
+}
+
+var (
+	pypiNameRe = regexp.MustCompile(`[-_.]+`)
+	hrefRe     = regexp.MustCompile(`href="([^"#]+)`)
+)
+
+func warmPypi(f *fetcher, key string, p Package) error {
+	name := strings.ToLower(pypiNameRe.ReplaceAllString(p.Name, "-"))
+	index, err := f.get(fmt.Sprintf("/pypi/%s/simple/%s/", key, name), nil, true)
+	if err != nil || p.Version == "" {
+		return err
+	}
+	found := false
+	for _, m := range hrefRe.FindAllSubmatch(index, -1) {
+		u, errURL := url.Parse(string(m[1]))
+		if errURL != nil {
+			continue
+		}
+		file := u.Path[strings.LastIndex(u.Path, "/")+1:]
+		if !strings.EqualFold(storage.PypiVersion(file), p.Version) {
+			continue
+		}
+		found = true
+		if _, err = f.get(u.EscapedPath(), nil, false); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("no files for version %s", p.Version)
+	}
+	return nil
+}
+
+func warmNpm(f *fetcher, key string, p Package) error {
+	name := p.Name
+	if strings.HasPrefix(name, "@") {
+		name = strings.Replace(name, "/", "%2F", 1)
+	}
+	header := http.Header{"Accept": {"application/vnd.npm.install-v1+json"}}
+	data, err := f.get(fmt.Sprintf("/npm/%s/%s", key, name), header, p.Version != "")
+	if err != nil || p.Version == "" {
+		return err
+	}
+	var packument struct {
+		Versions map[string]struct {
+			Dist struct {
+				Tarball string `json:"tarball"`
+			} `json:"dist"`
+		} `json:"versions"`
+	}
+	if err = json.Unmarshal(data, &packument); err != nil {
+		return fmt.Errorf("packument: %v", err)
+	}
+	v, ok := packument.Versions[p.Version]
+	if !ok || v.Dist.Tarball == "" {
+		return fmt.Errorf("version %s not found", p.Version)
+	}
+	u, err := url.Parse(v.Dist.Tarball)
+	if err != nil {
+		return fmt.Errorf("tarball URL: %v", err)
+	}
+	_, err = f.get(u.RequestURI(), nil, false)
+	return err
+}
+
+func warmCargo(f *fetcher, key string, p Package) error {
+	if _, err := f.get(fmt.Sprintf("/cargo/%s/index/%s", key, storage.CargoIndexPath(p.Name)), nil, false); err != nil || p.Version == "" {
+		return err
+	}
+	_, err := f.get(fmt.Sprintf("/cargo/%s/crates/%s/%s/download", key, p.Name, p.Version), nil, false)
+	return err
+}
+
+func warmGoProxy(f *fetcher, key string, p Package) error {
+	path, err := module.EscapePath(p.Name)
+	if err != nil {
+		return err
+	}
+	if p.Version == "" {
+		_, err = f.get(fmt.Sprintf("/goproxy/%s/%s/@v/list", key, path), nil, false)
+		return err
+	}
+	version, err := module.EscapeVersion(p.Version)
+	if err != nil {
+		return err
+	}
+	exts := []string{".info", ".mod", ".zip"}
+	if p.ModOnly {
+		exts = []string{".mod"}
+	}
+	for _, ext := range exts {
+		if _, err = f.get(fmt.Sprintf("/goproxy/%s/%s/@v/%s%s", key, path, version, ext), nil, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func warmRubyGems(f *fetcher, key string, p Package) error {
+	if _, err := f.get(fmt.Sprintf("/rubygems/%s/info/%s", key, p.Name), nil, false); err != nil || p.Version == "" {
+		return err
+	}
+	_, err := f.get(fmt.Sprintf("/rubygems/%s/gems/%s-%s.gem", key, p.Name, p.Version), nil, false)
+	return err
+}
+
+func warmGalaxy(f *fetcher, key string, p Package) error {
+	namespace, name, _ := strings.Cut(p.Name, ".")
+	base := fmt.Sprintf("/galaxy/%s/api/v3/collections/%s/%s/", key, namespace, name)
+	data, err := f.get(base, nil, p.Version == "")
+	if err != nil {
+		return err
+	}
+	version := p.Version
+	if version == "" {
+		var collection types.GalaxyCollection
+		if err = json.Unmarshal(data, &collection); err != nil {
+			return fmt.Errorf("collection: %v", err)
+		}
+		if version = collection.HighestVersion.Version; version == "" {
+			return fmt.Errorf("no versions found")
+		}
+	}
+	for _, path := range []string{
+		base + "versions/",
+		base + "versions/" + version + "/",
+		fmt.Sprintf("/galaxy/%s/get/%s/%s/%s", key, namespace, name, version),
+	} {
+		if _, err = f.get(path, nil, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/psvmcc/hub/pkg/logging"
+	"github.com/psvmcc/hub/pkg/storage"
+	"github.com/psvmcc/hub/pkg/upstream"
+	"github.com/psvmcc/hub/pkg/warm"
+
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+)
+
+var warmCommand = &cli.Command{
+	Name:      "warm",
+	Usage:     "Prefetch the packages of lockfiles into the cache",
+	ArgsUsage: "<lockfile>...",
+	Description: "Supported lockfiles: " + strings.Join(warm.Kinds(), ", ") +
+		" (including requirements-*.txt and npm-shrinkwrap.json).",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Config path",
+			Value:   "config.yaml",
+			EnvVars: []string{"HUB_CONFIG"},
+		},
+		&cli.BoolFlag{
+			Name:    "verbose",
+			Usage:   "Verbose logging",
+			EnvVars: []string{"HUB_VERBOSE"},
+		},
+		&cli.StringSliceFlag{
+			Name:  "repository",
+			Usage: "Repository to warm for a type, as <type>=<key>",
+		},
+		&cli.StringFlag{
+			Name:  "type",
+			Usage: "Lockfile kind, when it can't be detected from the file name",
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "Packages fetched in parallel",
+			Value: warm.DefaultConcurrency,
+		},
+	},
+	Action: warmCache,
+}
+
+func warmCache(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.Exit("usage: hub warm [options] <lockfile>...", 2)
+	}
+	cfg.Load(c.String("config"))
+	logger := logging.Build(c.Bool("verbose"))
+	zap.ReplaceGlobals(logger)
+	if err := upstream.Setup(cfg); err != nil {
+		log.Fatalf("Upstream client setup error: %v", err)
+	}
+	// Quotas apply to prefetched files like to served ones.
+	if err := storage.Setup(cfg); err != nil {
+		log.Fatalf("Cache config error: %v", err)
+	}
+
+	opts := warm.Options{Repositories: map[string]string{}, Concurrency: c.Int("concurrency")}
+	for _, r := range c.StringSlice("repository") {
+		ecosystem, key, ok := strings.Cut(r, "=")
+		if !ok {
+			return cli.Exit(fmt.Sprintf("invalid repository %q, expected <type>=<key>", r), 2)
+		}
+		opts.Repositories[ecosystem] = key
+	}
+
+	var packages []warm.Package
+	for _, file := range c.Args().Slice() {
+		kind := c.String("type")
+		if kind == "" {
+			var ok bool
+			if kind, ok = warm.Detect(file); !ok {
+				return cli.Exit(fmt.Sprintf("%s: unknown lockfile, set --type", file), 2)
+			}
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		found, err := warm.Parse(kind, data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		packages = append(packages, found...)
+	}
+
+	report, err := warm.Run(c.Context, newServer(withContext(zap.S().Named("warm"))), cfg, packages, opts)
+	if err != nil {
+		return cli.Exit(err.Error(), 2)
+	}
+	// Runs shorter than the eviction interval would otherwise leave the
+	// cache over quota until the server sweeps it.
+	if cfg.Cache.Enabled() {
+		storage.Sweep(cfg)
+	}
+	for _, f := range report.Failures {
+		fmt.Printf("FAILED %s: %s\n", f.Package, f.Error)
+	}
+	fmt.Printf("Warmed %d packages (%d files), %d failed\n", report.Packages-len(report.Failures), report.Files, len(report.Failures))
+	if len(report.Failures) > 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}